@@ -0,0 +1,66 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+)
+
+// runChild runs a command with the extra environment variables until it exits, returning its exit status.
+// If ctx is cancelled first, the command is asked to terminate and is killed if it hasn't exited within
+// timeout.
+func runChild(ctx context.Context, args []string, env []model.EnvVar, timeout time.Duration) int {
+	c := exec.Command(args[0], args[1:]...)
+	c.Stdin = os.Stdin
+	c.Stdout = os.Stdout
+	c.Stderr = os.Stderr
+	c.Env = os.Environ()
+	for _, e := range env {
+		c.Env = append(c.Env, e.Name+"="+e.Value)
+	}
+
+	util.LogInfoHeader("running %s", strings.Join(args, " "))
+	if err := c.Start(); err != nil {
+		util.LogError("error starting %s: %s", args[0], err)
+		return 127
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		_ = c.Process.Signal(syscall.SIGTERM)
+		select {
+		case err = <-done:
+		case <-time.After(timeout):
+			util.LogError("%s didn't exit, killing it", args[0])
+			_ = c.Process.Kill()
+			err = <-done
+		}
+	}
+	return exitStatus(err)
+}
+
+// exitStatus converts the result of waiting on a command to an exit status.
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	// a command that was killed by a signal doesn't have an exit code
+	if errors.As(err, &exitErr) && exitErr.ExitCode() > 0 {
+		return exitErr.ExitCode()
+	}
+	return 1
+}
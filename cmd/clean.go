@@ -17,7 +17,8 @@ var cleanCmd = &cobra.Command{
 is to use the 'create' commnad to construct a new configuration file
 and then edit/modify it as necessary, enabling services that are to be
 replaced and made available externally.  Then the clean command can be 
-used to remove all of the disabled services for a tidier config file.`,
+used to remove all of the disabled services for a tidier config file.
+Services that are used by a profile are kept even if they are disabled.`,
 	Args: cobra.ExactValidArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		inputFile := args[0]
@@ -25,10 +26,15 @@ used to remove all of the disabled services for a tidier config file.`,
 		if cfg == nil {
 			return
 		}
+		if extendsOthers(inputFile, *cfg) {
+			exitCode = 1
+			return
+		}
 
-		// filter out everything that is disabled
-		cfg.Supplant = filterSupplant(cfg.Supplant)
-		cfg.External = filterExternal(cfg.External)
+		// filter out everything that is disabled and not used by a profile
+		inSupplantProfile, inExternalProfile := cfg.InAnyProfile()
+		cfg.Supplant = filterSupplant(cfg.Supplant, inSupplantProfile)
+		cfg.External = filterExternal(cfg.External, inExternalProfile)
 		writeConfig(*cfg, inputFile)
 	},
 }
@@ -48,19 +54,19 @@ func readConfig(inputFile string) *model.Config {
 	return &cfg
 }
 
-func filterSupplant(supplant []model.SupplantService) []model.SupplantService {
+func filterSupplant(supplant []model.SupplantService, keep map[int]bool) []model.SupplantService {
 	var ret []model.SupplantService
-	for _, svc := range supplant {
-		if svc.Enabled {
+	for i, svc := range supplant {
+		if svc.Enabled || keep[i] {
 			ret = append(ret, svc)
 		}
 	}
 	return ret
 }
-func filterExternal(supplant []model.ExternalService) []model.ExternalService {
+func filterExternal(supplant []model.ExternalService, keep map[int]bool) []model.ExternalService {
 	var ret []model.ExternalService
-	for _, svc := range supplant {
-		if svc.Enabled {
+	for i, svc := range supplant {
+		if svc.Enabled || keep[i] {
 			ret = append(ret, svc)
 		}
 	}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	serviceCreateAttempts = 5
+	serviceCreateDelay    = 500 * time.Millisecond
+)
+
+// createService creates a service, retrying if the create is rejected.  Once a service is deleted, its
+// cluster IP and node ports can take a moment to be released so a create that requests the same
+// addresses may fail at first.
+func createService(ctx context.Context, cs *kubernetes.Clientset, svc *v1.Service) (*v1.Service, error) {
+	var err error
+	delay := serviceCreateDelay
+	for attempt := 0; attempt < serviceCreateAttempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(delay):
+			}
+			delay *= 2
+		}
+		var created *v1.Service
+		created, err = cs.CoreV1().Services(svc.Namespace).Create(ctx, svc, metav1.CreateOptions{})
+		if err == nil {
+			return created, nil
+		}
+		// an invalid service is what we get if the IP or a node port is allocated to someone else
+		if !errors.IsInvalid(err) && !errors.IsAlreadyExists(err) {
+			return nil, err
+		}
+	}
+	return nil, err
+}
+
+// serviceDrift returns a description of each cluster IP or node port that was allocated to want but
+// is different on got.  Only ports that exist on both services are compared.
+func serviceDrift(want, got *v1.Service) []string {
+	var drift []string
+	if want.Spec.ClusterIP != "" && want.Spec.ClusterIP != got.Spec.ClusterIP {
+		drift = append(drift, fmt.Sprintf("cluster IP changed from %s to %s", want.Spec.ClusterIP, got.Spec.ClusterIP))
+	}
+	if len(want.Spec.ClusterIPs) != 0 && !equalStrings(want.Spec.ClusterIPs, got.Spec.ClusterIPs) {
+		drift = append(drift, fmt.Sprintf("cluster IPs changed from %v to %v", want.Spec.ClusterIPs, got.Spec.ClusterIPs))
+	}
+
+	type portKey struct {
+		port     int32
+		protocol v1.Protocol
+	}
+	gotPorts := map[portKey]v1.ServicePort{}
+	for _, port := range got.Spec.Ports {
+		gotPorts[portKey{port.Port, port.Protocol}] = port
+	}
+	for _, port := range want.Spec.Ports {
+		if port.NodePort == 0 {
+			continue
+		}
+		gp, ok := gotPorts[portKey{port.Port, port.Protocol}]
+		if ok && gp.NodePort != port.NodePort {
+			drift = append(drift, fmt.Sprintf("node port for %d/%s changed from %d to %d",
+				port.Port, port.Protocol, port.NodePort, gp.NodePort))
+		}
+	}
+	return drift
+}
+
+// serviceUsingClusterIP returns the namespace/name of the service that holds ip, or an empty
+// string if no service is found.
+func serviceUsingClusterIP(ctx context.Context, cs *kubernetes.Clientset, ip string) string {
+	svcs, err := cs.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return ""
+	}
+	for _, svc := range svcs.Items {
+		for _, cip := range append([]string{svc.Spec.ClusterIP}, svc.Spec.ClusterIPs...) {
+			if cip == ip {
+				return fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
+			}
+		}
+	}
+	return ""
+}
+
+// clearAllocations removes the cluster IPs and node ports from a service so that new ones are allocated.
+func clearAllocations(svc *v1.Service) {
+	// headless services don't have an IP to lose
+	if svc.Spec.ClusterIP != v1.ClusterIPNone {
+		svc.Spec.ClusterIP = ""
+		svc.Spec.ClusterIPs = nil
+	}
+	for i := range svc.Spec.Ports {
+		svc.Spec.Ports[i].NodePort = 0
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
 )
 
 // configCmd represents the model command
@@ -16,3 +18,13 @@ and which the replacing services will need to connect to.`,
 func init() {
 	rootCmd.AddCommand(configCmd)
 }
+
+// extendsOthers reports an error and returns true if a configuration extends others.  Commands that rewrite a
+// single file can't use them since the entries of the merged configuration come from several files.
+func extendsOthers(inputFile string, cfg model.Config) bool {
+	if len(cfg.Extends) == 0 {
+		return false
+	}
+	util.LogError("%s extends %v, run this command on the extended files instead", inputFile, cfg.Extends)
+	return true
+}
@@ -2,14 +2,13 @@ package cmd
 
 import (
 	"context"
+	"io"
 	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/tzneal/supplant/model"
 	"github.com/tzneal/supplant/util"
 	"gopkg.in/yaml.v2"
-	v1 "k8s.io/api/core/v1"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
 )
 
@@ -19,9 +18,19 @@ var createCmd = &cobra.Command{
 	Short: "create constructs a configuration file based on the cluster",
 	Long: `create constructs a configuration file by looking at the services
 in the cluster.  This is intended to provide a template to allow 
-easy construction of the configuration.`,
+easy construction of the configuration.  The services that are
+added can be limited by namespace, label selector and glob patterns
+on their names, and services matching the enable patterns start
+out enabled.  The filter is saved in the configuration so that
+'config update' adds services the same way.`,
 	Args: cobra.ExactValidArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
+		filter, err := serviceFilterFromFlags(cmd, model.DefaultServiceFilter())
+		if err != nil {
+			util.LogError("%s", err)
+			return
+		}
+
 		f := cmdutil.NewFactory(kubeConfigFlags)
 		cs, err := f.KubernetesClientSet()
 		if err != nil {
@@ -30,37 +39,36 @@ easy construction of the configuration.`,
 		}
 
 		ctx := context.Background()
-		svcList, err := cs.CoreV1().Services(*kubeConfigFlags.Namespace).List(ctx, metav1.ListOptions{})
+		svcs, err := listConfigServices(ctx, cs, filter.Namespaces)
 		if err != nil {
 			util.LogError("error listing services: %s", err)
 			return
 		}
-		cfg := model.Config{}
-		includeAll, _ := cmd.Flags().GetBool(flagAll)
+		cfg := model.Config{Filter: &filter}
 		pl := model.NewPortLookup(cs)
-		for _, svc := range svcList.Items {
-			// skip kube-system services by default
-			if skipByDefault(svc) && !includeAll {
+		for _, svc := range svcs {
+			if !filter.Matches(svc) {
 				continue
 			}
-			cfg.Supplant = append(cfg.Supplant, model.MapSupplantService(pl, svc))
-			cfg.External = append(cfg.External, model.MapExternalService(pl, svc))
+			supplantSvc := model.MapSupplantService(pl, svc)
+			supplantSvc.Enabled = filter.EnableSupplant(svc)
+			cfg.Supplant = append(cfg.Supplant, supplantSvc)
+			externalSvc := model.MapExternalService(ctx, pl, svc)
+			externalSvc.Enabled = filter.EnableForward(svc)
+			cfg.External = append(cfg.External, externalSvc)
+		}
+
+		if interactive, _ := cmd.Flags().GetBool(flagInteractive); interactive {
+			var ok bool
+			if cfg, ok = pickServices(cfg); !ok {
+				return
+			}
 		}
 
 		writeConfig(cfg, args[0])
 	},
 }
 
-func skipByDefault(svc v1.Service) bool {
-	if svc.Namespace == "kube-system" {
-		return true
-	}
-	if svc.Namespace == "default" && svc.Name == "kubernetes" {
-		return true
-	}
-	return false
-}
-
 func writeConfig(cfg model.Config, outputFile string) {
 	fo, err := os.Create(outputFile)
 	if err != nil {
@@ -68,16 +76,22 @@ func writeConfig(cfg model.Config, outputFile string) {
 		return
 	}
 	defer fo.Close()
-	enc := yaml.NewEncoder(fo)
-	if err = enc.Encode(cfg); err != nil {
+	if err = encodeConfig(fo, cfg); err != nil {
 		util.LogError("error encoding config: %s", err)
 		return
 	}
 }
 
-const flagAll = "all"
+func encodeConfig(w io.Writer, cfg model.Config) error {
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+	return enc.Encode(cfg)
+}
+
+const flagInteractive = "interactive"
 
 func init() {
 	configCmd.AddCommand(createCmd)
-	createCmd.Flags().BoolP(flagAll, "A", false, "If true, include items in the kube-system namespace")
+	addServiceFilterFlags(createCmd)
+	createCmd.Flags().BoolP(flagInteractive, "i", false, "Choose the services to enable and their local ports in an interactive list before saving")
 }
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/dns"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+)
+
+const flagDNS = "dns"
+const flagClusterDomain = "cluster-domain"
+
+// addDNSFlags adds the flags that start a DNS server for the forwarded services.
+func addDNSFlags(cmd *cobra.Command) {
+	cmd.Flags().String(flagDNS, "", "Address to answer DNS queries for the forwarded services on (e.g. 127.0.0.1:5353), disabled if empty")
+	cmd.Flags().String(flagClusterDomain, "cluster.local", "Domain of the cluster used in the names answered by the DNS server")
+}
+
+// startDNS starts a DNS server for the forwarded services if one was requested, returning the function that
+// stops it or false if it couldn't be started.
+func startDNS(cmd *cobra.Command, info *model.SessionInfo) (func(), bool) {
+	addr, _ := cmd.Flags().GetString(flagDNS)
+	if addr == "" {
+		return func() {}, true
+	}
+	domain, _ := cmd.Flags().GetString(flagClusterDomain)
+	namespace, err := defaultNamespace()
+	if err != nil {
+		util.LogError("error determining the default namespace: %s", err)
+		return nil, false
+	}
+
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		util.LogError("error listening for DNS queries on %s: %s", addr, err)
+		return nil, false
+	}
+	server := &dns.Server{
+		ClusterDomain: domain,
+		Namespace:     namespace,
+	}
+	server.SetServices(dnsServices(info.Forwards))
+	go func() {
+		_ = server.Serve(pc)
+	}()
+
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	domain = strings.Trim(domain, ".")
+	util.LogInfoHeader("answering DNS queries for the forwarded services on %s", pc.LocalAddr())
+	util.LogInfoListItem("try it with: dig @%s -p %s <svc>.<ns>.svc.%s", host, port, domain)
+	util.LogInfoListItem("on macOS: printf 'nameserver %s\\nport %s\\n' | sudo tee /etc/resolver/%s", host, port, domain)
+	util.LogInfoListItem("with systemd-resolved: sudo resolvectl dns lo %s:%s && sudo resolvectl domain lo '~%s'", host, port, domain)
+	if port != "53" {
+		util.LogInfoListItem("resolvers that can't use another port, like /etc/resolv.conf, need --%s on port 53", flagDNS)
+	}
+	return func() { pc.Close() }, true
+}
+
+// dnsServices groups the forwarded ports by service.
+func dnsServices(forwards []model.ForwardMapping) []dns.Service {
+	var services []dns.Service
+	index := map[string]int{}
+	for _, fwd := range forwards {
+		host, portStr, err := net.SplitHostPort(fwd.Local)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+		key := fwd.Namespace + "/" + fwd.Service
+		i, ok := index[key]
+		if !ok {
+			i = len(services)
+			index[key] = i
+			services = append(services, dns.Service{Namespace: fwd.Namespace, Name: fwd.Service, IP: net.ParseIP(host)})
+		}
+		services[i].Ports = append(services[i].Ports, dns.Port{Name: fwd.Name, Protocol: fwd.Protocol, Port: uint16(port)})
+	}
+	return services
+}
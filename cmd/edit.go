@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/picker"
+	"github.com/tzneal/supplant/util"
+	"gopkg.in/yaml.v3"
+)
+
+// editCmd represents the edit command
+var editCmd = &cobra.Command{
+	Use:   "edit [flags] config.yml",
+	Short: "edit interactively chooses the services in a configuration file",
+	Long: `edit shows the services in a configuration file in a terminal
+list where services can be enabled for supplanting or forwarding
+and local ports can be set.  Comments and everything else in the
+file are kept when it's saved.`,
+	Args: cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inputFile := args[0]
+		data, err := os.ReadFile(inputFile)
+		if err != nil {
+			util.LogError("error opening %s: %s", inputFile, err)
+			return
+		}
+		var doc yaml.Node
+		if err = yaml.Unmarshal(data, &doc); err != nil {
+			util.LogError("error decoding %s: %s", inputFile, err)
+			return
+		}
+		var cfg model.Config
+		if err = doc.Decode(&cfg); err != nil {
+			util.LogError("error decoding %s: %s", inputFile, err)
+			return
+		}
+		if extendsOthers(inputFile, cfg) {
+			exitCode = 1
+			return
+		}
+
+		edited, ok := pickServices(cfg)
+		if !ok {
+			return
+		}
+		if err = model.SetChoices(&doc, edited); err != nil {
+			util.LogError("error updating %s: %s", inputFile, err)
+			return
+		}
+		writeConfigNode(&doc, inputFile)
+	},
+}
+
+// pickServices shows the interactive picker for a configuration, returning the edited configuration and
+// true if the user saved it.
+func pickServices(cfg model.Config) (model.Config, bool) {
+	m := picker.New(cfg)
+	saved, err := picker.Run(os.Stdin, os.Stdout, m)
+	if err != nil {
+		util.LogError("error running picker: %s", err)
+		return cfg, false
+	}
+	if !saved {
+		util.LogInfo("quit without saving")
+		return cfg, false
+	}
+	return m.Config(), true
+}
+
+func init() {
+	configCmd.AddCommand(editCmd)
+}
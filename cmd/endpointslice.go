@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// supportsEndpointSlices returns true if the server offers the discovery.k8s.io/v1 API.
+func supportsEndpointSlices(cs *kubernetes.Clientset) bool {
+	resources, err := cs.Discovery().ServerResourcesForGroupVersion(discoveryv1.SchemeGroupVersion.String())
+	if err != nil {
+		return false
+	}
+	for _, r := range resources.APIResources {
+		if r.Name == "endpointslices" {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointSliceName returns the name of the endpoint slice we create for a supplanted service.  A slice
+// only holds a single address type, so dual-stack services have a second slice for IPv6.
+func endpointSliceName(svcName string, addressType discoveryv1.AddressType) string {
+	if addressType == discoveryv1.AddressTypeIPv6 {
+		return fmt.Sprintf("%s-supplant-ipv6", svcName)
+	}
+	return fmt.Sprintf("%s-supplant", svcName)
+}
+
+// newEndpointSlice constructs an endpoint slice pointing the named service at our IP address.
+func newEndpointSlice(svcName string, ip net.IP, ports []discoveryv1.EndpointPort) *discoveryv1.EndpointSlice {
+	addressType := discoveryv1.AddressTypeIPv4
+	if ip.To4() == nil {
+		addressType = discoveryv1.AddressTypeIPv6
+	}
+	ready := true
+	return &discoveryv1.EndpointSlice{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: endpointSliceName(svcName, addressType),
+			Labels: map[string]string{
+				discoveryv1.LabelServiceName: svcName,
+				discoveryv1.LabelManagedBy:   "supplant",
+			},
+		},
+		AddressType: addressType,
+		Endpoints: []discoveryv1.Endpoint{{
+			Addresses:  []string{ip.String()},
+			Conditions: discoveryv1.EndpointConditions{Ready: &ready},
+		}},
+		Ports: ports,
+	}
+}
+
+// endpointSlicePort converts a supplanted port to an endpoint slice port.
+func endpointSlicePort(name string, port int32, protocol v1.Protocol) discoveryv1.EndpointPort {
+	return discoveryv1.EndpointPort{
+		Name:     &name,
+		Port:     &port,
+		Protocol: &protocol,
+	}
+}
+
+// deleteEndpointSlice deletes the endpoint slices that we created for a supplanted service
+func deleteEndpointSlice(ctx context.Context, cs *kubernetes.Clientset, jrnl *model.Journal, namespace, svcName string) {
+	for _, addressType := range []discoveryv1.AddressType{discoveryv1.AddressTypeIPv4, discoveryv1.AddressTypeIPv6} {
+		name := endpointSliceName(svcName, addressType)
+		err := cs.DiscoveryV1().EndpointSlices(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			util.LogError("error deleting endpoint slice %s: %s", name, err)
+			return
+		}
+		util.LogInfoListItem("deleted endpoint slice %s", name)
+	}
+	recordUndo(jrnl, model.JournalDeleteEndpointSlice, namespace, svcName)
+}
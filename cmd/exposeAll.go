@@ -3,12 +3,12 @@ package cmd
 import (
 	"context"
 	"net"
-	"os"
-	"os/signal"
+	"time"
 
 	"github.com/tzneal/supplant/model"
 	"github.com/tzneal/supplant/util"
 
+	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 
 	"github.com/spf13/cobra"
@@ -23,8 +23,22 @@ var exposeAllCmd = &cobra.Command{
 	Long: `expose-all is primarily intended for use in debugging
 and general 'poking around' a running K8s cluster. It
 enumerates all services and launches port forwarding for
-every exposed service and port.`,
+every exposed service and port.
+
+UDP ports are only forwarded with --udp, since they are
+forwarded through a relay pod that is started for each
+service with UDP ports.`,
 	Run: func(cmd *cobra.Command, args []string) {
+		// cancelled on the first termination signal, a second one forces us to exit
+		files := &sessionFiles{}
+		ctx, stopSignals := newSignalContext(files.Remove)
+		defer stopSignals()
+
+		// everything we start is stopped by the cleanup stack, which has its own timeout so that a relay pod
+		// that can't be deleted doesn't keep us from exiting
+		teardownTimeout, _ := cmd.Flags().GetDuration(flagTeardownTimeout)
+		cleanup := &cleanupStack{}
+		defer cleanup.Run(teardownTimeout)
 
 		f := cmdutil.NewFactory(kubeConfigFlags)
 		cs, err := f.KubernetesClientSet()
@@ -33,7 +47,7 @@ every exposed service and port.`,
 			return
 		}
 
-		svcs, err := cs.CoreV1().Services(*kubeConfigFlags.Namespace).List(context.TODO(), metav1.ListOptions{})
+		svcs, err := cs.CoreV1().Services(*kubeConfigFlags.Namespace).List(ctx, metav1.ListOptions{})
 		if err != nil {
 			util.LogError("error reading services: %s", err)
 			return
@@ -44,31 +58,103 @@ every exposed service and port.`,
 			return
 		}
 
-		var portForwards []kube.PortForwarder
+		modeFlag, _ := cmd.Flags().GetString(flagMode)
+		mode, err := kube.ParseForwardMode(modeFlag)
+		if err != nil {
+			util.LogError("%s", err)
+			return
+		}
+
+		// UDP ports are forwarded through relay pods, which are labeled with a session so that 'supplant gc'
+		// can delete them if we don't
+		var relays *relayPods
+		if forwardUDP, _ := cmd.Flags().GetBool(flagUDP); forwardUDP {
+			relayImage, _ := cmd.Flags().GetString(flagRelayImage)
+			sess := newSession(cs)
+			cleanup.Push(sess.Close)
+			relays = &relayPods{
+				cs:          cs,
+				sess:        sess,
+				cleanup:     cleanup,
+				image:       relayImage,
+				annotations: model.OwnerAnnotations(time.Now()),
+			}
+		}
+
+		var portForwards []*kube.PortForwarder
+		var udpForwards []*udpForward
+		// the service port names of each forward, in the same order as its ports
+		var forwardPortNames [][]string
 		pl := model.NewPortLookup(cs)
+		// with loopback aliases, each service is given its own address so that it can keep its ports
+		loopbackAliases, _ := cmd.Flags().GetBool(flagLoopbackAliases)
+		aliases := 0
 		portForwardingAtLeastOne := false
 		for _, svc := range svcs.Items {
 			// can't forward to selector'less services
 			if len(svc.Spec.Selector) == 0 {
 				continue
 			}
+			listenIP := localIp
+			if loopbackAliases {
+				listenIP = model.LoopbackAlias(aliases)
+				aliases++
+			}
 			var pc []kube.PortConfig
+			var names []string
+			skip := false
 			for _, port := range svc.Spec.Ports {
-				portNumber := pl.LookupPort(svc, port.TargetPort)
-				// doesn't support UDP port forwarding yet see https://github.com/kubernetes/kubernetes/issues/47862
+				// port forwards only carry TCP, UDP is forwarded through a relay pod below
 				if port.Protocol != "TCP" {
 					continue
 				}
-				pc = append(pc, kube.PortConfig{LocalPort: 0, TargetPort: portNumber})
+				portNumber := pl.LookupPort(ctx, svc, port.TargetPort)
+				localPort := int32(0)
+				if loopbackAliases {
+					localPort = port.Port
+					if err := checkListen(listenIP, localPort, port.Protocol); err != nil {
+						util.LogError("unable to forward %s on %s, skipping it: %s", svc.Name, listenIP, err)
+						skip = true
+						break
+					}
+				}
+				pc = append(pc, kube.PortConfig{LocalPort: localPort, TargetPort: portNumber})
+				names = append(names, port.Name)
+			}
+			if skip {
+				continue
 			}
 
 			if len(pc) > 0 {
-				fw, err := kube.PortForward(f, svc.Namespace, svc.Name, localIp, pc)
+				fw, err := kube.PortForward(ctx, f, svc.Namespace, svc.Name, listenIP, pc, mode)
 				if err != nil {
 					util.LogError("error forwarding port for %s: %s", svc.Name, err)
 					return
 				}
+				cleanup.Push(func(context.Context) { closePortForward(fw) })
 				portForwards = append(portForwards, fw)
+				forwardPortNames = append(forwardPortNames, names)
+				portForwardingAtLeastOne = true
+			}
+
+			if relays == nil {
+				continue
+			}
+			if _, udpPorts := splitUDPPorts(model.MapExternalService(ctx, pl, svc).Ports); len(udpPorts) > 0 {
+				if loopbackAliases {
+					if err := useServicePorts(listenIP, svc, udpPorts); err != nil {
+						util.LogError("unable to forward UDP ports for %s on %s, skipping them: %s", svc.Name, listenIP, err)
+						continue
+					}
+				}
+				util.LogInfoHeader("forwarding UDP ports for %s through a relay pod", svc.Name)
+				uf, err := startUDPForward(ctx, f, relays, svc, udpPorts, listenIP)
+				if err != nil {
+					util.LogError("error forwarding UDP ports for %s: %s", svc.Name, err)
+					return
+				}
+				cleanup.Push(func(context.Context) { uf.Close() })
+				udpForwards = append(udpForwards, uf)
 				portForwardingAtLeastOne = true
 			}
 		}
@@ -77,38 +163,86 @@ every exposed service and port.`,
 			return
 		}
 
-		// wait for all of the port forwards to be ready
-		for _, fw := range portForwards {
-			<-fw.Forwarder.Ready
+		// wait for all of the port forwards to be ready, the UDP forwards already are
+		info := &model.SessionInfo{}
+		type svcKey struct {
+			namespace string
+			name      string
+		}
+		udpPorts := map[svcKey][]model.EnvPort{}
+		for _, uf := range udpForwards {
+			udpPorts[svcKey{uf.Namespace, uf.Name}] = uf.Ports
+		}
+		for i, fw := range portForwards {
+			select {
+			case <-fw.Ready:
+			case <-ctx.Done():
+				return
+			}
 			util.LogInfoHeader("forwarding for %s", fw.Name)
-			ports, err := fw.Forwarder.GetPorts()
+			ports, err := fw.GetPorts()
 			if err != nil {
 				util.LogError("port forward error: %s", err)
 			}
+			var envPorts []model.EnvPort
+			for j, port := range ports {
+				util.LogInfoListItem("%s:%d points to remote %s:%d", fw.LocalIP(), port.Local, fw.Name, port.Remote)
+				envPort := model.EnvPort{Protocol: v1.ProtocolTCP, Port: int32(port.Remote), Local: int32(port.Local)}
+				if j < len(forwardPortNames[i]) {
+					envPort.Name = forwardPortNames[i][j]
+				}
+				envPorts = append(envPorts, envPort)
+			}
+			key := svcKey{fw.Namespace, fw.Name}
+			envPorts = append(envPorts, udpPorts[key]...)
+			delete(udpPorts, key)
+			info.AddForward(fw.Namespace, fw.Name, fw.LocalIP().String(), envPorts)
+		}
+		for _, uf := range udpForwards {
+			ports, ok := udpPorts[svcKey{uf.Namespace, uf.Name}]
+			if !ok {
+				continue
+			}
+			util.LogInfoHeader("forwarding UDP for %s", uf.Name)
 			for _, port := range ports {
-				util.LogInfoListItem("%s:%d points to remote %s:%d", localIp, port.Local, fw.Name, port.Remote)
+				util.LogInfoListItem("%s:%d/udp points to remote %s:%d", uf.IP, port.Local, uf.Name, port.Port)
 			}
+			info.AddForward(uf.Namespace, uf.Name, uf.IP.String(), ports)
 		}
+		stopDNS, ok := startDNS(cmd, info)
+		if !ok {
+			return
+		}
+		cleanup.Push(func(context.Context) { stopDNS() })
+		removeHosts, ok := writeHostsFile(cmd, info)
+		if !ok {
+			return
+		}
+		cleanup.Push(func(context.Context) { removeHosts() })
+		files.Write(cmd, info)
+		cleanup.Push(func(context.Context) { files.Remove() })
 
 		util.LogInfo("forwarding ports, hit Ctrl+C to exit")
-		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, os.Interrupt)
 
-		// wait on the Ctrl+C
-		<-signals
+		// wait on the Ctrl+C or another termination signal
+		<-ctx.Done()
 
 		util.LogInfoHeader("cleaning up....")
-		for _, fw := range portForwards {
-			for _, p := range fw.Ports {
-				util.LogInfoListItem("closing port forward %s:%d", fw.Name, p.LocalPort)
-			}
-			fw.Forwarder.Close()
-		}
 	},
 }
 
+const flagMode = "mode"
+const flagUDP = "udp"
+
 func init() {
 
 	exposeAllCmd.Flags().IP(flagLocalIP, net.IPv4(127, 0, 0, 1), "IP address that is used to listen")
+	addHostsFlags(exposeAllCmd)
+	addDNSFlags(exposeAllCmd)
+	addSessionFileFlags(exposeAllCmd)
+	exposeAllCmd.Flags().String(flagMode, string(kube.ForwardSingle), "How connections are spread across the pods of each service, one of single, round-robin or least-connections")
+	exposeAllCmd.Flags().Bool(flagUDP, false, "If true, forward UDP ports through a relay pod for each service that has them")
+	exposeAllCmd.Flags().String(flagRelayImage, defaultRelayImage(), "Image used for the relay pods that forward UDP ports")
+	exposeAllCmd.Flags().Duration(flagTeardownTimeout, 30*time.Second, "Maximum time to spend closing forwards and deleting relay pods when exiting")
 	rootCmd.AddCommand(exposeAllCmd)
 }
@@ -0,0 +1,190 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/hostip"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const flagExternalIP = "externalip"
+const flagInterface = "interface"
+const flagProbe = "probe"
+
+// addExternalIPFlags adds the flags that choose the addresses services in the cluster connect to.
+func addExternalIPFlags(cmd *cobra.Command) {
+	cmd.Flags().IPSlice(flagExternalIP, nil, "IP address that services within the cluster will connect to, one of each family for dual-stack services, found automatically if not set")
+	cmd.Flags().String(flagInterface, "", "Network interface whose addresses services within the cluster will connect to")
+	cmd.Flags().Bool(flagProbe, false, "If true, start a short-lived pod to find which addresses the cluster can connect to when the external IP is found automatically")
+}
+
+// externalIPs returns the addresses that supplanted services are pointed at, at most one of each family.
+// They come from --externalip, or are chosen from the addresses of the network interfaces by comparing
+// them with the nodes and pod network of the cluster and, with --probe, by connecting back to them from a
+// pod in namespace.
+func externalIPs(ctx context.Context, cmd *cobra.Command, cs *kubernetes.Clientset, relays *relayPods, namespace string) ([]net.IP, error) {
+	ips, _ := cmd.Flags().GetIPSlice(flagExternalIP)
+	iface, _ := cmd.Flags().GetString(flagInterface)
+	if len(ips) != 0 {
+		if iface != "" {
+			return nil, fmt.Errorf("only one of --%s and --%s can be used", flagExternalIP, flagInterface)
+		}
+		var haveIPv4, haveIPv6 bool
+		for _, ip := range ips {
+			if ip.IsUnspecified() {
+				return nil, fmt.Errorf("%s can't be used as an external IP", ip)
+			}
+			have := &haveIPv4
+			if ip.To4() == nil {
+				have = &haveIPv6
+			}
+			if *have {
+				return nil, fmt.Errorf("only one external IP of each address family can be used")
+			}
+			*have = true
+		}
+		return ips, nil
+	}
+
+	util.LogInfoHeader("finding the external IP")
+	cands, err := hostip.Candidates(iface)
+	if err != nil {
+		return nil, err
+	}
+	if len(cands) == 0 {
+		if iface != "" {
+			return nil, fmt.Errorf("interface %s has no usable addresses", iface)
+		}
+		return nil, fmt.Errorf("no usable external IP was found, choose one with --%s or --%s", flagExternalIP, flagInterface)
+	}
+
+	nodeIPs, podCIDRs, err := clusterNetworks(ctx, cs)
+	if err != nil {
+		// we can still rank them without the cluster
+		util.LogInfoListItem("unable to compare addresses with the cluster: %s", err)
+	}
+	hostip.MarkNear(cands, nodeIPs, podCIDRs)
+
+	if probe, _ := cmd.Flags().GetBool(flagProbe); probe {
+		reached, err := probeCandidates(ctx, relays, namespace, cands)
+		if err != nil {
+			return nil, fmt.Errorf("error probing external IPs: %w", err)
+		}
+		if len(reached) == 0 {
+			return nil, fmt.Errorf("the cluster couldn't connect to any of %d addresses, use --%s %s", len(cands),
+				flagTransport, transportRelay)
+		}
+		for _, c := range cands {
+			if !containsCandidate(reached, c) {
+				util.LogInfoListItem("the cluster couldn't connect to %s", c)
+			}
+		}
+		cands = reached
+	}
+
+	picked := hostip.Pick(cands)
+	for _, c := range picked {
+		util.LogInfoHeader("using external IP %s", c)
+		ips = append(ips, c.IP)
+	}
+	if len(cands) > len(picked) {
+		for _, c := range cands {
+			if !containsCandidate(picked, c) {
+				util.LogInfoListItem("also found %s", c)
+			}
+		}
+		util.LogInfoListItem("use --%s or --%s to choose another", flagInterface, flagExternalIP)
+	}
+	return ips, nil
+}
+
+// clusterNetworks returns the internal addresses of the nodes and the pod networks assigned to them.
+func clusterNetworks(ctx context.Context, cs *kubernetes.Clientset) ([]net.IP, []*net.IPNet, error) {
+	nodes, err := cs.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("error listing nodes: %w", err)
+	}
+	var nodeIPs []net.IP
+	var podCIDRs []*net.IPNet
+	for _, node := range nodes.Items {
+		for _, addr := range node.Status.Addresses {
+			if ip := net.ParseIP(addr.Address); addr.Type == v1.NodeInternalIP && ip != nil {
+				nodeIPs = append(nodeIPs, ip)
+			}
+		}
+		cidrs := node.Spec.PodCIDRs
+		if len(cidrs) == 0 && node.Spec.PodCIDR != "" {
+			cidrs = []string{node.Spec.PodCIDR}
+		}
+		for _, cidr := range cidrs {
+			if _, ipNet, err := net.ParseCIDR(cidr); err == nil {
+				podCIDRs = append(podCIDRs, ipNet)
+			}
+		}
+	}
+	return nodeIPs, podCIDRs, nil
+}
+
+// containsCandidate returns true if cands holds the address of c.
+func containsCandidate(cands []hostip.Candidate, c hostip.Candidate) bool {
+	for _, have := range cands {
+		if have.IP.Equal(c.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// endpointIPs returns the addresses of ips that a service's endpoints point to, in the order of the IP
+// families of the service.  It's an error if there is no address of the service's primary family.
+func endpointIPs(svc v1.Service, ips []net.IP) ([]net.IP, error) {
+	families := svc.Spec.IPFamilies
+	if len(families) == 0 {
+		// older clusters don't set the families
+		family := v1.IPv4Protocol
+		if ip := net.ParseIP(svc.Spec.ClusterIP); ip != nil && ip.To4() == nil {
+			family = v1.IPv6Protocol
+		}
+		families = []v1.IPFamily{family}
+	}
+
+	var ret []net.IP
+	for i, family := range families {
+		var found net.IP
+		for _, ip := range ips {
+			if (ip.To4() == nil) == (family == v1.IPv6Protocol) {
+				found = ip
+				break
+			}
+		}
+		if found != nil {
+			ret = append(ret, found)
+			continue
+		}
+		if i == 0 {
+			return nil, fmt.Errorf("service %s is %s but there is no %s address to point it at, choose one with --%s",
+				svc.Name, family, family, flagExternalIP)
+		}
+		util.LogInfoListItem("service %s is also %s but there is no %s address, it will only be reachable over %s",
+			svc.Name, family, family, families[0])
+	}
+	return ret, nil
+}
+
+// firstSupplanted returns the namespace of the first service in a configuration that is to be supplanted, or
+// false if there isn't one.
+func firstSupplanted(cfg *model.Config) (string, bool) {
+	for _, svc := range cfg.Supplant {
+		if svc.Enabled {
+			return svc.Namespace, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestEndpointIPs(t *testing.T) {
+	ipv4, ipv6 := net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")
+	tests := []struct {
+		name      string
+		families  []v1.IPFamily
+		clusterIP string
+		ips       []net.IP
+		want      []net.IP
+		wantErr   string
+	}{
+		{
+			name:     "single stack",
+			families: []v1.IPFamily{v1.IPv4Protocol},
+			ips:      []net.IP{ipv6, ipv4},
+			want:     []net.IP{ipv4},
+		},
+		{
+			name:     "dual stack in the order of the families",
+			families: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+			ips:      []net.IP{ipv4, ipv6},
+			want:     []net.IP{ipv6, ipv4},
+		},
+		{
+			name:     "missing secondary family",
+			families: []v1.IPFamily{v1.IPv4Protocol, v1.IPv6Protocol},
+			ips:      []net.IP{ipv4},
+			want:     []net.IP{ipv4},
+		},
+		{
+			name:     "missing primary family",
+			families: []v1.IPFamily{v1.IPv6Protocol, v1.IPv4Protocol},
+			ips:      []net.IP{ipv4},
+			wantErr:  "service web is IPv6 but there is no IPv6 address",
+		},
+		{
+			name:      "no families with an IPv4 cluster IP",
+			clusterIP: "10.96.0.10",
+			ips:       []net.IP{ipv6, ipv4},
+			want:      []net.IP{ipv4},
+		},
+		{
+			name:      "no families with an IPv6 cluster IP",
+			clusterIP: "fd00::10",
+			ips:       []net.IP{ipv4, ipv6},
+			want:      []net.IP{ipv6},
+		},
+		{
+			name:      "no families with a headless service",
+			clusterIP: v1.ClusterIPNone,
+			ips:       []net.IP{ipv6},
+			wantErr:   "service web is IPv4 but there is no IPv4 address",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			svc := v1.Service{
+				ObjectMeta: metav1.ObjectMeta{Name: "web"},
+				Spec:       v1.ServiceSpec{IPFamilies: tc.families, ClusterIP: tc.clusterIP},
+			}
+			got, err := endpointIPs(svc, tc.ips)
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("endpointIPs() error = %s", err)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("endpointIPs() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
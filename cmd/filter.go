@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const flagAll = "all"
+const flagSelector = "selector"
+const flagInclude = "include"
+const flagExclude = "exclude"
+const flagEnable = "enable"
+const flagEnableExternal = "enable-external"
+
+// addServiceFilterFlags adds the flags that choose which services are added to a configuration.
+func addServiceFilterFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP(flagAll, "A", false, "If true, don't exclude the services excluded by default (kube-system and the kubernetes service)")
+	cmd.Flags().StringP(flagSelector, "l", "", "Label selector that services must match")
+	cmd.Flags().StringSlice(flagInclude, nil, "Only add services matching a glob pattern on name or namespace/name, may be repeated")
+	cmd.Flags().StringSlice(flagExclude, nil, "Don't add services matching a glob pattern on name or namespace/name, may be repeated")
+	cmd.Flags().StringSlice(flagEnable, nil, "Enable supplanting services matching a glob pattern, may be repeated")
+	cmd.Flags().StringSlice(flagEnableExternal, nil, "Enable forwarding to services matching a glob pattern, may be repeated")
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[annotationNamespaces] = "true"
+}
+
+// serviceFilterFromFlags adds the filter flags from the command line to base.
+func serviceFilterFromFlags(cmd *cobra.Command, base model.ServiceFilter) (model.ServiceFilter, error) {
+	filter := base
+	if includeAll, _ := cmd.Flags().GetBool(flagAll); includeAll {
+		filter.Exclude = nil
+	}
+	if selector, _ := cmd.Flags().GetString(flagSelector); selector != "" {
+		filter.Selector = selector
+	}
+	// the namespaces come from the global, repeatable --namespace flag
+	filter.Namespaces = appendUnique(filter.Namespaces, namespaces)
+	for _, list := range []struct {
+		flag   string
+		target *[]string
+	}{
+		{flagInclude, &filter.Include},
+		{flagExclude, &filter.Exclude},
+		{flagEnable, &filter.Enable},
+		{flagEnableExternal, &filter.EnableExternal},
+	} {
+		values, _ := cmd.Flags().GetStringSlice(list.flag)
+		*list.target = appendUnique(*list.target, values)
+	}
+	return filter, filter.Validate()
+}
+
+// serviceFilterFlagsChanged returns true if any of the flags that serviceFilterFromFlags reads were given.
+func serviceFilterFlagsChanged(cmd *cobra.Command) bool {
+	for _, flag := range []string{flagAll, flagSelector, flagInclude, flagExclude, flagEnable, flagEnableExternal, flagNamespace} {
+		if cmd.Flags().Changed(flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// appendUnique returns a copy of a with each value of b that it doesn't already contain added.
+func appendUnique(a []string, b []string) []string {
+	ret := append([]string{}, a...)
+	for _, v := range b {
+		found := false
+		for _, existing := range ret {
+			if existing == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			ret = append(ret, v)
+		}
+	}
+	if len(ret) == 0 {
+		return nil
+	}
+	return ret
+}
+
+// listConfigServices lists the services that configurations are generated from in each of the namespaces,
+// or in every namespace if there are none.
+func listConfigServices(ctx context.Context, cs *kubernetes.Clientset, namespaces []string) ([]v1.Service, error) {
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+	var svcs []v1.Service
+	for _, ns := range namespaces {
+		svcList, err := cs.CoreV1().Services(ns).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, err
+		}
+		svcs = append(svcs, svcList.Items...)
+	}
+	return svcs, nil
+}
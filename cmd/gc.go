@@ -0,0 +1,160 @@
+package cmd
+
+import (
+	"context"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	discoveryv1 "k8s.io/api/discovery/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// gcCmd represents the gc command
+var gcCmd = &cobra.Command{
+	Use:   "gc [flags]",
+	Short: "gc cleans up objects left behind by sessions that are no longer running",
+	Long: `gc finds the services, endpoints and leases created by supplant
+whose session is no longer renewing its lease.  Supplanted services
+are restored from the backup stored on them and any other objects,
+such as endpoints, endpoint slices and relay pods, are deleted.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		dryRun, _ := cmd.Flags().GetBool(flagDryRun)
+
+		f := cmdutil.NewFactory(kubeConfigFlags)
+		cs, err := f.KubernetesClientSet()
+		if err != nil {
+			util.LogError("error getting kubernetes client: %s", err)
+			return
+		}
+
+		ctx := context.Background()
+		lo := metav1.ListOptions{LabelSelector: model.LabelSupplant + "=true"}
+		leases, err := cs.CoordinationV1().Leases(metav1.NamespaceAll).List(ctx, lo)
+		if err != nil {
+			util.LogError("error listing leases: %s", err)
+			return
+		}
+		svcs, err := cs.CoreV1().Services(metav1.NamespaceAll).List(ctx, lo)
+		if err != nil {
+			util.LogError("error listing services: %s", err)
+			return
+		}
+		eps, err := cs.CoreV1().Endpoints(metav1.NamespaceAll).List(ctx, lo)
+		if err != nil {
+			util.LogError("error listing endpoints: %s", err)
+			return
+		}
+
+		var slices []discoveryv1.EndpointSlice
+		if supportsEndpointSlices(cs) {
+			sliceList, err := cs.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(ctx, lo)
+			if err != nil {
+				util.LogError("error listing endpoint slices: %s", err)
+				return
+			}
+			slices = sliceList.Items
+		}
+
+		// a session is alive if any of its leases are still being renewed
+		now := time.Now()
+		live := map[string]bool{}
+		for _, lease := range leases.Items {
+			if !leaseExpired(lease, now) {
+				live[lease.Labels[model.LabelSession]] = true
+			}
+		}
+		dead := func(meta metav1.ObjectMeta) bool {
+			return !live[meta.Labels[model.LabelSession]]
+		}
+
+		type key struct {
+			namespace string
+			name      string
+		}
+		restored := map[key]bool{}
+		found := false
+		for i := range svcs.Items {
+			svc := &svcs.Items[i]
+			if !dead(svc.ObjectMeta) {
+				continue
+			}
+			found = true
+			util.LogInfoHeader("restoring service %s/%s from session %s", svc.Namespace, svc.Name, svc.Labels[model.LabelSession])
+			restored[key{svc.Namespace, svc.Name}] = true
+			if !dryRun {
+				restoreFromBackup(ctx, cs, svc)
+			}
+		}
+
+		for _, ep := range eps.Items {
+			if !dead(ep.ObjectMeta) || restored[key{ep.Namespace, ep.Name}] {
+				continue
+			}
+			found = true
+			util.LogInfoHeader("deleting endpoint %s/%s from session %s", ep.Namespace, ep.Name, ep.Labels[model.LabelSession])
+			if !dryRun {
+				deleteEndpoints(ctx, cs, nil, ep.Namespace, ep.Name)
+			}
+		}
+
+		for _, slice := range slices {
+			svcName := slice.Labels[discoveryv1.LabelServiceName]
+			if !dead(slice.ObjectMeta) || restored[key{slice.Namespace, svcName}] {
+				continue
+			}
+			found = true
+			util.LogInfoHeader("deleting endpoint slice %s/%s from session %s", slice.Namespace, slice.Name, slice.Labels[model.LabelSession])
+			if !dryRun {
+				deleteEndpointSlice(ctx, cs, nil, slice.Namespace, svcName)
+			}
+		}
+
+		pods, err := cs.CoreV1().Pods(metav1.NamespaceAll).List(ctx, lo)
+		if err != nil {
+			util.LogError("error listing pods: %s", err)
+			return
+		}
+		for _, pod := range pods.Items {
+			if !dead(pod.ObjectMeta) {
+				continue
+			}
+			found = true
+			util.LogInfoHeader("deleting relay pod %s/%s from session %s", pod.Namespace, pod.Name, pod.Labels[model.LabelSession])
+			if !dryRun {
+				deleteRelayPod(ctx, cs, nil, pod.Namespace, pod.Name)
+			}
+		}
+
+		for _, lease := range leases.Items {
+			if !dead(lease.ObjectMeta) {
+				continue
+			}
+			found = true
+			util.LogInfoHeader("deleting lease %s/%s", lease.Namespace, lease.Name)
+			if !dryRun {
+				err = cs.CoordinationV1().Leases(lease.Namespace).Delete(ctx, lease.Name, metav1.DeleteOptions{})
+				if err != nil && !errors.IsNotFound(err) {
+					util.LogError("error deleting lease %s: %s", lease.Name, err)
+				}
+			}
+		}
+
+		if !found {
+			util.LogInfo("no objects from dead sessions found")
+		} else if dryRun {
+			util.LogInfo("dry run, no changes were made")
+		}
+	},
+}
+
+const flagDryRun = "dry-run"
+
+func init() {
+	rootCmd.AddCommand(gcCmd)
+	gcCmd.Flags().Bool(flagDryRun, false, "If true, only list the objects that would be restored or deleted")
+}
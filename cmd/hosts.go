@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"syscall"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+)
+
+const flagLoopbackAliases = "loopback-aliases"
+const flagHostsFile = "hosts-file"
+
+// addHostsFlags adds the flags that give each forwarded service its own address and name.
+func addHostsFlags(cmd *cobra.Command) {
+	cmd.Flags().Bool(flagLoopbackAliases, false, "If true, forward each service on its own loopback address (127.1.x.y) using the ports of the service")
+	cmd.Flags().String(flagHostsFile, "", "Hosts file (e.g. /etc/hosts) to add the names of the forwarded services to while running, disabled if empty")
+}
+
+// defaultNamespace returns the namespace that names without a namespace refer to.
+func defaultNamespace() (string, error) {
+	namespace, _, err := kubeConfigFlags.ToRawKubeConfigLoader().Namespace()
+	return namespace, err
+}
+
+// checkListen returns an error explaining why we can't listen on a loopback alias, so that it can be reported
+// before the forward starts and retries forever.
+func checkListen(ip net.IP, port int32, protocol v1.Protocol) error {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+	var err error
+	if model.NormalizeProtocol(protocol) == v1.ProtocolUDP {
+		var conn net.PacketConn
+		if conn, err = net.ListenPacket("udp", addr); err == nil {
+			conn.Close()
+		}
+	} else {
+		var listener net.Listener
+		if listener, err = net.Listen("tcp", addr); err == nil {
+			listener.Close()
+		}
+	}
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, syscall.EADDRNOTAVAIL) && runtime.GOOS == "darwin":
+		return fmt.Errorf("%s is not configured, add it with 'sudo ifconfig lo0 alias %s up'", ip, ip)
+	case errors.Is(err, syscall.EACCES):
+		return fmt.Errorf("port %d is privileged, run as root or lower net.ipv4.ip_unprivileged_port_start", port)
+	}
+	return err
+}
+
+// writeHostsFile adds the names of the forwarded services to the hosts file if one was given, returning the
+// function that removes them or false if the file couldn't be updated.  Entries left behind by a previous
+// run are replaced.
+func writeHostsFile(cmd *cobra.Command, info *model.SessionInfo) (func(), bool) {
+	path, _ := cmd.Flags().GetString(flagHostsFile)
+	if path == "" {
+		return func() {}, true
+	}
+	domain, _ := cmd.Flags().GetString(flagClusterDomain)
+	namespace, err := defaultNamespace()
+	if err != nil {
+		util.LogError("error determining the default namespace: %s", err)
+		return nil, false
+	}
+
+	entries := model.HostsEntries(info.Forwards, namespace, domain)
+	if err = updateHostsFile(path, entries); err != nil {
+		util.LogError("error updating hosts file %s: %s", path, err)
+		return nil, false
+	}
+	util.LogInfoHeader("added the forwarded services to %s", path)
+	for _, e := range entries {
+		util.LogInfoListItem("%s %v", e.IP, e.Names)
+	}
+	return func() {
+		if err := updateHostsFile(path, nil); err != nil {
+			util.LogError("error removing the forwarded services from %s: %s", path, err)
+		}
+	}, true
+}
+
+// updateHostsFile replaces our block in a hosts file, creating the file if it doesn't exist.  The file is
+// written in place since /etc/hosts is often a mount that can't be replaced.
+func updateHostsFile(path string, entries []model.HostsEntry) error {
+	perm := os.FileMode(0644)
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if fi, err := os.Stat(path); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	return os.WriteFile(path, model.ReplaceHostsBlock(data, entries), perm)
+}
+
+// useServicePorts sets the local port of each port that doesn't have one to the port of the service, and
+// checks that each local port can be listened on at ip.
+func useServicePorts(ip net.IP, svc v1.Service, ports []model.ExternalPortConfig) error {
+	for i := range ports {
+		port := &ports[i]
+		if port.LocalPort == 0 {
+			if sp, ok := port.ServicePort(svc); ok {
+				port.LocalPort = sp.Port
+			}
+		}
+		if err := checkListen(ip, port.LocalPort, port.Protocol); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/hostip"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// probeConnectTimeout is how long the probe pod tries to connect to each address
+const probeConnectTimeout = 5 * time.Second
+
+// probeCmd represents the probe command
+var probeCmd = &cobra.Command{
+	Use:   "probe [flags] address...",
+	Short: "probe runs inside the cluster and connects back to supplant",
+	Long: `probe is run inside of a short-lived pod in the cluster to find
+which of the addresses of the machine running supplant the cluster
+can connect to.  It connects to each address, sends the token and
+waits for supplant to acknowledge it.`,
+	Hidden: true,
+	Args:   cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		token, _ := cmd.Flags().GetString(flagToken)
+		timeout, _ := cmd.Flags().GetDuration(flagTimeout)
+		var wg sync.WaitGroup
+		failed := false
+		var mu sync.Mutex
+		for _, addr := range args {
+			wg.Add(1)
+			go func(addr string) {
+				defer wg.Done()
+				if err := probeAddress(addr, token, timeout); err != nil {
+					mu.Lock()
+					failed = true
+					mu.Unlock()
+					util.LogError("unable to reach %s: %s", addr, err)
+					return
+				}
+				util.LogInfoListItem("reached %s", addr)
+			}(addr)
+		}
+		wg.Wait()
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+// probeAddress connects to addr and sends the token, returning once it has been acknowledged.
+func probeAddress(addr, token string, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err = conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	if _, err = fmt.Fprintln(conn, token); err != nil {
+		return err
+	}
+	ack, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(ack) != token {
+		return fmt.Errorf("unexpected response")
+	}
+	return nil
+}
+
+// newProbePod constructs a pod that connects to each of addrs once and exits.
+func newProbePod(name string, image string, token string, addrs []string) *v1.Pod {
+	args := []string{"probe", fmt.Sprintf("--%s=%s", flagToken, token), fmt.Sprintf("--%s=%s", flagTimeout, probeConnectTimeout)}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "probe",
+				Image: image,
+				Args:  append(args, addrs...),
+			}},
+			RestartPolicy: v1.RestartPolicyNever,
+		},
+	}
+}
+
+// probeCandidates starts a probe pod in namespace that tries to connect back to a temporary listener on each
+// candidate, returning the candidates that it reached in the order they were given.
+func probeCandidates(ctx context.Context, relays *relayPods, namespace string, cands []hostip.Candidate) ([]hostip.Candidate, error) {
+	token := relays.sess.ID
+	reached := make(chan int, len(cands))
+	var addrs []string
+	for i, c := range cands {
+		listener, err := net.Listen("tcp", net.JoinHostPort(c.IP.String(), "0"))
+		if err != nil {
+			util.LogInfoListItem("unable to listen on %s to probe it: %s", c.IP, err)
+			continue
+		}
+		defer listener.Close()
+		addrs = append(addrs, listener.Addr().String())
+		go acceptProbe(listener, token, i, reached)
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("unable to listen on any of the candidates")
+	}
+
+	name := fmt.Sprintf("supplant-probe-%s", token)
+	util.LogInfoListItem("starting probe pod %s in %s", name, namespace)
+	del, err := relays.Create(ctx, namespace, newProbePod(name, relays.image, token, addrs))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		// once we are interrupted, the cleanup stack deletes the pod with its own timeout
+		if ctx.Err() == nil {
+			del(ctx)
+		}
+	}()
+
+	// the probe waits for each of its connections to be acknowledged, which happens after we are told about
+	// it, so once the pod has exited we have heard about every address that it reached
+	ok := map[int]bool{}
+	timeout := time.After(relayStartTimeout)
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	for exited := false; !exited && len(ok) < len(addrs); {
+		select {
+		case i := <-reached:
+			ok[i] = true
+		case <-poll.C:
+			pod, err := relays.cs.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("error checking probe pod %s: %w", name, err)
+			}
+			exited = pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed
+		case <-timeout:
+			if len(ok) == 0 {
+				return nil, fmt.Errorf("timed out waiting for probe pod %s", name)
+			}
+			exited = true
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	for drained := false; !drained; {
+		select {
+		case i := <-reached:
+			ok[i] = true
+		default:
+			drained = true
+		}
+	}
+
+	var ret []hostip.Candidate
+	for i, c := range cands {
+		if ok[i] {
+			ret = append(ret, c)
+		}
+	}
+	return ret, nil
+}
+
+// acceptProbe accepts connections until one sends the token, sending index to reached before acknowledging it.
+func acceptProbe(listener net.Listener, token string, index int, reached chan<- int) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_ = conn.SetDeadline(time.Now().Add(probeConnectTimeout))
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		if err != nil || strings.TrimSpace(line) != token {
+			conn.Close()
+			continue
+		}
+		reached <- index
+		_, _ = fmt.Fprintln(conn, token)
+		conn.Close()
+		return
+	}
+}
+
+const flagToken = "token"
+const flagTimeout = "timeout"
+
+func init() {
+	rootCmd.AddCommand(probeCmd)
+	probeCmd.Flags().String(flagToken, "", "Token to send to each address")
+	probeCmd.Flags().Duration(flagTimeout, probeConnectTimeout, "How long to try to connect to each address")
+}
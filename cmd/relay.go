@@ -0,0 +1,288 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/kube"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/tunnel"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/kubernetes"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+const (
+	// relayTunnelPort is the port that the relay accepts tunnels from supplant on
+	relayTunnelPort = model.RelayTunnelPort
+	// relayUDPForwardPort is the first of the ports that the relay accepts streams of datagrams on
+	relayUDPForwardPort = model.RelayUDPForwardPort
+	// relayStartTimeout is how long we wait for a relay pod to become ready
+	relayStartTimeout = 2 * time.Minute
+
+	transportDirect = "direct"
+	transportRelay  = "relay"
+)
+
+// relayCmd represents the relay command
+var relayCmd = &cobra.Command{
+	Use:   "relay [flags]",
+	Short: "relay runs inside the cluster and tunnels connections back to supplant",
+	Long: `relay is run inside of a pod in the cluster when using the relay
+transport or to forward UDP ports.  It accepts connections and
+datagrams on each port and sends them back through tunnels that
+supplant opens to it using a port forward, and sends datagrams
+that supplant streams to it on to addresses in the cluster.`,
+	Hidden: true,
+	Args:   cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var cfg tunnel.RelayConfig
+		cfg.TunnelPort, _ = cmd.Flags().GetInt32(flagTunnelPort)
+		cfg.Ports, _ = cmd.Flags().GetInt32Slice(flagPort)
+		cfg.UDPPorts, _ = cmd.Flags().GetInt32Slice(flagUDPPort)
+		cfg.UDPForwardPort, _ = cmd.Flags().GetInt32(flagUDPForwardPort)
+		cfg.UDPForwards, _ = cmd.Flags().GetStringSlice(flagUDPForward)
+		if err := tunnel.ListenAndServe(cfg); err != nil {
+			util.LogError("relay error: %s", err)
+			os.Exit(1)
+		}
+	},
+}
+
+// relayTunnel is a running relay pod along with the tunnels to it.
+type relayTunnel struct {
+	Pod  *v1.Pod
+	fw   *kube.PortForwarder
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Close stops tunneling connections from the relay.
+func (rt *relayTunnel) Close() {
+	close(rt.stop)
+	<-rt.done
+	rt.fw.Close()
+}
+
+// relayPodName includes the session so that a pod left behind by another session doesn't collide with ours.
+func relayPodName(svcName string, sessionID string) string {
+	return fmt.Sprintf("supplant-relay-%s-%s", svcName, sessionID)
+}
+
+// udpRelayPodName includes the session since sessions can forward to the same service at once.
+func udpRelayPodName(svcName string, sessionID string) string {
+	return fmt.Sprintf("supplant-udp-%s-%s", svcName, sessionID)
+}
+
+func defaultRelayImage() string {
+	tag := version
+	if tag == "dev" {
+		tag = "latest"
+	}
+	return fmt.Sprintf("ghcr.io/tzneal/supplant:%s", tag)
+}
+
+// newRelayPod constructs a relay pod that listens on each of the ports in cfg.
+func newRelayPod(name string, image string, cfg tunnel.RelayConfig) *v1.Pod {
+	args := []string{"relay", fmt.Sprintf("--%s=%d", flagTunnelPort, relayTunnelPort)}
+	containerPorts := []v1.ContainerPort{{Name: "tunnel", ContainerPort: relayTunnelPort, Protocol: v1.ProtocolTCP}}
+	for _, port := range cfg.Ports {
+		args = append(args, fmt.Sprintf("--%s=%d", flagPort, port))
+		containerPorts = append(containerPorts, v1.ContainerPort{ContainerPort: port, Protocol: v1.ProtocolTCP})
+	}
+	for _, port := range cfg.UDPPorts {
+		args = append(args, fmt.Sprintf("--%s=%d", flagUDPPort, port))
+		containerPorts = append(containerPorts, v1.ContainerPort{ContainerPort: port, Protocol: v1.ProtocolUDP})
+	}
+	if len(cfg.UDPForwards) != 0 {
+		args = append(args, fmt.Sprintf("--%s=%d", flagUDPForwardPort, relayUDPForwardPort))
+	}
+	for i, target := range cfg.UDPForwards {
+		args = append(args, fmt.Sprintf("--%s=%s", flagUDPForward, target))
+		containerPorts = append(containerPorts, v1.ContainerPort{ContainerPort: relayUDPForwardPort + int32(i), Protocol: v1.ProtocolTCP})
+	}
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name,
+		},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{
+				Name:  "relay",
+				Image: image,
+				Args:  args,
+				Ports: containerPorts,
+				ReadinessProbe: &v1.Probe{
+					Handler: v1.Handler{
+						TCPSocket: &v1.TCPSocketAction{Port: intstr.FromInt(relayTunnelPort)},
+					},
+					PeriodSeconds: 2,
+				},
+			}},
+			RestartPolicy: v1.RestartPolicyAlways,
+		},
+	}
+}
+
+// waitForPodReady polls until the pod is ready and has an IP address.
+func waitForPodReady(ctx context.Context, cs *kubernetes.Clientset, namespace, name string) (*v1.Pod, error) {
+	deadline := time.Now().Add(relayStartTimeout)
+	for time.Now().Before(deadline) {
+		pod, err := cs.CoreV1().Pods(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		if pod.Status.Phase == v1.PodFailed || pod.Status.Phase == v1.PodSucceeded {
+			return nil, fmt.Errorf("pod %s exited", name)
+		}
+		for _, cond := range pod.Status.Conditions {
+			if cond.Type == v1.PodReady && cond.Status == v1.ConditionTrue && pod.Status.PodIP != "" {
+				return pod, nil
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	return nil, fmt.Errorf("timed out waiting for pod %s to be ready", name)
+}
+
+// relayPods starts relay and probe pods for a session.  Each pod is recorded in the journal, if there is one, and is
+// deleted by the cleanup stack.
+type relayPods struct {
+	cs          *kubernetes.Clientset
+	jrnl        *model.Journal
+	sess        *session
+	cleanup     *cleanupStack
+	image       string
+	annotations map[string]string
+}
+
+// Start creates a relay pod in namespace and waits for it to be ready.
+func (rp *relayPods) Start(ctx context.Context, namespace string, pod *v1.Pod) (*v1.Pod, error) {
+	util.LogInfoListItem("starting relay pod %s", pod.Name)
+	if _, err := rp.Create(ctx, namespace, pod); err != nil {
+		return nil, err
+	}
+	started, err := waitForPodReady(ctx, rp.cs, namespace, pod.Name)
+	if err != nil {
+		return nil, fmt.Errorf("error starting relay pod: %w", err)
+	}
+	return started, nil
+}
+
+// Create creates a pod in namespace without waiting for it, returning a function that deletes it early.
+// The pod is deleted by the cleanup stack if it hasn't been already.
+func (rp *relayPods) Create(ctx context.Context, namespace string, pod *v1.Pod) (func(ctx context.Context), error) {
+	pod.Labels = rp.sess.Labels()
+	appendAnnotation(&pod.ObjectMeta, model.AnnotationSupplanted, "true")
+	for k, v := range rp.annotations {
+		appendAnnotation(&pod.ObjectMeta, k, v)
+	}
+	if err := rp.sess.EnsureLease(ctx, namespace); err != nil {
+		return nil, fmt.Errorf("error creating session lease in %s: %w", namespace, err)
+	}
+
+	// the pod is journaled before it's created in case we are killed while creating it, but it's only
+	// ours to delete once the create succeeds
+	if rp.jrnl != nil {
+		err := rp.jrnl.Record(model.JournalEntry{
+			Op:        model.JournalCreatePod,
+			Namespace: namespace,
+			Name:      pod.Name,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error recording pod %s: %w", pod.Name, err)
+		}
+	}
+	podName := pod.Name
+	if _, err := rp.cs.CoreV1().Pods(namespace).Create(ctx, pod, metav1.CreateOptions{}); err != nil {
+		recordUndo(rp.jrnl, model.JournalDeletePod, namespace, podName)
+		return nil, fmt.Errorf("error creating pod %s: %w", podName, err)
+	}
+
+	var once sync.Once
+	del := func(ctx context.Context) {
+		once.Do(func() { deleteRelayPod(ctx, rp.cs, rp.jrnl, namespace, podName) })
+	}
+	rp.cleanup.Push(del)
+	return del, nil
+}
+
+// startRelayTunnel forwards to the relay pod and keeps tunnels open to it, proxying connections
+// and datagrams that arrive on each relay port to the local address in targets or udpTargets.
+func startRelayTunnel(ctx context.Context, f cmdutil.Factory, pod *v1.Pod, targets map[int32]string, udpTargets map[int32]string) (*relayTunnel, error) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	fw, err := kube.PortForwardPod(ctx, f, pod.Namespace, pod.Name, loopback,
+		[]kube.PortConfig{{LocalPort: 0, TargetPort: relayTunnelPort}})
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-fw.Ready:
+	case <-ctx.Done():
+		fw.Close()
+		return nil, ctx.Err()
+	}
+	fwPorts, err := fw.GetPorts()
+	if err != nil {
+		fw.Close()
+		return nil, err
+	}
+	tunnelAddr := net.JoinHostPort(loopback.String(), strconv.Itoa(int(fwPorts[0].Local)))
+
+	client := &tunnel.Client{
+		Dial:       func() (net.Conn, error) { return net.Dial("tcp", tunnelAddr) },
+		Targets:    targets,
+		UDPTargets: udpTargets,
+	}
+
+	rt := &relayTunnel{
+		Pod:  pod,
+		fw:   fw,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go func() {
+		defer close(rt.done)
+		client.Run(rt.stop)
+	}()
+	return rt, nil
+}
+
+// deleteRelayPod deletes a relay pod that we created
+func deleteRelayPod(ctx context.Context, cs *kubernetes.Clientset, jrnl *model.Journal, namespace, name string) {
+	util.LogInfoListItem("deleting relay pod %s", name)
+	err := cs.CoreV1().Pods(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		util.LogError("error deleting relay pod %s: %s", name, err)
+		return
+	}
+	recordUndo(jrnl, model.JournalDeletePod, namespace, name)
+}
+
+const flagTunnelPort = "tunnel-port"
+const flagPort = "port"
+const flagUDPPort = "udp-port"
+const flagUDPForwardPort = "udp-forward-port"
+const flagUDPForward = "udp-forward"
+
+func init() {
+	rootCmd.AddCommand(relayCmd)
+	relayCmd.Flags().Int32(flagTunnelPort, relayTunnelPort, "Port to accept tunnels from supplant on")
+	relayCmd.Flags().Int32Slice(flagPort, nil, "Port to accept connections on and send through a tunnel")
+	relayCmd.Flags().Int32Slice(flagUDPPort, nil, "UDP port to accept datagrams on and send through a tunnel")
+	relayCmd.Flags().Int32(flagUDPForwardPort, relayUDPForwardPort, "First port to accept streams of datagrams on, one port for each --udp-forward")
+	relayCmd.Flags().StringSlice(flagUDPForward, nil, "Address to send the datagrams streamed to the next forward port to, may be repeated")
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/util"
+)
+
+// renderCmd represents the render command
+var renderCmd = &cobra.Command{
+	Use:   "render [flags] config.yml",
+	Short: "render prints a configuration merged with the configurations it extends",
+	Long: `render prints the configuration that 'run' would use, after
+merging the configuration file on top of each of the files
+listed under 'extends' and applying the profile if one is given.`,
+	Args: cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		cfg, _ := loadConfig(args[0])
+		if cfg == nil {
+			exitCode = 1
+			return
+		}
+		// the profile is applied directly since the output is only the configuration
+		if profile, _ := cmd.Flags().GetString(flagProfile); profile != "" {
+			if err := cfg.ApplyProfile(profile); err != nil {
+				util.LogError("%s", err)
+				exitCode = 1
+				return
+			}
+		}
+		if err := encodeConfig(os.Stdout, *cfg); err != nil {
+			util.LogError("error encoding config: %s", err)
+			exitCode = 1
+		}
+	},
+}
+
+func init() {
+	configCmd.AddCommand(renderCmd)
+	renderCmd.Flags().String(flagProfile, "", "Name of the profile in the configuration to apply")
+}
@@ -0,0 +1,174 @@
+package cmd
+
+import (
+	"context"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// restoreCmd represents the restore command
+var restoreCmd = &cobra.Command{
+	Use:   "restore [flags] [journal]",
+	Short: "restore undoes changes left behind by an interrupted run",
+	Long: `restore replays the journal written by 'run', restoring any
+services that were supplanted and deleting the endpoints that
+were created for them.  This is used to recover the cluster if
+supplant was killed before it could clean up after itself.  If
+no journal is specified, every journal in the user cache
+directory is replayed.  Journals that belong to a run that is
+still active are skipped unless --force is used.
+
+With --service, the original service is instead rebuilt from the
+backup that 'run' stores on the supplanted service, so no local
+files are needed and any machine can undo a supplant.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		ctx := context.Background()
+		services, _ := cmd.Flags().GetStringSlice(flagService)
+		if len(services) > 0 {
+			if len(args) > 0 {
+				util.LogError("a journal can't be specified with --%s", flagService)
+				return
+			}
+			f := cmdutil.NewFactory(kubeConfigFlags)
+			cs, err := f.KubernetesClientSet()
+			if err != nil {
+				util.LogError("error getting kubernetes client: %s", err)
+				return
+			}
+			for _, svc := range services {
+				restoreFromCluster(ctx, cs, svc)
+			}
+			return
+		}
+
+		paths := args
+		if len(paths) == 0 {
+			var err error
+			paths, err = model.ListJournals()
+			if err != nil {
+				util.LogError("error listing journals: %s", err)
+				return
+			}
+			if len(paths) == 0 {
+				util.LogInfo("no journals found, nothing to restore")
+				return
+			}
+		}
+
+		f := cmdutil.NewFactory(kubeConfigFlags)
+		cs, err := f.KubernetesClientSet()
+		if err != nil {
+			util.LogError("error getting kubernetes client: %s", err)
+			return
+		}
+
+		force, _ := cmd.Flags().GetBool(flagForce)
+		for _, path := range paths {
+			replayJournal(ctx, cs, path, force)
+		}
+	},
+}
+
+// replayJournal undoes all of the pending changes in a journal, newest first.  Journals owned by a
+// running process are skipped unless force is set.
+func replayJournal(ctx context.Context, cs *kubernetes.Clientset, path string, force bool) {
+	if !force {
+		pid, err := model.JournalInUse(path)
+		if err != nil {
+			util.LogError("error reading journal %s: %s", path, err)
+			return
+		}
+		if pid != 0 {
+			util.LogInfoHeader("skipping %s, it is in use by process %d (use --%s to restore anyway)", path, pid, flagForce)
+			return
+		}
+	}
+	jrnl, err := model.OpenJournal(path)
+	if err != nil {
+		util.LogError("error reading journal %s: %s", path, err)
+		return
+	}
+	defer closeJournal(jrnl)
+
+	pending := jrnl.Pending()
+	util.LogInfoHeader("restoring from %s", path)
+	if len(pending) == 0 {
+		util.LogInfoListItem("nothing to restore")
+		return
+	}
+	for i := len(pending) - 1; i >= 0; i-- {
+		e := pending[i]
+		switch e.Op {
+		case model.JournalBackupService:
+			if e.Service == nil {
+				util.LogError("journal entry for service %s has no backup", e.Name)
+				continue
+			}
+			restoreService(ctx, cs, jrnl, e.Service)
+		case model.JournalCreateEndpoints:
+			deleteEndpoints(ctx, cs, jrnl, e.Namespace, e.Name)
+		case model.JournalCreateEndpointSlice:
+			deleteEndpointSlice(ctx, cs, jrnl, e.Namespace, e.Name)
+		case model.JournalCreatePod:
+			deleteRelayPod(ctx, cs, jrnl, e.Namespace, e.Name)
+		}
+	}
+}
+
+// restoreFromCluster restores a supplanted service using the backup stored in its annotations.
+func restoreFromCluster(ctx context.Context, cs *kubernetes.Clientset, nsName string) {
+	namespace, name := splitNamespacedName(nsName)
+	util.LogInfoHeader("restoring %s/%s from cluster", namespace, name)
+	svc, err := cs.CoreV1().Services(namespace).Get(ctx, name, metav1.GetOptions{})
+	if err != nil {
+		util.LogError("error getting service %s/%s: %s", namespace, name, err)
+		return
+	}
+	if _, ok := svc.Annotations[model.AnnotationSupplanted]; !ok {
+		util.LogError("service %s/%s is not supplanted", namespace, name)
+		return
+	}
+	restoreFromBackup(ctx, cs, svc)
+}
+
+// restoreFromBackup replaces a supplanted service with the original stored in its annotations.
+func restoreFromBackup(ctx context.Context, cs *kubernetes.Clientset, svc *v1.Service) {
+	backup, err := model.DecodeServiceBackup(svc)
+	if err != nil {
+		util.LogError("%s", err)
+		return
+	}
+	deleteEndpointSlice(ctx, cs, nil, svc.Namespace, svc.Name)
+	deleteEndpoints(ctx, cs, nil, svc.Namespace, svc.Name)
+	restoreService(ctx, cs, nil, backup)
+}
+
+// splitNamespacedName splits a namespace/name string, using the current namespace if
+// one isn't provided.
+func splitNamespacedName(nsName string) (string, string) {
+	if idx := strings.Index(nsName, "/"); idx >= 0 {
+		return nsName[:idx], nsName[idx+1:]
+	}
+	namespace := metav1.NamespaceDefault
+	if kubeConfigFlags.Namespace != nil && *kubeConfigFlags.Namespace != "" {
+		namespace = *kubeConfigFlags.Namespace
+	}
+	return namespace, nsName
+}
+
+const flagService = "service"
+const flagForce = "force"
+
+func init() {
+	rootCmd.AddCommand(restoreCmd)
+	restoreCmd.Flags().StringSlice(flagService, nil, "Restore the namespace/name service from the backup stored in the cluster instead of from a journal")
+	restoreCmd.Flags().Bool(flagForce, false, "Replay journals even if the run that owns them is still active")
+}
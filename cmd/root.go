@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/pflag"
@@ -24,19 +25,50 @@ with the rest of the services in a cluster.`,
 	Version: version,
 }
 
+// exitCode is the status that supplant exits with once a command has finished and cleaned up.  Commands
+// set it instead of calling os.Exit so that their deferred cleanup still runs.
+var exitCode int
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	cobra.CheckErr(rootCmd.Execute())
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
 }
 
 var kubeConfigFlags = genericclioptions.NewConfigFlags(false)
 
+const flagNamespace = "namespace"
+
+// namespaces holds each --namespace flag.  The first one is used as the namespace of kubeConfigFlags and
+// commands that work across several namespaces use all of them.
+var namespaces []string
+
+// annotationNamespaces marks a command that accepts more than one --namespace flag.
+const annotationNamespaces = "supplant/namespaces"
+
 func init() {
 	flags := pflag.NewFlagSet("supplant", pflag.ExitOnError)
 	pflag.CommandLine = flags
 	flags.AddFlagSet(rootCmd.PersistentFlags())
+
+	// we register our own repeatable namespace flag in place of the one from the kubeconfig flags
+	namespace := kubeConfigFlags.Namespace
+	kubeConfigFlags.Namespace = nil
 	kubeConfigFlags.AddFlags(flags)
+	kubeConfigFlags.Namespace = namespace
+	flags.StringSliceVarP(&namespaces, flagNamespace, "n", nil, "If present, the namespace scope for this CLI request, may be repeated for commands that support several namespaces")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		if len(namespaces) > 1 && cmd.Annotations[annotationNamespaces] == "" {
+			return fmt.Errorf("%s only accepts a single --%s", cmd.CommandPath(), flagNamespace)
+		}
+		if len(namespaces) != 0 {
+			*kubeConfigFlags.Namespace = namespaces[0]
+		}
+		return nil
+	}
 
 	rootCmd.SetVersionTemplate(fmt.Sprintf("supplant version {{.Version}} / %s\n", date))
 }
@@ -2,16 +2,23 @@ package cmd
 
 import (
 	"context"
+	"fmt"
+	"io"
 	"net"
 	"os"
-	"os/signal"
+	"strconv"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/tzneal/supplant/kube"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/tunnel"
 	"github.com/tzneal/supplant/util"
 	v1 "k8s.io/api/core/v1"
+	discoveryv1 "k8s.io/api/discovery/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/util/intstr"
 	"k8s.io/client-go/kubernetes"
 	cmdutil "k8s.io/kubectl/pkg/cmd/util"
@@ -19,14 +26,73 @@ import (
 
 // runCmd represents the run command
 var runCmd = &cobra.Command{
-	Use:   "run [flags] config.yml",
+	Use:   "run [flags] config.yml [-- command [args...]]",
 	Short: "run launches a configuration",
 	Long: `run launches a configuration, pointing services to local ports
 on your machine and forwarding local ports to services
-inside the cluster as described by the configuration file.`,
-	Args: cobra.ExactValidArgs(1),
+inside the cluster as described by the configuration file.
+
+If a command is given after --, it is run once everything is
+ready with <SVC>_SERVICE_HOST and <SVC>_SERVICE_PORT style
+variables pointing at the forwarded services and
+SUPPLANT_<SVC>_PORT variables with the local ports of the
+supplanted services.  When the command exits, supplant cleans
+up and exits with the command's status.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if dash := cmd.ArgsLenAtDash(); dash != -1 {
+			if dash != 1 || len(args) < 2 {
+				return fmt.Errorf("expected a config file followed by -- and a command")
+			}
+			return nil
+		}
+		return cobra.ExactArgs(1)(cmd, args)
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 		inputFile := args[0]
+		var child []string
+		if cmd.ArgsLenAtDash() == 1 {
+			child = args[1:]
+			// failing before the command starts is a failure of the command for anyone scripting us
+			exitCode = 1
+		}
+		transport, _ := cmd.Flags().GetString(flagTransport)
+		if transport != transportDirect && transport != transportRelay {
+			util.LogError("unsupported transport %s, must be one of %s or %s", transport, transportDirect, transportRelay)
+			return
+		}
+		relayImage, _ := cmd.Flags().GetString(flagRelayImage)
+		teardownTimeout, _ := cmd.Flags().GetDuration(flagTeardownTimeout)
+
+		cfg, pos := loadConfig(inputFile)
+		if cfg == nil {
+			return
+		}
+		if !applyProfile(cmd, cfg) {
+			return
+		}
+
+		// every change we make is recorded in the journal before it's applied so that it can be
+		// undone with 'supplant restore' even if we don't get a chance to clean up
+		jrnl := openJournal(cmd)
+		if jrnl == nil {
+			return
+		}
+		defer closeJournal(jrnl)
+
+		// ctx is cancelled on the first termination signal and is used for everything up until we
+		// start to clean up.  A second signal forces us to exit, removing the session files and reporting
+		// what wasn't undone.
+		files := &sessionFiles{}
+		ctx, stopSignals := newSignalContext(func() {
+			files.Remove()
+			reportUnrestored(jrnl)
+		})
+		defer stopSignals()
+
+		// changes to the cluster are undone by the cleanup stack, which has its own timeout so that
+		// teardown still happens after ctx is cancelled but can't hang forever
+		cleanup := &cleanupStack{}
+		defer cleanup.Run(teardownTimeout)
 
 		util.LogInfoHeader("connecting to K8s")
 		f := cmdutil.NewFactory(kubeConfigFlags)
@@ -43,7 +109,6 @@ inside the cluster as described by the configuration file.`,
 		}
 
 		util.LogInfoHeader("K8s version: %s", ver.String())
-		ctx := context.Background()
 		type svcKey struct {
 			namespace string
 			name      string
@@ -62,15 +127,50 @@ inside the cluster as described by the configuration file.`,
 			svcMap[key] = svc
 		}
 
-		supplantingAtLeastOne := false
-		cfg := readConfig(inputFile)
-		if cfg == nil {
+		// check everything we can before we change anything
+		if !validateConfig(inputFile, cfg, pos, svcList, transport == transportRelay) {
 			return
 		}
 
-		// defer the deletion of endpoints so we can try to ensure we always put things
+		supplantingAtLeastOne := false
+		// where everything can be reached, for the child command and the session files
+		info := &model.SessionInfo{}
+		ownerAnnotations := model.OwnerAnnotations(time.Now())
+
+		// everything we create is labeled with our session and the session is kept alive with a lease
+		// so that 'supplant gc' can tell if we are still running
+		sess := newSession(cs)
+		cleanup.Push(sess.Close)
+		util.LogInfoHeader("session %s", sess.ID)
+		relays := &relayPods{
+			cs:          cs,
+			jrnl:        jrnl,
+			sess:        sess,
+			cleanup:     cleanup,
+			image:       relayImage,
+			annotations: ownerAnnotations,
+		}
+
+		// newer clusters use endpoint slices, but we still create endpoints for anything that reads them
+		useEndpointSlices := supportsEndpointSlices(cs)
+		if !useEndpointSlices {
+			util.LogInfoHeader("endpoint slices are not supported, only creating endpoints")
+		}
+
+		// clean up any of our endpoints that were missed so we can try to ensure we always put things
 		// back like they were
-		defer deleteSupplantedEndpoints(cs)
+		cleanup.Push(func(ctx context.Context) {
+			deleteSupplantedEndpoints(ctx, cs, sess.ID, useEndpointSlices)
+		})
+
+		// the addresses the cluster connects to us on, which are only needed if it connects directly
+		var extIPs []net.IP
+		if namespace, ok := firstSupplanted(cfg); ok && transport == transportDirect {
+			if extIPs, err = externalIPs(ctx, cmd, cs, relays, namespace); err != nil {
+				util.LogError("%s", err)
+				return
+			}
+		}
 
 		for _, supplantSvc := range cfg.Supplant {
 			if !supplantSvc.Enabled {
@@ -79,8 +179,31 @@ inside the cluster as described by the configuration file.`,
 
 			for i := range supplantSvc.Ports {
 				port := &supplantSvc.Ports[i]
+				udp := model.NormalizeProtocol(port.Protocol) == v1.ProtocolUDP
+				// we own the listener and proxy to the local target, so there is no need to hand the port
+				// to the user.  With the relay transport, the tunnel connects directly to the target instead.
+				if port.LocalTarget != "" && transport == transportDirect {
+					// the first listener chooses the port if there isn't one, which the others then share
+					for _, ip := range extIPs {
+						closer, err := listenLocalTarget(ip, port)
+						if err != nil {
+							util.LogError("%s for service %s", err, supplantSvc.Name)
+							return
+						}
+						cleanup.Push(func(context.Context) { closer.Close() })
+					}
+					continue
+				}
 				// we need to choose a port for the user
-				if port.LocalPort == 0 {
+				if port.LocalPort == 0 && udp {
+					conn, err := net.ListenPacket("udp", ":0")
+					if err != nil {
+						util.LogError("error choosing local port for service %s: %s", supplantSvc.Name, err)
+						return
+					}
+					port.LocalPort = int32(conn.LocalAddr().(*net.UDPAddr).Port)
+					conn.Close()
+				} else if port.LocalPort == 0 {
 					listener, err := net.Listen("tcp", ":0")
 					if err != nil {
 						util.LogError("error choosing local port for service %s: %s", supplantSvc.Name, err)
@@ -95,24 +218,34 @@ inside the cluster as described by the configuration file.`,
 			svc, ok := svcMap[key]
 			if !ok {
 				util.LogError("unable to find service %s in namespace %s", supplantSvc.Name, supplantSvc.Namespace)
+				return
 			}
 
 			// backup the service before we change it so we can replace them it when
 			// exiting
 			serviceBackup := svc.DeepCopy()
 
-			svcPorts := map[int32]v1.ServicePort{}
-			for _, port := range svc.Spec.Ports {
-				svcPorts[port.Port] = port
-			}
-
-			// ensure that we are covering all of the ports
-			for _, port := range supplantSvc.Ports {
-				_, match := svcPorts[port.Port]
+			// ensure that we are covering all of the ports, finding named ports by name in case they were renumbered
+			svcPorts := make([]v1.ServicePort, len(supplantSvc.Ports))
+			for i := range supplantSvc.Ports {
+				port := &supplantSvc.Ports[i]
+				sp, match := port.Resolve(svc)
 				if !match {
 					util.LogError("no match found for port %d in service %s", port.Port, svc.Name)
 					return
 				}
+				if sp.Port != port.Port {
+					util.LogInfoListItem("port %s of service %s is now %d instead of %d", port.Name, svc.Name, sp.Port, port.Port)
+					port.Port = sp.Port
+				}
+				port.Protocol = model.NormalizeProtocol(sp.Protocol)
+				svcPorts[i] = sp
+			}
+
+			if _, supplanted := svc.Annotations[model.AnnotationSupplanted]; supplanted {
+				util.LogError("service %s is already supplanted, use 'supplant restore --service %s/%s' to restore it first",
+					svc.Name, svc.Namespace, svc.Name)
+				return
 			}
 
 			if svc.Spec.Selector == nil || len(svc.Spec.Selector) == 0 {
@@ -120,48 +253,147 @@ inside the cluster as described by the configuration file.`,
 				return
 			}
 
-			// clear the selector and ports
-			svc.ObjectMeta.Labels = nil
+			// the addresses the endpoints point to, one for each IP family of the service
+			var epIPs []net.IP
+			if transport == transportDirect {
+				if epIPs, err = endpointIPs(svc, extIPs); err != nil {
+					util.LogError("%s", err)
+					return
+				}
+			}
+
+			// clear the selector and ports, replacing the labels with our own
+			svc.ObjectMeta.Labels = sess.Labels()
 			svc.Spec.Selector = nil
 			svc.Spec.Ports = nil
 
-			ip, err := cmd.Flags().GetIP(flagExternalIP)
-			if err != nil {
-				util.LogError("error getting external IP: %s", err)
-				return
+			// with the relay transport, connections arrive through a tunnel to our local ports
+			logIP := net.IPv4(127, 0, 0, 1)
+			if transport == transportDirect {
+				logIP = epIPs[0]
 			}
 
 			util.LogInfoHeader("updating service %s", svc.Name)
 			// and specify our new port mappings
-			for _, port := range supplantSvc.Ports {
+			for i, port := range supplantSvc.Ports {
 				var newPort v1.ServicePort
 				newPort.Name = port.Name
 				newPort.Port = port.Port
 				newPort.TargetPort = intstr.FromInt(int(port.LocalPort))
-				newPort.Protocol = svcPorts[port.Port].Protocol
+				newPort.Protocol = svcPorts[i].Protocol
+				// keep the node port so that anything using it from outside the cluster still works
+				newPort.NodePort = svcPorts[i].NodePort
 				svc.Spec.Ports = append(svc.Spec.Ports, newPort)
-				util.LogInfoListItem("%s:%d is now the endpoint for %s:%d", ip, port.LocalPort, supplantSvc.Name, port.Port)
+				if port.LocalTarget != "" {
+					util.LogInfoListItem("%s:%d is now the endpoint for %s:%d and is proxied to %s", logIP, port.LocalPort,
+						supplantSvc.Name, port.Port, port.LocalTarget)
+				} else {
+					util.LogInfoListItem("%s:%d is now the endpoint for %s:%d", logIP, port.LocalPort, supplantSvc.Name, port.Port)
+				}
+			}
+			appendAnnotation(&svc.ObjectMeta, model.AnnotationSupplanted, "true")
+			for k, v := range ownerAnnotations {
+				appendAnnotation(&svc.ObjectMeta, k, v)
+			}
+
+			// store the original service on the replacement so it can be restored from any machine
+			backupData, err := model.EncodeServiceBackup(serviceBackup)
+			if err != nil {
+				util.LogError("error backing up service %s: %s", svc.Name, err)
+				return
+			}
+			appendAnnotation(&svc.ObjectMeta, model.AnnotationBackup, backupData)
+
+			if err = sess.EnsureLease(ctx, svc.Namespace); err != nil {
+				util.LogError("error creating session lease in %s: %s", svc.Namespace, err)
+				return
+			}
+
+			if transport == transportRelay {
+				// the cluster can't reach us, so point the endpoints at a relay pod that tunnels back to us
+				cfg := tunnel.RelayConfig{TunnelPort: relayTunnelPort}
+				targets := map[int32]string{}
+				udpTargets := map[int32]string{}
+				for _, port := range supplantSvc.Ports {
+					if port.Protocol == v1.ProtocolUDP {
+						cfg.UDPPorts = append(cfg.UDPPorts, port.LocalPort)
+						udpTargets[port.LocalPort] = port.LocalAddress()
+						continue
+					}
+					cfg.Ports = append(cfg.Ports, port.LocalPort)
+					targets[port.LocalPort] = port.LocalAddress()
+				}
+				pod, err := relays.Start(ctx, svc.Namespace, newRelayPod(relayPodName(svc.Name, sess.ID), relayImage, cfg))
+				if err != nil {
+					util.LogError("%s", err)
+					return
+				}
+				rt, err := startRelayTunnel(ctx, f, pod, targets, udpTargets)
+				if err != nil {
+					util.LogError("error tunneling to relay pod %s: %s", pod.Name, err)
+					return
+				}
+				cleanup.Push(func(context.Context) { rt.Close() })
+				var podIPs []net.IP
+				for _, podIP := range pod.Status.PodIPs {
+					podIPs = append(podIPs, net.ParseIP(podIP.IP))
+				}
+				if len(podIPs) == 0 {
+					podIPs = append(podIPs, net.ParseIP(pod.Status.PodIP))
+				}
+				if epIPs, err = endpointIPs(svc, podIPs); err != nil {
+					util.LogError("%s", err)
+					return
+				}
+				util.LogInfoListItem("relay pod %s at %s is tunneling to local ports", pod.Name, epIPs[0])
+			}
+
+			// the backup is only recorded right before the delete so that restore never touches a service
+			// that we didn't change
+			err = jrnl.Record(model.JournalEntry{
+				Op:        model.JournalBackupService,
+				Namespace: serviceBackup.Namespace,
+				Name:      serviceBackup.Name,
+				Service:   serviceBackup,
+			})
+			if err != nil {
+				util.LogError("error recording backup of service %s: %s", svc.Name, err)
+				return
 			}
-			appendAnnotation(&svc.ObjectMeta, "supplant", "true")
 
 			// delete the existing service
 			err = cs.CoreV1().Services(svc.Namespace).Delete(ctx, svc.Name, metav1.DeleteOptions{})
 			if err != nil && !errors.IsNotFound(err) {
+				// the service is as it was, so there is nothing to restore
+				recordUndo(jrnl, model.JournalRestoreService, serviceBackup.Namespace, serviceBackup.Name)
 				util.LogError("error deleting existing service %s: %s", svc.Name, err)
 				return
 			}
 
 			// always try to restore the service
-			defer restoreService(cs, serviceBackup)
+			cleanup.Push(func(ctx context.Context) {
+				restoreService(ctx, cs, jrnl, serviceBackup)
+			})
 
 			// Prepare to recreate a new service without a selector.  I attempted to just remove the selector
 			// on the existing service, which somewhat worked but it would then load-balance across the existing service
 			// and our replacement.  Removing the service seems to make this more reliable.
 			prepareServiceForCreation(&svc)
 
-			_, err = cs.CoreV1().Services(svc.Namespace).Create(ctx, &svc, metav1.CreateOptions{})
+			created, err := createService(ctx, cs, &svc)
 			if err != nil {
 				util.LogError("error updating service %s: %s", svc.Name, err)
+				if holder := serviceUsingClusterIP(ctx, cs, svc.Spec.ClusterIP); holder != "" {
+					util.LogError("cluster IP %s of %s is now used by %s", svc.Spec.ClusterIP, svc.Name, holder)
+				}
+				return
+			}
+
+			// clients may have cached the cluster IP or use the node ports, so we can't continue if either changed
+			if drift := serviceDrift(serviceBackup, created); len(drift) != 0 {
+				for _, d := range drift {
+					util.LogError("service %s %s", svc.Name, d)
+				}
 				return
 			}
 
@@ -174,28 +406,89 @@ inside the cluster as described by the configuration file.`,
 				return
 			}
 
-			// and prepare to create our own that points back to our local IP address
+			// and prepare to create our own that points back to our local IP address.  Endpoints only
+			// hold the primary IP family of a service, the other is only in the endpoint slices.
 			ep := &v1.Endpoints{
 				ObjectMeta: metav1.ObjectMeta{Name: svc.Name},
 				Subsets: []v1.EndpointSubset{{
 					Addresses: []v1.EndpointAddress{{
-						IP: ip.String(),
+						IP: epIPs[0].String(),
 					}}}},
 			}
 
-			appendAnnotation(&ep.ObjectMeta, "supplant", "true")
+			ep.Labels = sess.Labels()
+			if useEndpointSlices {
+				// we create our own endpoint slice, so prevent the endpoints from being mirrored to another one
+				ep.Labels[discoveryv1.LabelSkipMirror] = "true"
+			}
+			appendAnnotation(&ep.ObjectMeta, model.AnnotationSupplanted, "true")
+			for k, v := range ownerAnnotations {
+				appendAnnotation(&ep.ObjectMeta, k, v)
+			}
 
 			for _, port := range supplantSvc.Ports {
 				ep.Subsets[0].Ports = append(ep.Subsets[0].Ports, v1.EndpointPort{
-					Name: port.Name,
-					Port: port.LocalPort,
+					Name:     port.Name,
+					Port:     port.LocalPort,
+					Protocol: port.Protocol,
 				})
 			}
+			err = jrnl.Record(model.JournalEntry{
+				Op:        model.JournalCreateEndpoints,
+				Namespace: svc.Namespace,
+				Name:      svc.Name,
+			})
+			if err != nil {
+				util.LogError("error recording endpoint %s: %s", svc.Name, err)
+				return
+			}
+			cleanup.Push(func(ctx context.Context) {
+				deleteEndpoints(ctx, cs, jrnl, svc.Namespace, svc.Name)
+			})
+
 			_, err = endpoints.Create(ctx, ep, metav1.CreateOptions{})
 			if err != nil {
 				util.LogError("error creating endpoint %s: %s", svc.Name, err)
 				return
 			}
+
+			if useEndpointSlices {
+				var slicePorts []discoveryv1.EndpointPort
+				for _, port := range supplantSvc.Ports {
+					slicePorts = append(slicePorts, endpointSlicePort(port.Name, port.LocalPort, port.Protocol))
+				}
+				err = jrnl.Record(model.JournalEntry{
+					Op:        model.JournalCreateEndpointSlice,
+					Namespace: svc.Namespace,
+					Name:      svc.Name,
+				})
+				if err != nil {
+					util.LogError("error recording endpoint slices of %s: %s", svc.Name, err)
+					return
+				}
+				cleanup.Push(func(ctx context.Context) {
+					deleteEndpointSlice(ctx, cs, jrnl, svc.Namespace, svc.Name)
+				})
+
+				// a slice holds a single address type, so dual-stack services get one for each family
+				for _, epIP := range epIPs {
+					slice := newEndpointSlice(svc.Name, epIP, slicePorts)
+					for k, v := range sess.Labels() {
+						slice.Labels[k] = v
+					}
+					appendAnnotation(&slice.ObjectMeta, model.AnnotationSupplanted, "true")
+					for k, v := range ownerAnnotations {
+						appendAnnotation(&slice.ObjectMeta, k, v)
+					}
+
+					_, err = cs.DiscoveryV1().EndpointSlices(svc.Namespace).Create(ctx, slice, metav1.CreateOptions{})
+					if err != nil {
+						util.LogError("error creating endpoint slice %s: %s", slice.Name, err)
+						return
+					}
+				}
+			}
+			info.AddSupplant(supplantSvc, epIPs[0])
 			supplantingAtLeastOne = true
 		}
 
@@ -205,29 +498,67 @@ inside the cluster as described by the configuration file.`,
 			return
 		}
 
+		// with loopback aliases, each service is given its own address so that it can keep its ports
+		loopbackAliases, _ := cmd.Flags().GetBool(flagLoopbackAliases)
+		aliases := 0
+
 		portForwardingAtLeastOne := false
-		var portForwards []kube.PortForwarder
+		var portForwards []*kube.PortForwarder
+		// the TCP ports of each port forward, in the order they are forwarded
+		var forwardedPorts [][]model.ExternalPortConfig
+		var udpForwards []*udpForward
 		for _, externalSvc := range cfg.External {
 			if !externalSvc.Enabled {
 				continue
 			}
+			listenIP := localIp
+			if loopbackAliases {
+				listenIP = model.LoopbackAlias(aliases)
+				aliases++
+				svc := svcMap[svcKey{externalSvc.Namespace, externalSvc.Name}]
+				if err := useServicePorts(listenIP, svc, externalSvc.Ports); err != nil {
+					util.LogError("unable to forward %s on %s: %s", externalSvc.Name, listenIP, err)
+					return
+				}
+			}
+			tcpPorts, udpPorts := splitUDPPorts(externalSvc.Ports)
 			var pc []kube.PortConfig
-			for _, port := range externalSvc.Ports {
+			for _, port := range tcpPorts {
 				pc = append(pc, kube.PortConfig{
-					LocalPort:  port.LocalPort,
-					TargetPort: port.TargetPort,
+					LocalPort:      port.LocalPort,
+					TargetPort:     port.TargetPort,
+					TargetPortName: port.TargetPortName,
 				})
 			}
 
+			mode, err := kube.ParseForwardMode(externalSvc.Mode)
+			if err != nil {
+				util.LogError("invalid mode for %s: %s", externalSvc.Name, err)
+				return
+			}
+
 			if len(pc) > 0 {
-				fw, err := kube.PortForward(f, externalSvc.Namespace, externalSvc.Name, localIp, pc)
+				fw, err := kube.PortForward(ctx, f, externalSvc.Namespace, externalSvc.Name, listenIP, pc, mode)
 				if err != nil {
 					util.LogError("error forwarding port for %s: %s", externalSvc.Name, err)
 					return
 				}
 				// ensure we close it
-				defer closePortForward(fw)
+				cleanup.Push(func(context.Context) { closePortForward(fw) })
 				portForwards = append(portForwards, fw)
+				forwardedPorts = append(forwardedPorts, tcpPorts)
+				portForwardingAtLeastOne = true
+			}
+
+			if len(udpPorts) > 0 {
+				util.LogInfoHeader("forwarding UDP ports for %s through a relay pod", externalSvc.Name)
+				uf, err := startUDPForward(ctx, f, relays, svcMap[svcKey{externalSvc.Namespace, externalSvc.Name}], udpPorts, listenIP)
+				if err != nil {
+					util.LogError("error forwarding UDP ports for %s: %s", externalSvc.Name, err)
+					return
+				}
+				cleanup.Push(func(context.Context) { uf.Close() })
+				udpForwards = append(udpForwards, uf)
 				portForwardingAtLeastOne = true
 			}
 		}
@@ -236,65 +567,193 @@ inside the cluster as described by the configuration file.`,
 			util.LogError("no services configured for supplanting or port forwarding, exiting...")
 			return
 		}
-		// wait for all of the port forwards to be ready
-		for _, fw := range portForwards {
-			<-fw.Forwarder.Ready
+		// wait for all of the port forwards to be ready, the UDP forwards already are
+		udpPorts := map[svcKey][]model.EnvPort{}
+		for _, uf := range udpForwards {
+			udpPorts[svcKey{uf.Namespace, uf.Name}] = uf.Ports
+		}
+		for i, fw := range portForwards {
+			select {
+			case <-fw.Ready:
+			case <-ctx.Done():
+				return
+			}
 			util.LogInfoHeader("forwarding for %s", fw.Name)
-			ports, err := fw.Forwarder.GetPorts()
+			ports, err := fw.GetPorts()
 			if err != nil {
 				util.LogError("port forward error: %s", err)
 				return
 			}
+			var envPorts []model.EnvPort
+			for j, port := range ports {
+				util.LogInfoListItem("%s:%d points to remote %s:%d", fw.LocalIP(), port.Local, fw.Name, port.Remote)
+				envPort := model.EnvPort{Port: int32(port.Remote), Local: int32(port.Local), Protocol: v1.ProtocolTCP}
+				// the ports are forwarded in the order they are configured
+				if j < len(forwardedPorts[i]) {
+					envPort.Name = forwardedPorts[i][j].Name
+				}
+				envPorts = append(envPorts, envPort)
+			}
+			key := svcKey{fw.Namespace, fw.Name}
+			envPorts = append(envPorts, udpPorts[key]...)
+			delete(udpPorts, key)
+			info.AddForward(fw.Namespace, fw.Name, fw.LocalIP().String(), envPorts)
+		}
+		for _, uf := range udpForwards {
+			ports, ok := udpPorts[svcKey{uf.Namespace, uf.Name}]
+			if !ok {
+				continue
+			}
+			util.LogInfoHeader("forwarding UDP for %s", uf.Name)
 			for _, port := range ports {
-				util.LogInfoListItem("%s:%d points to remote %s:%d", localIp, port.Local, fw.Name, port.Remote)
+				util.LogInfoListItem("%s:%d/udp points to remote %s:%d", uf.IP, port.Local, uf.Name, port.Port)
 			}
+			info.AddForward(uf.Namespace, uf.Name, uf.IP.String(), ports)
+		}
+
+		stopDNS, ok := startDNS(cmd, info)
+		if !ok {
+			return
+		}
+		cleanup.Push(func(context.Context) { stopDNS() })
+		removeHosts, ok := writeHostsFile(cmd, info)
+		if !ok {
+			return
+		}
+		cleanup.Push(func(context.Context) { removeHosts() })
+		files.Write(cmd, info)
+		cleanup.Push(func(context.Context) { files.Remove() })
+
+		if len(child) != 0 {
+			exitCode = runChild(ctx, child, info.Env, teardownTimeout)
+			util.LogInfoHeader("cleaning up....")
+			return
 		}
 
 		// we've now replaced the services and are forwarding the requested ports. Wait for the user to hit Ctrl+C
 		// so we can undo all of our changes
 		util.LogInfo("forwarding ports, hit Ctrl+C to exit")
-		signals := make(chan os.Signal, 1)
-		signal.Notify(signals, os.Interrupt)
 
-		// wait on the Ctrl+C
-		<-signals
+		// wait on the Ctrl+C or another termination signal
+		<-ctx.Done()
 
 		util.LogInfoHeader("cleaning up....")
-		// all of the cleanup is done via defers so we can hopefully always return the state to what it was
-		// before we changed things
+		// all of the cleanup is done via the cleanup stack so we can hopefully always return the state
+		// to what it was before we changed things
 	},
 }
 
-func restoreService(cs *kubernetes.Clientset, sb *v1.Service) {
-	ctx := context.TODO()
+func restoreService(ctx context.Context, cs *kubernetes.Clientset, jrnl *model.Journal, sb *v1.Service) {
 	util.LogInfoListItem("restoring service %s", sb.Name)
 	err := cs.CoreV1().Services(sb.Namespace).Delete(ctx, sb.Name, metav1.DeleteOptions{})
-	if err != nil {
+	if err != nil && !errors.IsNotFound(err) {
 		util.LogError("error deleting existing service %s: %s", sb.Name, err)
 	}
 
 	// try to re-create the service even if the deletion failed (maybe it was already gone?)
 	prepareServiceForCreation(sb)
-	_, err = cs.CoreV1().Services(sb.Namespace).Create(ctx, sb, metav1.CreateOptions{})
+	created, err := createService(ctx, cs, sb)
+	if err != nil && errors.IsInvalid(err) {
+		// the original addresses are likely allocated to another service, but a service with a new IP is
+		// better than no service at all
+		util.LogError("error restoring %s with its original addresses: %s", sb.Name, err)
+		if holder := serviceUsingClusterIP(ctx, cs, sb.Spec.ClusterIP); holder != "" {
+			util.LogError("cluster IP %s of %s is now used by %s", sb.Spec.ClusterIP, sb.Name, holder)
+		}
+		fresh := sb.DeepCopy()
+		clearAllocations(fresh)
+		created, err = createService(ctx, cs, fresh)
+	}
 
 	if err != nil {
 		util.LogError("error restoring %s: %s", sb.Name, err)
+		return
+	}
+	for _, d := range serviceDrift(sb, created) {
+		util.LogError("restored service %s differs from the backup, %s", sb.Name, d)
+	}
+	recordUndo(jrnl, model.JournalRestoreService, sb.Namespace, sb.Name)
+}
+
+// deleteEndpoints deletes the endpoints that we created for a supplanted service
+func deleteEndpoints(ctx context.Context, cs *kubernetes.Clientset, jrnl *model.Journal, namespace, name string) {
+	util.LogInfoListItem("deleting endpoint %s", name)
+	err := cs.CoreV1().Endpoints(namespace).Delete(ctx, name, metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		util.LogError("error deleting endpoint %s: %s", name, err)
+		return
+	}
+	recordUndo(jrnl, model.JournalDeleteEndpoints, namespace, name)
+}
+
+func recordUndo(jrnl *model.Journal, op model.JournalOp, namespace, name string) {
+	// restoring from cluster state alone doesn't use a journal
+	if jrnl == nil {
+		return
+	}
+	err := jrnl.Record(model.JournalEntry{
+		Op:        op,
+		Namespace: namespace,
+		Name:      name,
+	})
+	if err != nil {
+		util.LogError("error recording %s for %s in journal: %s", op, name, err)
+	}
+}
+
+func openJournal(cmd *cobra.Command) *model.Journal {
+	path, _ := cmd.Flags().GetString(flagJournal)
+	if path == "" {
+		var err error
+		path, err = model.NewJournalPath()
+		if err != nil {
+			util.LogError("error determining journal location: %s", err)
+			return nil
+		}
 	}
+	if pid, err := model.JournalInUse(path); err != nil {
+		util.LogError("error reading journal %s: %s", path, err)
+		return nil
+	} else if pid != 0 {
+		util.LogError("journal %s is in use by process %d", path, pid)
+		return nil
+	}
+	jrnl, err := model.OpenJournal(path)
+	if err != nil {
+		util.LogError("error opening journal %s: %s", path, err)
+		return nil
+	}
+	// record ourselves as the owner so that 'supplant restore' leaves the journal alone while we run
+	if err = jrnl.Record(model.JournalEntry{Op: model.JournalOpen, PID: os.Getpid()}); err != nil {
+		util.LogError("error recording journal owner: %s", err)
+		_ = jrnl.Close()
+		return nil
+	}
+	return jrnl
 }
 
-func closePortForward(fw kube.PortForwarder) {
+func closeJournal(jrnl *model.Journal) {
+	pending := len(jrnl.Pending())
+	if err := jrnl.Close(); err != nil {
+		util.LogError("error closing journal %s: %s", jrnl.Path(), err)
+	}
+	if pending != 0 {
+		util.LogError("%d change(s) could not be undone, run 'supplant restore %s' to retry", pending, jrnl.Path())
+	}
+}
+
+func closePortForward(fw *kube.PortForwarder) {
 	for _, p := range fw.Ports {
 		util.LogInfoListItem("closing port forward %s:%d", fw.Name, p.LocalPort)
 	}
-	fw.Forwarder.Close()
+	fw.Close()
 }
 
-// deleteSupplantedEndpoints deletes all supplants that we've created (either in this run or a previous run)
-func deleteSupplantedEndpoints(cs *kubernetes.Clientset) {
+// deleteSupplantedEndpoints deletes any endpoints or endpoint slices created by our session that weren't already cleaned up
+func deleteSupplantedEndpoints(ctx context.Context, cs *kubernetes.Clientset, sessionID string, useEndpointSlices bool) {
 	lo := metav1.ListOptions{
-		LabelSelector: "supplant=true",
+		LabelSelector: labels.SelectorFromSet(model.SessionLabels(sessionID)).String(),
 	}
-	ctx := context.Background()
 	eps, err := cs.CoreV1().Endpoints(metav1.NamespaceAll).List(ctx, lo)
 	if err != nil {
 		util.LogError("error listing endpoints: %s", err)
@@ -306,39 +765,77 @@ func deleteSupplantedEndpoints(cs *kubernetes.Clientset) {
 			}
 		}
 	}
+
+	if !useEndpointSlices {
+		return
+	}
+	slices, err := cs.DiscoveryV1().EndpointSlices(metav1.NamespaceAll).List(ctx, lo)
+	if err != nil {
+		util.LogError("error listing endpoint slices: %s", err)
+		return
+	}
+	for _, slice := range slices.Items {
+		err = cs.DiscoveryV1().EndpointSlices(slice.Namespace).Delete(ctx, slice.Name, metav1.DeleteOptions{})
+		if err != nil {
+			util.LogError("error deleting endpoint slice: %s", err)
+		}
+	}
 }
 
 // prepareServiceForCreation clears out some the properties on a service retrieved from K8s so we can use it
-// to recreate a new service.  We retain the cluster IPs to hopefully provide minimal disruption.
+// to recreate a new service.  We retain the cluster IPs and node ports to provide minimal disruption and
+// verify that they were kept with serviceDrift.
 func prepareServiceForCreation(svc *v1.Service) {
 	svc.ResourceVersion = ""
 	svc.UID = ""
 	svc.ObjectMeta.CreationTimestamp = metav1.Time{}
 }
 
-const flagExternalIP = "externalip"
 const flagLocalIP = "localip"
+const flagJournal = "journal"
+const flagTransport = "transport"
+const flagRelayImage = "relay-image"
+const flagTeardownTimeout = "teardown-timeout"
 
 func init() {
 	rootCmd.AddCommand(runCmd)
 
-	ip, err := getOutboundIP()
-	if err != nil {
-		ip = net.IP{}
-	}
-	runCmd.Flags().IP(flagExternalIP, ip, "IP address that services within the cluster will connect to")
+	addExternalIPFlags(runCmd)
 	runCmd.Flags().IP(flagLocalIP, net.IPv4(127, 0, 0, 1), "IP address that is used to listen")
+	runCmd.Flags().String(flagTransport, transportDirect, "How the cluster reaches supplanted services, either direct to the external IP or through a relay pod")
+	runCmd.Flags().String(flagRelayImage, defaultRelayImage(), "Image used for the relay pod with the relay transport")
+	runCmd.Flags().Duration(flagTeardownTimeout, 30*time.Second, "Maximum time to spend restoring the cluster when exiting")
+	runCmd.Flags().String(flagJournal, "", "Path of the journal used to undo changes, defaults to a new file in the user cache directory")
+	addHostsFlags(runCmd)
+	addDNSFlags(runCmd)
+	addSessionFileFlags(runCmd)
+	runCmd.Flags().String(flagProfile, "", "Name of the profile in the configuration that chooses which services are enabled")
 }
 
-func getOutboundIP() (net.IP, error) {
-	conn, err := net.Dial("udp", "8.8.8.8:80")
+// listenLocalTarget listens for connections to a supplanted port on ip and proxies them to its local
+// target, setting the local port to the port listened on.
+func listenLocalTarget(ip net.IP, port *model.SupplantPortConfig) (io.Closer, error) {
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(int(port.LocalPort)))
+	if model.NormalizeProtocol(port.Protocol) == v1.ProtocolUDP {
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+		}
+		port.LocalPort = int32(conn.LocalAddr().(*net.UDPAddr).Port)
+		go func(target string) {
+			_ = tunnel.ProxyDatagrams(conn, target)
+		}(port.LocalTarget)
+		return conn, nil
+	}
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
-		return net.IP{}, err
+		return nil, fmt.Errorf("error listening on %s: %w", addr, err)
 	}
-	defer conn.Close()
-
-	localAddr := conn.LocalAddr().(*net.UDPAddr)
-	return localAddr.IP, nil
+	port.LocalPort = int32(listener.Addr().(*net.TCPAddr).Port)
+	go func(target string) {
+		_ = util.Proxy(listener, target)
+	}(port.LocalTarget)
+	return listener, nil
 }
 
 func appendAnnotation(meta *metav1.ObjectMeta, key string, value string) {
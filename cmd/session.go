@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/utils/pointer"
+)
+
+// leaseDuration is how long a session is considered alive after its lease was last renewed
+const leaseDuration = 60 * time.Second
+
+// leaseRenewTimeout limits how long renewing the leases can take so that it finishes before the next renewal
+const leaseRenewTimeout = leaseDuration / 4
+
+// session tracks a single run of supplant.  It maintains a lease in every namespace
+// that it modifies so that other machines can tell whether the objects labeled with the
+// session are still in use.
+type session struct {
+	ID    string
+	Owner string
+
+	cs         *kubernetes.Clientset
+	mu         sync.Mutex
+	namespaces map[string]struct{}
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func newSession(cs *kubernetes.Clientset) *session {
+	s := &session{
+		ID:         model.NewSessionID(),
+		Owner:      model.Owner(),
+		cs:         cs,
+		namespaces: map[string]struct{}{},
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go s.renew()
+	return s
+}
+
+func sessionLeaseName(id string) string {
+	return fmt.Sprintf("supplant-%s", id)
+}
+
+// Labels returns the labels to apply to objects created by this session.
+func (s *session) Labels() map[string]string {
+	return model.SessionLabels(s.ID)
+}
+
+// EnsureLease creates the session lease in namespace if it doesn't already exist.
+func (s *session) EnsureLease(ctx context.Context, namespace string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.namespaces[namespace]; ok {
+		return nil
+	}
+	now := metav1.NowMicro()
+	lease := &coordinationv1.Lease{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      sessionLeaseName(s.ID),
+			Namespace: namespace,
+			Labels:    s.Labels(),
+		},
+		Spec: coordinationv1.LeaseSpec{
+			HolderIdentity:       pointer.String(s.Owner),
+			LeaseDurationSeconds: pointer.Int32(int32(leaseDuration.Seconds())),
+			AcquireTime:          &now,
+			RenewTime:            &now,
+		},
+	}
+	_, err := s.cs.CoordinationV1().Leases(namespace).Create(ctx, lease, metav1.CreateOptions{})
+	if err != nil && !errors.IsAlreadyExists(err) {
+		return err
+	}
+	s.namespaces[namespace] = struct{}{}
+	return nil
+}
+
+// renew periodically renews all of the session leases until the session is closed.
+func (s *session) renew() {
+	defer close(s.done)
+	ticker := time.NewTicker(leaseDuration / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+
+		// copy the namespaces so a slow API server doesn't block EnsureLease while we renew
+		s.mu.Lock()
+		namespaces := make([]string, 0, len(s.namespaces))
+		for ns := range s.namespaces {
+			namespaces = append(namespaces, ns)
+		}
+		s.mu.Unlock()
+
+		// give up before the next renewal is due, or as soon as the session is closed
+		ctx, cancel := context.WithTimeout(context.Background(), leaseRenewTimeout)
+		go func() {
+			select {
+			case <-s.stop:
+				cancel()
+			case <-ctx.Done():
+			}
+		}()
+		for _, ns := range namespaces {
+			s.renewLease(ctx, ns)
+		}
+		cancel()
+	}
+}
+
+// renewLease renews the session lease in a single namespace.
+func (s *session) renewLease(ctx context.Context, ns string) {
+	leases := s.cs.CoordinationV1().Leases(ns)
+	lease, err := leases.Get(ctx, sessionLeaseName(s.ID), metav1.GetOptions{})
+	if err != nil {
+		util.LogError("error renewing session lease in %s: %s", ns, err)
+		return
+	}
+	now := metav1.NowMicro()
+	lease.Spec.RenewTime = &now
+	if _, err = leases.Update(ctx, lease, metav1.UpdateOptions{}); err != nil {
+		util.LogError("error renewing session lease in %s: %s", ns, err)
+	}
+}
+
+// Close stops renewing and deletes the session leases.
+func (s *session) Close(ctx context.Context) {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for ns := range s.namespaces {
+		err := s.cs.CoordinationV1().Leases(ns).Delete(ctx, sessionLeaseName(s.ID), metav1.DeleteOptions{})
+		if err != nil && !errors.IsNotFound(err) {
+			util.LogError("error deleting session lease in %s: %s", ns, err)
+		}
+	}
+}
+
+// leaseExpired returns true if the lease hasn't been renewed within its duration.
+func leaseExpired(lease coordinationv1.Lease, now time.Time) bool {
+	if lease.Spec.RenewTime == nil {
+		return true
+	}
+	duration := leaseDuration
+	if lease.Spec.LeaseDurationSeconds != nil {
+		duration = time.Duration(*lease.Spec.LeaseDurationSeconds) * time.Second
+	}
+	return lease.Spec.RenewTime.Add(duration).Before(now)
+}
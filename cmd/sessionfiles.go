@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"bytes"
+	"os"
+	"sync"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+)
+
+const flagEnvFile = "env-file"
+const flagExportFile = "export-file"
+const flagJSONFile = "json-file"
+
+// addSessionFileFlags adds the flags for the files that describe a running session.
+func addSessionFileFlags(cmd *cobra.Command) {
+	cmd.Flags().String(flagEnvFile, "", "Write a .env file with the service environment variables once ready, deleted on exit")
+	cmd.Flags().String(flagExportFile, "", "Write a shell script exporting the service environment variables once ready, deleted on exit")
+	cmd.Flags().String(flagJSONFile, "", "Write a JSON file describing each forwarded and supplanted port once ready, deleted on exit")
+}
+
+// sessionFiles are the session files that have been written.  They are removed when cleaning up and when a
+// second signal forces us to exit, so they are guarded by a mutex.
+type sessionFiles struct {
+	mu    sync.Mutex
+	paths []string
+}
+
+// Write writes each of the session files that were requested.
+func (sf *sessionFiles) Write(cmd *cobra.Command, info *model.SessionInfo) {
+	for _, file := range []struct {
+		flag  string
+		write func(buf *bytes.Buffer) error
+	}{
+		{flagEnvFile, func(buf *bytes.Buffer) error { return info.WriteDotenv(buf) }},
+		{flagExportFile, func(buf *bytes.Buffer) error { return info.WriteShell(buf) }},
+		{flagJSONFile, func(buf *bytes.Buffer) error { return info.WriteJSON(buf) }},
+	} {
+		path, _ := cmd.Flags().GetString(file.flag)
+		if path == "" {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := file.write(&buf); err != nil {
+			util.LogError("error encoding %s: %s", path, err)
+			continue
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0600); err != nil {
+			util.LogError("error writing %s: %s", path, err)
+			continue
+		}
+		util.LogInfoListItem("wrote %s", path)
+		sf.mu.Lock()
+		sf.paths = append(sf.paths, path)
+		sf.mu.Unlock()
+	}
+}
+
+// Remove deletes the files that were written.
+func (sf *sessionFiles) Remove() {
+	sf.mu.Lock()
+	defer sf.mu.Unlock()
+	for _, path := range sf.paths {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			util.LogError("error removing %s: %s", path, err)
+		}
+	}
+	sf.paths = nil
+}
@@ -0,0 +1,153 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status [flags]",
+	Short: "status lists the services that are currently supplanted",
+	Long: `status finds the services and endpoints in the cluster that
+were created by supplant and lists where they point, when
+they were supplanted and by whom.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		output, _ := cmd.Flags().GetString(flagOutput)
+		if output != outputTable && output != outputJSON {
+			util.LogError("unsupported output format %s, must be one of %s or %s", output, outputTable, outputJSON)
+			return
+		}
+
+		f := cmdutil.NewFactory(kubeConfigFlags)
+		cs, err := f.KubernetesClientSet()
+		if err != nil {
+			util.LogError("error getting kubernetes client: %s", err)
+			return
+		}
+
+		ctx := context.Background()
+		svcList, err := cs.CoreV1().Services(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			util.LogError("error listing services: %s", err)
+			return
+		}
+		epList, err := cs.CoreV1().Endpoints(metav1.NamespaceAll).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			util.LogError("error listing endpoints: %s", err)
+			return
+		}
+
+		statuses := supplantStatuses(svcList.Items, epList.Items)
+		if output == outputJSON {
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			if err = enc.Encode(statuses); err != nil {
+				util.LogError("error encoding status: %s", err)
+			}
+			return
+		}
+
+		if len(statuses) == 0 {
+			util.LogInfo("no services are supplanted")
+			return
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAMESPACE\tSERVICE\tTARGETS\tSTARTED\tOWNER\tSESSION")
+		for _, st := range statuses {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", st.Namespace, st.Service,
+				strings.Join(st.Targets, ","), st.Started, st.Owner, st.Session)
+		}
+		tw.Flush()
+	},
+}
+
+type supplantStatus struct {
+	Namespace string   `json:"namespace"`
+	Service   string   `json:"service"`
+	Targets   []string `json:"targets"`
+	Started   string   `json:"started"`
+	Owner     string   `json:"owner"`
+	Session   string   `json:"session"`
+}
+
+// supplantStatuses constructs the status of every service or endpoint that is marked
+// as being created by supplant.
+func supplantStatuses(svcs []v1.Service, eps []v1.Endpoints) []supplantStatus {
+	type key struct {
+		namespace string
+		name      string
+	}
+	byKey := map[key]*supplantStatus{}
+	lookup := func(meta metav1.ObjectMeta) *supplantStatus {
+		k := key{meta.Namespace, meta.Name}
+		if st, ok := byKey[k]; ok {
+			return st
+		}
+		st := &supplantStatus{
+			Namespace: meta.Namespace,
+			Service:   meta.Name,
+			Targets:   []string{},
+			Started:   meta.Annotations[model.AnnotationStarted],
+			Owner:     meta.Annotations[model.AnnotationOwner],
+			Session:   meta.Labels[model.LabelSession],
+		}
+		byKey[k] = st
+		return st
+	}
+
+	for _, svc := range svcs {
+		if _, ok := svc.Annotations[model.AnnotationSupplanted]; ok {
+			lookup(svc.ObjectMeta)
+		}
+	}
+	for _, ep := range eps {
+		if _, ok := ep.Annotations[model.AnnotationSupplanted]; !ok {
+			continue
+		}
+		st := lookup(ep.ObjectMeta)
+		for _, subset := range ep.Subsets {
+			for _, addr := range subset.Addresses {
+				for _, port := range subset.Ports {
+					st.Targets = append(st.Targets, net.JoinHostPort(addr.IP, strconv.Itoa(int(port.Port))))
+				}
+			}
+		}
+	}
+
+	var ret []supplantStatus
+	for _, st := range byKey {
+		ret = append(ret, *st)
+	}
+	sort.Slice(ret, func(a, b int) bool {
+		if ret[a].Namespace != ret[b].Namespace {
+			return ret[a].Namespace < ret[b].Namespace
+		}
+		return ret[a].Service < ret[b].Service
+	})
+	return ret
+}
+
+const flagOutput = "output"
+const outputTable = "table"
+const outputJSON = "json"
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+	statusCmd.Flags().StringP(flagOutput, "o", outputTable, "Output format, either table or json")
+}
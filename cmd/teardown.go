@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+)
+
+// terminationSignals are the signals that cause us to clean up and exit
+var terminationSignals = []os.Signal{os.Interrupt, syscall.SIGTERM, syscall.SIGHUP}
+
+// newSignalContext returns a context that is cancelled when a termination signal is received.  If a
+// second signal is received before the returned stop function is called, onForce is called and the
+// process exits immediately.
+func newSignalContext(onForce func()) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, terminationSignals...)
+	done := make(chan struct{})
+
+	go func() {
+		select {
+		case sig := <-signals:
+			util.LogInfoHeader("received %s, cleaning up (send again to force exit)", sig)
+			cancel()
+		case <-done:
+			return
+		}
+
+		select {
+		case <-signals:
+			if onForce != nil {
+				onForce()
+			}
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(done)
+		cancel()
+	}
+}
+
+// reportUnrestored lists the changes in the journal that haven't been undone.
+func reportUnrestored(jrnl *model.Journal) {
+	pending := jrnl.Pending()
+	if len(pending) == 0 {
+		return
+	}
+	util.LogError("forced exit, the following changes were not undone:")
+	for _, e := range pending {
+		util.LogInfoListItem("%s %s/%s", e.Op, e.Namespace, e.Name)
+	}
+	util.LogError("run 'supplant restore %s' to undo them", jrnl.Path())
+}
+
+// cleanupStack holds functions that undo changes to the cluster.  They are run in reverse order, like
+// defers, but with a context that is independent of the one used for setup and that only starts its
+// timeout once teardown begins.
+type cleanupStack struct {
+	fns []func(ctx context.Context)
+}
+
+// Push adds a function to be run during teardown.
+func (c *cleanupStack) Push(fn func(ctx context.Context)) {
+	c.fns = append(c.fns, fn)
+}
+
+// Run calls the cleanup functions in reverse order, sharing a context that expires after timeout.
+func (c *cleanupStack) Run(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for i := len(c.fns) - 1; i >= 0; i-- {
+		c.fns[i](ctx)
+	}
+	c.fns = nil
+}
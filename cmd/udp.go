@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/tzneal/supplant/kube"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/tunnel"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// udpForward forwards local UDP ports to a service.  Port forwards only carry TCP, so the datagrams from
+// each local address are streamed through a port forward to a relay pod which sends them on to the
+// cluster IP of the service.
+type udpForward struct {
+	Namespace string
+	Name      string
+	// IP is the address that datagrams are received on
+	IP net.IP
+	// Ports are the forwarded ports in the order they were configured
+	Ports []model.EnvPort
+
+	fw    *kube.PortForwarder
+	conns []net.PacketConn
+}
+
+// startUDPForward starts a relay pod for the UDP ports of a service and listens for datagrams on localIP.
+func startUDPForward(ctx context.Context, f cmdutil.Factory, relays *relayPods, svc v1.Service, ports []model.ExternalPortConfig, localIP net.IP) (*udpForward, error) {
+	if svc.Spec.ClusterIP == "" || svc.Spec.ClusterIP == v1.ClusterIPNone {
+		return nil, fmt.Errorf("service %s has no cluster IP to send datagrams to", svc.Name)
+	}
+	var cfg tunnel.RelayConfig
+	var pc []kube.PortConfig
+	for i, port := range ports {
+		sp, ok := port.ServicePort(svc)
+		if !ok {
+			return nil, fmt.Errorf("service %s has no UDP port with target port %d", svc.Name, port.TargetPort)
+		}
+		cfg.UDPForwards = append(cfg.UDPForwards, net.JoinHostPort(svc.Spec.ClusterIP, strconv.Itoa(int(sp.Port))))
+		pc = append(pc, kube.PortConfig{TargetPort: relayUDPForwardPort + int32(i)})
+	}
+
+	pod, err := relays.Start(ctx, svc.Namespace, newRelayPod(udpRelayPodName(svc.Name, relays.sess.ID), relays.image, cfg))
+	if err != nil {
+		return nil, err
+	}
+	// only our own listeners connect to the forward
+	loopback := net.IPv4(127, 0, 0, 1)
+	fw, err := kube.PortForwardPod(ctx, f, pod.Namespace, pod.Name, loopback, pc)
+	if err != nil {
+		return nil, fmt.Errorf("error forwarding to relay pod %s: %w", pod.Name, err)
+	}
+	uf := &udpForward{Namespace: svc.Namespace, Name: svc.Name, IP: localIP, fw: fw}
+	select {
+	case <-fw.Ready:
+	case <-ctx.Done():
+		uf.Close()
+		return nil, ctx.Err()
+	}
+	fwPorts, err := fw.GetPorts()
+	if err != nil {
+		uf.Close()
+		return nil, err
+	}
+
+	for i, port := range ports {
+		addr := net.JoinHostPort(localIP.String(), strconv.Itoa(int(port.LocalPort)))
+		conn, err := net.ListenPacket("udp", addr)
+		if err != nil {
+			uf.Close()
+			return nil, fmt.Errorf("error listening on %s: %w", addr, err)
+		}
+		uf.conns = append(uf.conns, conn)
+		streamAddr := net.JoinHostPort(loopback.String(), strconv.Itoa(int(fwPorts[i].Local)))
+		go func() {
+			_ = tunnel.ServeDatagrams(conn, func() (net.Conn, error) { return net.Dial("tcp", streamAddr) })
+		}()
+		uf.Ports = append(uf.Ports, model.EnvPort{
+			Name:     port.Name,
+			Protocol: v1.ProtocolUDP,
+			Port:     port.TargetPort,
+			Local:    int32(conn.LocalAddr().(*net.UDPAddr).Port),
+		})
+	}
+	return uf, nil
+}
+
+// Close stops listening for datagrams and closes the forward to the relay pod, which is deleted by the cleanup stack.
+func (uf *udpForward) Close() {
+	for _, port := range uf.Ports {
+		util.LogInfoListItem("closing UDP forward %s:%d", uf.Name, port.Local)
+	}
+	for _, conn := range uf.conns {
+		conn.Close()
+	}
+	uf.fw.Close()
+}
+
+// splitUDPPorts separates the UDP ports of an external service, which are forwarded through a relay pod,
+// from the ports that are port forwarded.
+func splitUDPPorts(ports []model.ExternalPortConfig) (tcp []model.ExternalPortConfig, udp []model.ExternalPortConfig) {
+	for _, port := range ports {
+		if model.NormalizeProtocol(port.Protocol) == v1.ProtocolUDP {
+			udp = append(udp, port)
+		} else {
+			tcp = append(tcp, port)
+		}
+	}
+	return tcp, udp
+}
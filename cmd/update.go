@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"reflect"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	"gopkg.in/yaml.v3"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// updateCmd represents the update command
+var updateCmd = &cobra.Command{
+	Use:   "update [flags] config.yml",
+	Short: "update re-syncs a configuration file with the cluster",
+	Long: `update looks at the services in the cluster the same way that
+'create' does, using the filter saved in the configuration, and adds
+any new services and ports to an existing configuration file as
+disabled entries unless they match an enable pattern.  Entries that no longer
+exist in the cluster are marked with a comment, or removed with
+--prune.  Everything else in the file, including comments and
+which services are enabled, is left as it was.`,
+	Args: cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inputFile := args[0]
+		data, err := os.ReadFile(inputFile)
+		if err != nil {
+			util.LogError("error opening %s: %s", inputFile, err)
+			return
+		}
+		var doc yaml.Node
+		if err = yaml.Unmarshal(data, &doc); err != nil {
+			util.LogError("error decoding %s: %s", inputFile, err)
+			return
+		}
+		var cfg model.Config
+		if err = doc.Decode(&cfg); err != nil {
+			util.LogError("error decoding %s: %s", inputFile, err)
+			return
+		}
+		if extendsOthers(inputFile, cfg) {
+			exitCode = 1
+			return
+		}
+
+		// services are added using the filter saved by create, along with anything added on the command line
+		base := model.DefaultServiceFilter()
+		if cfg.Filter != nil {
+			base = *cfg.Filter
+		}
+		filter, err := serviceFilterFromFlags(cmd, base)
+		if err != nil {
+			util.LogError("%s", err)
+			return
+		}
+
+		f := cmdutil.NewFactory(kubeConfigFlags)
+		cs, err := f.KubernetesClientSet()
+		if err != nil {
+			util.LogError("error getting kubernetes client: %s", err)
+			return
+		}
+
+		ctx := context.Background()
+		svcs, err := listConfigServices(ctx, cs, filter.Namespaces)
+		if err != nil {
+			util.LogError("error listing services: %s", err)
+			return
+		}
+
+		// every listed service is used to decide what still exists, but only the ones that match the
+		// filter are added
+		prune, _ := cmd.Flags().GetBool(flagPrune)
+		pl := model.NewPortLookup(cs)
+		matched := map[string]bool{}
+		u := model.ConfigUpdate{Prune: prune}
+		for _, svc := range svcs {
+			matched[svc.Namespace+"/"+svc.Name] = filter.Matches(svc)
+			supplantSvc := model.MapSupplantService(pl, svc)
+			supplantSvc.Enabled = filter.EnableSupplant(svc)
+			u.Current.Supplant = append(u.Current.Supplant, supplantSvc)
+			externalSvc := model.MapExternalService(ctx, pl, svc)
+			externalSvc.Enabled = filter.EnableForward(svc)
+			u.Current.External = append(u.Current.External, externalSvc)
+		}
+		u.Add = func(namespace, name string) bool {
+			return matched[namespace+"/"+name]
+		}
+		u.InScope = filter.InNamespace
+
+		changes, err := model.UpdateConfig(&doc, u)
+		if err != nil {
+			util.LogError("error updating %s: %s", inputFile, err)
+			return
+		}
+		// a configuration from before filters were saved only gets one if the filter was asked for
+		if (cfg.Filter != nil && !reflect.DeepEqual(*cfg.Filter, filter)) || (cfg.Filter == nil && serviceFilterFlagsChanged(cmd)) {
+			if err = model.SetFilter(&doc, filter); err != nil {
+				util.LogError("error updating %s: %s", inputFile, err)
+				return
+			}
+			changes = append(changes, model.UpdateChange{Section: "filter", Action: "updated"})
+		}
+		if len(changes) == 0 {
+			util.LogInfo("%s is up to date", inputFile)
+			return
+		}
+		util.LogInfoHeader("updating %s", inputFile)
+		for _, c := range changes {
+			util.LogInfoListItem("%s", c)
+		}
+		writeConfigNode(&doc, inputFile)
+	},
+}
+
+// writeConfigNode writes a parsed configuration document, preserving its comments.
+func writeConfigNode(doc *yaml.Node, outputFile string) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		util.LogError("error encoding config: %s", err)
+		return
+	}
+	if err := enc.Close(); err != nil {
+		util.LogError("error encoding config: %s", err)
+		return
+	}
+	if err := os.WriteFile(outputFile, buf.Bytes(), 0644); err != nil {
+		util.LogError("error writing %s: %s", outputFile, err)
+	}
+}
+
+const flagPrune = "prune"
+
+func init() {
+	configCmd.AddCommand(updateCmd)
+	addServiceFilterFlags(updateCmd)
+	updateCmd.Flags().Bool(flagPrune, false, "Remove entries that no longer exist in the cluster instead of marking them")
+}
@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"context"
+
+	"github.com/spf13/cobra"
+	"github.com/tzneal/supplant/model"
+	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cmdutil "k8s.io/kubectl/pkg/cmd/util"
+)
+
+// validateCmd represents the validate command
+var validateCmd = &cobra.Command{
+	Use:   "validate [flags] config.yml",
+	Short: "validate checks a configuration file for problems",
+	Long: `validate checks a configuration file for unknown keys and
+duplicate local ports, then checks each enabled service against
+the cluster to ensure that it exists, has the configured ports and
+has a selector if it is to be supplanted.  The same checks are run
+by the 'run' command before it changes anything.`,
+	Args: cobra.ExactValidArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		inputFile := args[0]
+		transport, _ := cmd.Flags().GetString(flagTransport)
+		if transport != transportDirect && transport != transportRelay {
+			util.LogError("unsupported transport %s, must be one of %s or %s", transport, transportDirect, transportRelay)
+			exitCode = 1
+			return
+		}
+		cfg, pos := loadConfig(inputFile)
+		if cfg == nil || !applyProfile(cmd, cfg) {
+			exitCode = 1
+			return
+		}
+
+		var svcList *v1.ServiceList
+		if offline, _ := cmd.Flags().GetBool(flagOffline); !offline {
+			f := cmdutil.NewFactory(kubeConfigFlags)
+			cs, err := f.KubernetesClientSet()
+			if err != nil {
+				util.LogError("error getting kubernetes client: %s", err)
+				exitCode = 1
+				return
+			}
+			svcList, err = cs.CoreV1().Services(metav1.NamespaceAll).List(context.Background(), metav1.ListOptions{})
+			if err != nil {
+				util.LogError("error listing services: %s", err)
+				exitCode = 1
+				return
+			}
+		}
+
+		if !validateConfig(inputFile, cfg, pos, svcList, transport == transportRelay) {
+			exitCode = 1
+			return
+		}
+		util.LogInfo("%s is valid", inputFile)
+	},
+}
+
+// loadConfig strictly reads a configuration file along with any that it extends, reporting any unknown keys
+// or malformed values.
+func loadConfig(inputFile string) (*model.Config, *model.ConfigPositions) {
+	cfg, pos, err := model.LoadConfig(inputFile)
+	if err != nil {
+		util.LogError("error reading config: %s", err)
+		return nil, nil
+	}
+	return cfg, pos
+}
+
+// applyProfile enables the services of the profile chosen on the command line, returning false if the
+// profile can't be applied.
+func applyProfile(cmd *cobra.Command, cfg *model.Config) bool {
+	profile, _ := cmd.Flags().GetString(flagProfile)
+	if profile == "" {
+		return true
+	}
+	if err := cfg.ApplyProfile(profile); err != nil {
+		util.LogError("%s", err)
+		return false
+	}
+	util.LogInfoHeader("using profile %s", profile)
+	return true
+}
+
+// validateConfig reports any problems with the configuration, returning true if there were none.  If
+// svcList is nil, the configuration isn't checked against the cluster.
+func validateConfig(inputFile string, cfg *model.Config, pos *model.ConfigPositions, svcList *v1.ServiceList, relay bool) bool {
+	var svcs []v1.Service
+	if svcList != nil {
+		// an empty cluster still needs to be checked against
+		svcs = append([]v1.Service{}, svcList.Items...)
+	}
+	errs := model.ValidateConfig(cfg, pos, svcs, relay)
+	if len(errs) == 0 {
+		return true
+	}
+	util.LogError("%s is invalid:", inputFile)
+	for _, e := range errs {
+		// errors are reported against the file they were found in, which may be one that inputFile extends
+		at := e.Position
+		if at.File == "" {
+			at.File = inputFile
+		}
+		util.LogInfoListItem("%s: %s", at, e.Message)
+	}
+	return false
+}
+
+const flagOffline = "offline"
+const flagProfile = "profile"
+
+func init() {
+	configCmd.AddCommand(validateCmd)
+	validateCmd.Flags().String(flagProfile, "", "Name of the profile in the configuration to validate")
+	validateCmd.Flags().String(flagTransport, transportDirect, "Transport that 'run' will use, checking the local ports against those of the relay pod with relay")
+	validateCmd.Flags().Bool(flagOffline, false, "Only check the file itself, skipping the checks against the cluster")
+}
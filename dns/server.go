@@ -0,0 +1,331 @@
+// Package dns answers DNS queries for the names of services in the cluster with the local addresses that
+// the services are forwarded to, so that code using the names in the cluster works unchanged.  Names that
+// aren't services are passed to the system resolver.
+package dns
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// serviceTTL is short since the forwards only last as long as supplant is running
+	serviceTTL = 5
+	// upstreamTTL is used for the answers from the system resolver, which doesn't tell us the real TTL
+	upstreamTTL = 30
+	// upstreamTimeout limits how long we wait for the system resolver, which may be pointed back at us
+	upstreamTimeout = 5 * time.Second
+	// maxUDPSize is the largest response sent without EDNS, larger responses are truncated
+	maxUDPSize = 512
+)
+
+// Service is a service in the cluster that is forwarded to a local address.
+type Service struct {
+	Namespace string
+	Name      string
+	// IP is the local address that the service is forwarded to
+	IP    net.IP
+	Ports []Port
+}
+
+// Port is a forwarded port of a service.  Named ports are served as SRV records.
+type Port struct {
+	Name     string
+	Protocol string
+	// Port is the local port that the service port is forwarded to
+	Port uint16
+}
+
+// Server answers A, AAAA and SRV queries for <svc>, <svc>.<ns>, <svc>.<ns>.svc and
+// <svc>.<ns>.svc.<cluster domain> along with the _<port>._<proto> SRV names of the named ports.  Queries
+// of other types are answered without any records.
+type Server struct {
+	// ClusterDomain is the domain of the cluster, usually cluster.local
+	ClusterDomain string
+	// Namespace is the namespace that a name without one is looked up in first
+	Namespace string
+	// Resolver resolves the names that aren't services, net.DefaultResolver if nil
+	Resolver *net.Resolver
+
+	mu       sync.RWMutex
+	services []Service
+}
+
+// SetServices replaces the services that are answered for.
+func (s *Server) SetServices(services []Service) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.services = append([]Service(nil), services...)
+}
+
+// Serve answers the queries read from pc until it's closed.
+func (s *Server) Serve(pc net.PacketConn) error {
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		req := append([]byte(nil), buf[:n]...)
+		go func() {
+			if resp := s.Handle(req); resp != nil {
+				_, _ = pc.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+// Handle returns the response to a query, or nil if the query can't be parsed well enough to respond to.
+func (s *Server) Handle(req []byte) []byte {
+	var p dnsmessage.Parser
+	hdr, err := p.Start(req)
+	if err != nil {
+		return nil
+	}
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 hdr.ID,
+			Response:           true,
+			OpCode:             hdr.OpCode,
+			RecursionDesired:   hdr.RecursionDesired,
+			RecursionAvailable: true,
+		},
+	}
+	q, err := p.Question()
+	if err != nil || hdr.OpCode != 0 {
+		msg.RCode = dnsmessage.RCodeFormatError
+		if err == nil {
+			msg.RCode = dnsmessage.RCodeNotImplemented
+		}
+		return pack(msg)
+	}
+	msg.Questions = []dnsmessage.Question{q}
+
+	if q.Class != dnsmessage.ClassINET {
+		msg.RCode = dnsmessage.RCodeNotImplemented
+		return pack(msg)
+	}
+	name := strings.ToLower(strings.TrimSuffix(q.Name.String(), "."))
+	if ok := s.answerService(&msg, q, name); !ok {
+		s.answerUpstream(&msg, q, name)
+	}
+	return pack(msg)
+}
+
+func pack(msg dnsmessage.Message) []byte {
+	resp, err := msg.Pack()
+	if err != nil {
+		return nil
+	}
+	if len(resp) <= maxUDPSize {
+		return resp
+	}
+	// the client should retry over TCP, which we don't serve, but a truncated response is better than none
+	msg.Truncated = true
+	msg.Answers = nil
+	msg.Additionals = nil
+	resp, _ = msg.Pack()
+	return resp
+}
+
+// query is a parsed name of a service.
+type query struct {
+	namespace string
+	name      string
+	// port and protocol are set for the SRV name of a single port
+	port     string
+	protocol string
+}
+
+// parseName parses the name of a service.  inCluster is true if the name is under the cluster domain, so
+// that it can't be resolved by anything other than us.
+func (s *Server) parseName(name string) (q query, inCluster bool, ok bool) {
+	svcSuffix := ".svc"
+	if domain := strings.Trim(strings.ToLower(s.ClusterDomain), "."); domain != "" {
+		if strings.HasSuffix(name, ".svc."+domain) {
+			inCluster = true
+			svcSuffix = ".svc." + domain
+		}
+	}
+	qualified := strings.HasSuffix(name, svcSuffix)
+	name = strings.TrimSuffix(name, svcSuffix)
+
+	labels := strings.Split(name, ".")
+	if len(labels) >= 2 && strings.HasPrefix(labels[0], "_") && strings.HasPrefix(labels[1], "_") {
+		q.port = strings.TrimPrefix(labels[0], "_")
+		q.protocol = strings.TrimPrefix(labels[1], "_")
+		labels = labels[2:]
+	}
+	switch {
+	case len(labels) == 2:
+		q.name, q.namespace = labels[0], labels[1]
+	case len(labels) == 1 && !qualified:
+		q.name = labels[0]
+	default:
+		return query{}, inCluster, false
+	}
+	return q, inCluster, q.name != ""
+}
+
+// find returns the service for a query, preferring the default namespace for a name without one.
+func (s *Server) find(q query) (Service, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var matches []Service
+	for _, svc := range s.services {
+		if strings.ToLower(svc.Name) != q.name {
+			continue
+		}
+		if q.namespace != "" && strings.ToLower(svc.Namespace) != q.namespace {
+			continue
+		}
+		if q.namespace == "" && svc.Namespace == s.Namespace {
+			return svc, true
+		}
+		matches = append(matches, svc)
+	}
+	if len(matches) != 1 {
+		return Service{}, false
+	}
+	return matches[0], true
+}
+
+// answerService answers a query for a service, returning false if the name isn't one of ours.
+func (s *Server) answerService(msg *dnsmessage.Message, q dnsmessage.Question, name string) bool {
+	sq, inCluster, ok := s.parseName(name)
+	if !ok {
+		if inCluster {
+			msg.Authoritative = true
+			msg.RCode = dnsmessage.RCodeNameError
+		}
+		return inCluster
+	}
+	svc, ok := s.find(sq)
+	if !ok {
+		if inCluster {
+			msg.Authoritative = true
+			msg.RCode = dnsmessage.RCodeNameError
+		}
+		return inCluster
+	}
+	msg.Authoritative = true
+
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		if sq.port != "" {
+			return true
+		}
+		if rr, ok := addressResource(q.Name, q.Type, svc.IP, serviceTTL); ok {
+			msg.Answers = append(msg.Answers, rr)
+		}
+	case dnsmessage.TypeSRV:
+		target, err := dnsmessage.NewName(fmt.Sprintf("%s.%s.svc.%s.", svc.Name, svc.Namespace, strings.Trim(s.ClusterDomain, ".")))
+		if err != nil {
+			msg.RCode = dnsmessage.RCodeServerFailure
+			return true
+		}
+		for _, port := range svc.Ports {
+			if port.Name == "" {
+				continue
+			}
+			if sq.port != "" && (strings.ToLower(port.Name) != sq.port || strings.ToLower(port.Protocol) != sq.protocol) {
+				continue
+			}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: serviceTTL},
+				Body:   &dnsmessage.SRVResource{Priority: 0, Weight: 100, Port: port.Port, Target: target},
+			})
+		}
+		if len(msg.Answers) != 0 {
+			for _, typ := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+				if rr, ok := addressResource(target, typ, svc.IP, serviceTTL); ok {
+					msg.Additionals = append(msg.Additionals, rr)
+				}
+			}
+		}
+	}
+	return true
+}
+
+// addressResource returns an A or AAAA record for ip if it's of the family for the type.
+func addressResource(name dnsmessage.Name, typ dnsmessage.Type, ip net.IP, ttl uint32) (dnsmessage.Resource, bool) {
+	hdr := dnsmessage.ResourceHeader{Name: name, Type: typ, Class: dnsmessage.ClassINET, TTL: ttl}
+	if ip4 := ip.To4(); ip4 != nil {
+		if typ != dnsmessage.TypeA {
+			return dnsmessage.Resource{}, false
+		}
+		var a dnsmessage.AResource
+		copy(a.A[:], ip4)
+		return dnsmessage.Resource{Header: hdr, Body: &a}, true
+	}
+	if ip16 := ip.To16(); ip16 != nil && typ == dnsmessage.TypeAAAA {
+		var aaaa dnsmessage.AAAAResource
+		copy(aaaa.AAAA[:], ip16)
+		return dnsmessage.Resource{Header: hdr, Body: &aaaa}, true
+	}
+	return dnsmessage.Resource{}, false
+}
+
+// answerUpstream answers a query using the system resolver.
+func (s *Server) answerUpstream(msg *dnsmessage.Message, q dnsmessage.Question, name string) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), upstreamTimeout)
+	defer cancel()
+
+	var err error
+	switch q.Type {
+	case dnsmessage.TypeA, dnsmessage.TypeAAAA:
+		// look up both families so that a name with only one of them isn't reported as missing
+		var addrs []net.IPAddr
+		addrs, err = resolver.LookupIPAddr(ctx, name)
+		for _, addr := range addrs {
+			if rr, ok := addressResource(q.Name, q.Type, addr.IP, upstreamTTL); ok {
+				msg.Answers = append(msg.Answers, rr)
+			}
+		}
+	case dnsmessage.TypeSRV:
+		var srvs []*net.SRV
+		_, srvs, err = resolver.LookupSRV(ctx, "", "", name)
+		for _, srv := range srvs {
+			target, nerr := dnsmessage.NewName(dnsName(srv.Target))
+			if nerr != nil {
+				continue
+			}
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET, TTL: upstreamTTL},
+				Body:   &dnsmessage.SRVResource{Priority: srv.Priority, Weight: srv.Weight, Port: srv.Port, Target: target},
+			})
+		}
+	default:
+		// other types (e.g. HTTPS and SVCB) are answered without any records so that clients fall back to A and
+		// AAAA queries, rather than refusing them or claiming that the name doesn't exist
+		return
+	}
+
+	var dnsErr *net.DNSError
+	switch {
+	case err == nil:
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		msg.RCode = dnsmessage.RCodeNameError
+	default:
+		msg.RCode = dnsmessage.RCodeServerFailure
+	}
+}
+
+// dnsName returns a name with the trailing dot that dnsmessage requires.
+func dnsName(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+	return name + "."
+}
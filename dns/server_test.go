@@ -0,0 +1,272 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// typeHTTPS is the type of HTTPS queries, which dnsmessage doesn't have a constant for
+const typeHTTPS = dnsmessage.Type(65)
+
+func testServer() *Server {
+	s := &Server{ClusterDomain: "cluster.local", Namespace: "shop"}
+	s.SetServices([]Service{
+		{Namespace: "shop", Name: "web", IP: net.ParseIP("127.1.0.1"), Ports: []Port{{Name: "http", Protocol: "TCP", Port: 8080}, {Port: 8443}}},
+		{Namespace: "blog", Name: "web", IP: net.ParseIP("127.1.0.2")},
+		{Namespace: "blog", Name: "Admin", IP: net.ParseIP("::1")},
+		{Namespace: "data", Name: "db", IP: net.ParseIP("127.1.0.3")},
+		{Namespace: "cache", Name: "db", IP: net.ParseIP("127.1.0.4")},
+	})
+	return s
+}
+
+func TestParseName(t *testing.T) {
+	tests := []struct {
+		name          string
+		want          query
+		wantInCluster bool
+		wantOK        bool
+	}{
+		{"web", query{name: "web"}, false, true},
+		{"web.shop", query{namespace: "shop", name: "web"}, false, true},
+		{"web.shop.svc", query{namespace: "shop", name: "web"}, false, true},
+		{"web.shop.svc.cluster.local", query{namespace: "shop", name: "web"}, true, true},
+		{"_http._tcp.web.shop.svc.cluster.local", query{namespace: "shop", name: "web", port: "http", protocol: "tcp"}, true, true},
+		{"_http._tcp.web", query{name: "web", port: "http", protocol: "tcp"}, false, true},
+		{"web.svc", query{}, false, false},
+		{"www.example.com", query{}, false, false},
+		{"a.web.shop.svc.cluster.local", query{}, true, false},
+		{"web.shop.svc.example.com", query{}, false, false},
+	}
+	s := testServer()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, inCluster, ok := s.parseName(tc.name)
+			if got != tc.want || inCluster != tc.wantInCluster || ok != tc.wantOK {
+				t.Errorf("parseName(%q) = %+v, %v, %v, want %+v, %v, %v", tc.name, got, inCluster, ok, tc.want, tc.wantInCluster, tc.wantOK)
+			}
+		})
+	}
+
+	// the cluster domain may be given with a trailing dot
+	s.ClusterDomain = "cluster.local."
+	if _, inCluster, ok := s.parseName("web.shop.svc.cluster.local"); !inCluster || !ok {
+		t.Errorf("expected a name under a cluster domain with a trailing dot to be in the cluster")
+	}
+}
+
+func TestFind(t *testing.T) {
+	tests := []struct {
+		name      string
+		namespace string
+		q         query
+		want      string
+	}{
+		{"default namespace is preferred", "shop", query{name: "web"}, "127.1.0.1"},
+		{"default namespace is preferred when it comes later", "blog", query{name: "web"}, "127.1.0.2"},
+		{"unique short name", "shop", query{name: "admin"}, "::1"},
+		{"ambiguous short name", "shop", query{name: "db"}, ""},
+		{"ambiguous short name outside the default namespace", "other", query{name: "web"}, ""},
+		{"namespace", "shop", query{namespace: "cache", name: "db"}, "127.1.0.4"},
+		{"missing in the namespace", "shop", query{namespace: "shop", name: "db"}, ""},
+		{"missing", "shop", query{name: "api"}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := testServer()
+			s.Namespace = tc.namespace
+			svc, ok := s.find(tc.q)
+			var got string
+			if ok {
+				got = svc.IP.String()
+			}
+			if got != tc.want {
+				t.Errorf("find(%+v) = %q, want %q", tc.q, got, tc.want)
+			}
+		})
+	}
+}
+
+func request(t *testing.T, opCode dnsmessage.OpCode, name string, typ dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 42, OpCode: opCode, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  typ,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	req, err := msg.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+// records describes each of the records in a section of a response.
+func records(rrs []dnsmessage.Resource) []string {
+	var ret []string
+	for _, rr := range rrs {
+		switch body := rr.Body.(type) {
+		case *dnsmessage.AResource:
+			ret = append(ret, fmt.Sprintf("%s A %s", rr.Header.Name, net.IP(body.A[:])))
+		case *dnsmessage.AAAAResource:
+			ret = append(ret, fmt.Sprintf("%s AAAA %s", rr.Header.Name, net.IP(body.AAAA[:])))
+		case *dnsmessage.SRVResource:
+			ret = append(ret, fmt.Sprintf("%s SRV %d %s", rr.Header.Name, body.Port, body.Target))
+		default:
+			ret = append(ret, rr.Header.GoString())
+		}
+	}
+	return ret
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name              string
+		req               []byte
+		wantRCode         dnsmessage.RCode
+		wantAuthoritative bool
+		wantAnswers       []string
+		wantAdditionals   []string
+	}{
+		{
+			name:              "A",
+			req:               request(t, dnsmessage.OpCode(0), "web.shop.svc.cluster.local.", dnsmessage.TypeA),
+			wantAuthoritative: true,
+			wantAnswers:       []string{"web.shop.svc.cluster.local. A 127.1.0.1"},
+		},
+		{
+			name:              "short name is case insensitive",
+			req:               request(t, dnsmessage.OpCode(0), "WEB.", dnsmessage.TypeA),
+			wantAuthoritative: true,
+			wantAnswers:       []string{"WEB. A 127.1.0.1"},
+		},
+		{
+			name:              "AAAA",
+			req:               request(t, dnsmessage.OpCode(0), "admin.blog.", dnsmessage.TypeAAAA),
+			wantAuthoritative: true,
+			wantAnswers:       []string{"admin.blog. AAAA ::1"},
+		},
+		{
+			name:              "AAAA of an IPv4 service has no records",
+			req:               request(t, dnsmessage.OpCode(0), "web.shop.", dnsmessage.TypeAAAA),
+			wantAuthoritative: true,
+		},
+		{
+			name:              "SRV of every named port",
+			req:               request(t, dnsmessage.OpCode(0), "web.shop.svc.cluster.local.", dnsmessage.TypeSRV),
+			wantAuthoritative: true,
+			wantAnswers:       []string{"web.shop.svc.cluster.local. SRV 8080 web.shop.svc.cluster.local."},
+			wantAdditionals:   []string{"web.shop.svc.cluster.local. A 127.1.0.1"},
+		},
+		{
+			name:              "SRV of a port",
+			req:               request(t, dnsmessage.OpCode(0), "_http._tcp.web.shop.svc.cluster.local.", dnsmessage.TypeSRV),
+			wantAuthoritative: true,
+			wantAnswers:       []string{"_http._tcp.web.shop.svc.cluster.local. SRV 8080 web.shop.svc.cluster.local."},
+			wantAdditionals:   []string{"web.shop.svc.cluster.local. A 127.1.0.1"},
+		},
+		{
+			name:              "SRV of a missing port",
+			req:               request(t, dnsmessage.OpCode(0), "_http._udp.web.shop.svc.cluster.local.", dnsmessage.TypeSRV),
+			wantAuthoritative: true,
+		},
+		{
+			name:              "unknown service under the cluster domain",
+			req:               request(t, dnsmessage.OpCode(0), "api.shop.svc.cluster.local.", dnsmessage.TypeA),
+			wantRCode:         dnsmessage.RCodeNameError,
+			wantAuthoritative: true,
+		},
+		{
+			name:              "name under the cluster domain that isn't a service",
+			req:               request(t, dnsmessage.OpCode(0), "a.b.c.svc.cluster.local.", dnsmessage.TypeA),
+			wantRCode:         dnsmessage.RCodeNameError,
+			wantAuthoritative: true,
+		},
+		{
+			name:              "HTTPS of a service",
+			req:               request(t, dnsmessage.OpCode(0), "web.shop.svc.cluster.local.", typeHTTPS),
+			wantAuthoritative: true,
+		},
+		{
+			name: "HTTPS of another name",
+			req:  request(t, dnsmessage.OpCode(0), "www.example.com.", typeHTTPS),
+		},
+		{
+			name:      "unsupported opcode",
+			req:       request(t, dnsmessage.OpCode(2), "web.shop.svc.cluster.local.", dnsmessage.TypeA),
+			wantRCode: dnsmessage.RCodeNotImplemented,
+		},
+	}
+	s := testServer()
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var resp dnsmessage.Message
+			if err := resp.Unpack(s.Handle(tc.req)); err != nil {
+				t.Fatalf("error unpacking the response: %s", err)
+			}
+			if resp.ID != 42 || !resp.Response || !resp.RecursionDesired {
+				t.Errorf("unexpected header %+v", resp.Header)
+			}
+			if resp.RCode != tc.wantRCode || resp.Authoritative != tc.wantAuthoritative {
+				t.Errorf("got rcode %s and authoritative %v, want %s and %v", resp.RCode, resp.Authoritative, tc.wantRCode, tc.wantAuthoritative)
+			}
+			if got := records(resp.Answers); !reflect.DeepEqual(got, tc.wantAnswers) {
+				t.Errorf("got answers %q, want %q", got, tc.wantAnswers)
+			}
+			if got := records(resp.Additionals); !reflect.DeepEqual(got, tc.wantAdditionals) {
+				t.Errorf("got additionals %q, want %q", got, tc.wantAdditionals)
+			}
+		})
+	}
+
+	if resp := s.Handle([]byte{1, 2, 3}); resp != nil {
+		t.Errorf("expected no response to a short message, got %v", resp)
+	}
+}
+
+func TestPack(t *testing.T) {
+	name := dnsmessage.MustNewName("web.shop.svc.cluster.local.")
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: 42, Response: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET}},
+	}
+	for i := 0; i < 50; i++ {
+		rr, _ := addressResource(name, dnsmessage.TypeA, net.IPv4(127, 1, 0, byte(i)), serviceTTL)
+		msg.Answers = append(msg.Answers, rr)
+	}
+
+	tests := []struct {
+		name          string
+		answers       int
+		wantTruncated bool
+		wantAnswers   int
+	}{
+		{"fits", 10, false, 10},
+		{"too large", 50, true, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			m := msg
+			m.Answers = msg.Answers[:tc.answers]
+			data := pack(m)
+			if len(data) > maxUDPSize {
+				t.Errorf("expected at most %d bytes, got %d", maxUDPSize, len(data))
+			}
+			var resp dnsmessage.Message
+			if err := resp.Unpack(data); err != nil {
+				t.Fatalf("error unpacking the response: %s", err)
+			}
+			if resp.Truncated != tc.wantTruncated || len(resp.Answers) != tc.wantAnswers || len(resp.Questions) != 1 {
+				t.Errorf("got truncated %v with %d answers and %d questions, want %v with %d answers", resp.Truncated,
+					len(resp.Answers), len(resp.Questions), tc.wantTruncated, tc.wantAnswers)
+			}
+		})
+	}
+}
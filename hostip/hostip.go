@@ -0,0 +1,223 @@
+// Package hostip finds the addresses of this machine that services in the cluster may be able to connect to.
+package hostip
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+)
+
+// virtualPrefixes are the prefixes of the names of interfaces that are usually container bridges, virtual
+// machine networks or VPN tunnels, none of which the cluster is likely to reach us on
+var virtualPrefixes = []string{
+	"docker", "br-", "veth", "virbr", "vnet", "vmnet", "vboxnet", "cni", "flannel", "cali", "weave", "kube",
+	"lxc", "lxd", "podman", "bridge", "tun", "tap", "utun", "wg", "tailscale", "zt", "ppp", "ipsec", "gif",
+	"stf", "awdl", "llw", "anpi",
+}
+
+// Candidate is an address of this machine.
+type Candidate struct {
+	Interface string
+	IP        net.IP
+	// Network is the network of the address on its interface
+	Network *net.IPNet
+	// Virtual is true if the interface looks like a container bridge, virtual machine network or VPN tunnel
+	Virtual bool
+	// Default is true if the address is the source of connections to the internet
+	Default bool
+	// Near is true if the cluster's nodes or pods are on the network of the address or are routed through it
+	Near bool
+}
+
+// String returns the address along with its interface.
+func (c Candidate) String() string {
+	var notes []string
+	if c.Near {
+		notes = append(notes, "near the cluster")
+	}
+	if c.Default {
+		notes = append(notes, "default route")
+	}
+	if c.Virtual {
+		notes = append(notes, "virtual")
+	}
+	if len(notes) == 0 {
+		return fmt.Sprintf("%s on %s", c.IP, c.Interface)
+	}
+	return fmt.Sprintf("%s on %s (%s)", c.IP, c.Interface, strings.Join(notes, ", "))
+}
+
+// IsIPv6 returns true if the candidate is an IPv6 address.
+func (c Candidate) IsIPv6() bool {
+	return c.IP.To4() == nil
+}
+
+// Candidates returns the addresses of the interfaces that are up, or of the named interface if iface isn't
+// empty, ranked from the most to the least likely to be reachable.  Loopback and link-local addresses are
+// skipped unless they belong to the named interface.
+func Candidates(iface string) ([]Candidate, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("error listing network interfaces: %w", err)
+	}
+	defaults := defaultRouteIPs()
+
+	found := false
+	var cands []Candidate
+	for _, i := range ifaces {
+		if iface != "" && i.Name != iface {
+			continue
+		}
+		found = true
+		if i.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if i.Flags&net.FlagLoopback != 0 && iface == "" {
+			continue
+		}
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("error listing addresses of %s: %w", i.Name, err)
+		}
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || !usable(ipNet.IP, iface != "") {
+				continue
+			}
+			c := Candidate{
+				Interface: i.Name,
+				IP:        ipNet.IP,
+				Network:   &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask},
+				Virtual:   isVirtual(i),
+			}
+			for _, ip := range defaults {
+				c.Default = c.Default || ip.Equal(c.IP)
+			}
+			cands = append(cands, c)
+		}
+	}
+	if iface != "" && !found {
+		return nil, fmt.Errorf("there is no network interface named %s", iface)
+	}
+	Rank(cands)
+	return cands, nil
+}
+
+// MarkNear marks the candidates whose network holds one of the nodes or overlaps the pod network, or that
+// the machine uses to reach the nodes or pods over a route of its own, and ranks them before the others.  A
+// cluster running in containers or virtual machines on this machine is usually only reachable from the
+// address of a virtual interface, which would otherwise be ranked last.
+func MarkNear(cands []Candidate, nodeIPs []net.IP, podCIDRs []*net.IPNet) {
+	targets := append([]net.IP{}, nodeIPs...)
+	for _, cidr := range podCIDRs {
+		targets = append(targets, cidr.IP)
+	}
+	sources := make([]net.IP, len(targets))
+	for i, target := range targets {
+		sources[i] = routeSource(target)
+	}
+
+	for i := range cands {
+		c := &cands[i]
+		for _, ip := range nodeIPs {
+			c.Near = c.Near || c.Network.Contains(ip)
+		}
+		for _, cidr := range podCIDRs {
+			c.Near = c.Near || c.Network.Contains(cidr.IP) || cidr.Contains(c.IP)
+		}
+		// the default route reaches everything, so it only tells us something if it's another route
+		for _, src := range sources {
+			c.Near = c.Near || (!c.Default && src != nil && src.Equal(c.IP))
+		}
+	}
+	Rank(cands)
+}
+
+// Rank sorts candidates so that the addresses near the cluster come first, followed by the address with
+// the default route, and the addresses of virtual interfaces come last, otherwise keeping the order of the
+// interfaces.
+func Rank(cands []Candidate) {
+	score := func(c Candidate) int {
+		s := 0
+		if c.Near {
+			s += 4
+		}
+		if !c.Virtual {
+			s += 2
+		}
+		if c.Default {
+			s++
+		}
+		return s
+	}
+	sort.SliceStable(cands, func(a, b int) bool {
+		return score(cands[a]) > score(cands[b])
+	})
+}
+
+// Pick returns the best ranked candidate of each address family, starting with the family of the best
+// candidate, so that dual-stack services can be reached over either family.
+func Pick(cands []Candidate) []Candidate {
+	var picked []Candidate
+	var haveIPv4, haveIPv6 bool
+	for _, c := range cands {
+		if c.IsIPv6() && !haveIPv6 {
+			haveIPv6 = true
+			picked = append(picked, c)
+		} else if !c.IsIPv6() && !haveIPv4 {
+			haveIPv4 = true
+			picked = append(picked, c)
+		}
+	}
+	return picked
+}
+
+// usable returns true if the cluster could connect to ip.  Loopback and link-local addresses are only used
+// if the user asked for their interface.
+func usable(ip net.IP, named bool) bool {
+	// endpoints can't hold the zone that an IPv6 link-local address needs
+	if ip.IsUnspecified() || ip.IsMulticast() || (ip.To4() == nil && ip.IsLinkLocalUnicast()) {
+		return false
+	}
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+		return named
+	}
+	return true
+}
+
+func isVirtual(i net.Interface) bool {
+	if i.Flags&net.FlagPointToPoint != 0 {
+		return true
+	}
+	name := strings.ToLower(i.Name)
+	for _, prefix := range virtualPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultRouteIPs returns the source addresses the machine uses to reach the internet, which works without
+// access to the internet as long as there is a route.
+func defaultRouteIPs() []net.IP {
+	var ips []net.IP
+	for _, ip := range []net.IP{net.IPv4(8, 8, 8, 8), net.ParseIP("2001:4860:4860::8888")} {
+		if src := routeSource(ip); src != nil {
+			ips = append(ips, src)
+		}
+	}
+	return ips
+}
+
+// routeSource returns the source address that the machine uses to reach ip, or nil if there is no route.
+// Connecting a UDP socket doesn't send anything.
+func routeSource(ip net.IP) net.IP {
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 80})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
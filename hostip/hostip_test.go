@@ -0,0 +1,215 @@
+package hostip
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// candidate returns a candidate for an address in CIDR notation.
+func candidate(t *testing.T, iface string, cidr string, virtual, isDefault bool) Candidate {
+	t.Helper()
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Candidate{Interface: iface, IP: ip, Network: network, Virtual: virtual, Default: isDefault}
+}
+
+func ips(cands []Candidate) []string {
+	var ret []string
+	for _, c := range cands {
+		ret = append(ret, c.IP.String())
+	}
+	return ret
+}
+
+func TestRank(t *testing.T) {
+	tests := []struct {
+		name  string
+		cands []Candidate
+		near  []int
+		want  []string
+	}{
+		{
+			name: "interface order is kept",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, false),
+				candidate(t, "eth1", "198.51.100.10/24", false, false),
+			},
+			want: []string{"192.0.2.10", "198.51.100.10"},
+		},
+		{
+			name: "default route first",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, false),
+				candidate(t, "wlan0", "198.51.100.10/24", false, true),
+			},
+			want: []string{"198.51.100.10", "192.0.2.10"},
+		},
+		{
+			name: "virtual last even with the default route",
+			cands: []Candidate{
+				candidate(t, "tailscale0", "100.64.0.1/32", true, true),
+				candidate(t, "docker0", "172.17.0.1/16", true, false),
+				candidate(t, "eth0", "192.0.2.10/24", false, false),
+			},
+			want: []string{"192.0.2.10", "100.64.0.1", "172.17.0.1"},
+		},
+		{
+			name: "near the cluster first even if virtual",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, true),
+				candidate(t, "br-1234", "172.18.0.1/16", true, false),
+			},
+			near: []int{1},
+			want: []string{"172.18.0.1", "192.0.2.10"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, i := range tc.near {
+				tc.cands[i].Near = true
+			}
+			Rank(tc.cands)
+			if got := ips(tc.cands); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Rank() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMarkNear(t *testing.T) {
+	_, podCIDR, _ := net.ParseCIDR("10.244.0.0/16")
+	tests := []struct {
+		name     string
+		cands    []Candidate
+		nodeIPs  []net.IP
+		podCIDRs []*net.IPNet
+		want     []string
+		wantNear []bool
+	}{
+		{
+			name: "node on the network of a virtual interface",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, true),
+				candidate(t, "br-1234", "172.18.0.1/16", true, false),
+			},
+			nodeIPs:  []net.IP{net.ParseIP("172.18.0.2")},
+			want:     []string{"172.18.0.1", "192.0.2.10"},
+			wantNear: []bool{true, false},
+		},
+		{
+			name: "pod network overlapping an interface",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, true),
+				candidate(t, "cni0", "10.244.0.1/24", true, false),
+			},
+			podCIDRs: []*net.IPNet{podCIDR},
+			want:     []string{"10.244.0.1", "192.0.2.10"},
+			wantNear: []bool{true, false},
+		},
+		{
+			name: "nothing near keeps the ranking",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, true),
+				candidate(t, "docker0", "172.17.0.1/16", true, false),
+			},
+			nodeIPs:  []net.IP{net.ParseIP("203.0.113.5")},
+			want:     []string{"192.0.2.10", "172.17.0.1"},
+			wantNear: []bool{false, false},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			MarkNear(tc.cands, tc.nodeIPs, tc.podCIDRs)
+			if got := ips(tc.cands); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("MarkNear() ranked %v, want %v", got, tc.want)
+			}
+			var near []bool
+			for _, c := range tc.cands {
+				near = append(near, c.Near)
+			}
+			if !reflect.DeepEqual(near, tc.wantNear) {
+				t.Errorf("MarkNear() marked %v, want %v", near, tc.wantNear)
+			}
+		})
+	}
+}
+
+func TestPick(t *testing.T) {
+	tests := []struct {
+		name  string
+		cands []Candidate
+		want  []string
+	}{
+		{"none", nil, nil},
+		{
+			name: "best of each family, starting with the best",
+			cands: []Candidate{
+				candidate(t, "eth0", "2001:db8::10/64", false, true),
+				candidate(t, "eth0", "192.0.2.10/24", false, true),
+				candidate(t, "eth1", "2001:db8:1::10/64", false, false),
+				candidate(t, "eth1", "198.51.100.10/24", false, false),
+			},
+			want: []string{"2001:db8::10", "192.0.2.10"},
+		},
+		{
+			name: "single family",
+			cands: []Candidate{
+				candidate(t, "eth0", "192.0.2.10/24", false, true),
+				candidate(t, "eth1", "198.51.100.10/24", false, false),
+			},
+			want: []string{"192.0.2.10"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := ips(Pick(tc.cands)); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("Pick() = %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestUsable(t *testing.T) {
+	tests := []struct {
+		ip    string
+		named bool
+		want  bool
+	}{
+		{"192.0.2.10", false, true},
+		{"2001:db8::10", false, true},
+		{"0.0.0.0", true, false},
+		{"224.0.0.1", true, false},
+		{"fe80::1", true, false},
+		{"127.0.0.1", false, false},
+		{"127.0.0.1", true, true},
+		{"169.254.1.1", false, false},
+		{"169.254.1.1", true, true},
+	}
+	for _, tc := range tests {
+		if got := usable(net.ParseIP(tc.ip), tc.named); got != tc.want {
+			t.Errorf("usable(%s, %v) = %v, want %v", tc.ip, tc.named, got, tc.want)
+		}
+	}
+}
+
+func TestIsVirtual(t *testing.T) {
+	tests := []struct {
+		iface net.Interface
+		want  bool
+	}{
+		{net.Interface{Name: "eth0"}, false},
+		{net.Interface{Name: "en0"}, false},
+		{net.Interface{Name: "Docker0"}, true},
+		{net.Interface{Name: "veth1a2b"}, true},
+		{net.Interface{Name: "utun3"}, true},
+		{net.Interface{Name: "corp0", Flags: net.FlagPointToPoint}, true},
+	}
+	for _, tc := range tests {
+		if got := isVirtual(tc.iface); got != tc.want {
+			t.Errorf("isVirtual(%s) = %v, want %v", tc.iface.Name, got, tc.want)
+		}
+	}
+}
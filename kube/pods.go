@@ -0,0 +1,119 @@
+package kube
+
+import (
+	"sort"
+	"sync"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// podTracker watches the endpoints of a service to track which pods are ready.
+type podTracker struct {
+	mu      sync.Mutex
+	synced  bool
+	ready   map[string]struct{}
+	changed chan struct{}
+}
+
+func newPodTracker(cs *kubernetes.Clientset, namespace, svcName string, stop <-chan struct{}) *podTracker {
+	pt := &podTracker{
+		ready:   map[string]struct{}{},
+		changed: make(chan struct{}),
+	}
+	lw := cache.NewListWatchFromClient(cs.CoreV1().RESTClient(), "endpoints", namespace,
+		fields.OneTermEqualSelector("metadata.name", svcName))
+	update := func(obj interface{}) {
+		if ep, ok := obj.(*v1.Endpoints); ok {
+			pt.update(ep)
+		}
+	}
+	_, controller := cache.NewInformer(lw, &v1.Endpoints{}, 0, cache.ResourceEventHandlerFuncs{
+		AddFunc:    update,
+		UpdateFunc: func(_, obj interface{}) { update(obj) },
+		DeleteFunc: func(interface{}) { pt.update(&v1.Endpoints{}) },
+	})
+	go controller.Run(stop)
+	return pt
+}
+
+func (pt *podTracker) update(ep *v1.Endpoints) {
+	ready := map[string]struct{}{}
+	for _, subset := range ep.Subsets {
+		for _, addr := range subset.Addresses {
+			if addr.TargetRef != nil && addr.TargetRef.Kind == "Pod" {
+				ready[addr.TargetRef.Name] = struct{}{}
+			}
+		}
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	pt.synced = true
+	pt.ready = ready
+	close(pt.changed)
+	pt.changed = make(chan struct{})
+}
+
+// Ready returns the names of the ready pods in sorted order along with a channel that is
+// closed the next time the set of ready pods changes.
+func (pt *podTracker) Ready() ([]string, <-chan struct{}) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	var names []string
+	for name := range pt.ready {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, pt.changed
+}
+
+// Pick returns a ready pod, preferring one other than the previous pod.  It returns
+// an empty string if there are no ready pods.
+func (pt *podTracker) Pick(previous string) string {
+	// forwards to a specific pod don't track the pods of a service
+	if pt == nil {
+		return previous
+	}
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+	for name := range pt.ready {
+		if name != previous {
+			return name
+		}
+	}
+	if _, ok := pt.ready[previous]; ok {
+		return previous
+	}
+	return ""
+}
+
+// WaitGone returns a channel that is closed once the named pod is no longer ready.  The
+// wait is abandoned when cancel is closed.
+func (pt *podTracker) WaitGone(podName string, cancel <-chan struct{}) <-chan struct{} {
+	if pt == nil {
+		return nil
+	}
+	gone := make(chan struct{})
+	go func() {
+		for {
+			pt.mu.Lock()
+			_, ok := pt.ready[podName]
+			synced := pt.synced
+			changed := pt.changed
+			pt.mu.Unlock()
+			// until we've seen the endpoints we don't know if the pod is ready or not
+			if synced && !ok {
+				close(gone)
+				return
+			}
+			select {
+			case <-changed:
+			case <-cancel:
+				return
+			}
+		}
+	}()
+	return gone
+}
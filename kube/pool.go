@@ -0,0 +1,305 @@
+package kube
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tzneal/supplant/util"
+	"k8s.io/client-go/tools/portforward"
+)
+
+// ForwardMode determines how local connections are distributed across the pods of a service.
+type ForwardMode string
+
+const (
+	// ForwardSingle forwards all connections to a single pod.
+	ForwardSingle ForwardMode = "single"
+	// ForwardRoundRobin spreads connections across every ready pod in turn.
+	ForwardRoundRobin ForwardMode = "round-robin"
+	// ForwardLeastConnections sends each connection to the ready pod with the fewest active connections.
+	ForwardLeastConnections ForwardMode = "least-connections"
+)
+
+// poolResyncInterval is how often the pool retries pods whose forwards have failed
+const poolResyncInterval = 5 * time.Second
+
+// ParseForwardMode converts a forwarding mode from a configuration file, defaulting to ForwardSingle.
+func ParseForwardMode(mode string) (ForwardMode, error) {
+	switch ForwardMode(mode) {
+	case "", ForwardSingle:
+		return ForwardSingle, nil
+	case ForwardRoundRobin, ForwardLeastConnections:
+		return ForwardMode(mode), nil
+	}
+	return "", fmt.Errorf("unknown forwarding mode %q, must be one of %s, %s or %s", mode,
+		ForwardSingle, ForwardRoundRobin, ForwardLeastConnections)
+}
+
+// forwardPool maintains a port forward to every ready pod of a service and proxies connections
+// on the local ports across them.
+type forwardPool struct {
+	p         *PortForwarder
+	mode      ForwardMode
+	listeners []net.Listener
+
+	mu       sync.Mutex
+	backends map[string]*poolBackend
+	next     int
+	died     chan struct{}
+}
+
+// poolBackend is a forward to a single pod on randomly chosen loopback ports.
+type poolBackend struct {
+	pod     string
+	attempt *forwardAttempt
+	// ports is the loopback port that each of the forwarder's ports is forwarded on
+	ports  []uint16
+	active int64
+	errCh  chan error
+}
+
+// newForwardPool listens on the local ports so that any errors are reported immediately.
+func newForwardPool(p *PortForwarder, mode ForwardMode) (*forwardPool, error) {
+	pool := &forwardPool{
+		p:        p,
+		mode:     mode,
+		backends: map[string]*poolBackend{},
+		died:     make(chan struct{}, 1),
+	}
+	for i := range p.Ports {
+		port := &p.Ports[i]
+		addr := net.JoinHostPort(p.localIP.String(), strconv.Itoa(int(port.LocalPort)))
+		l, err := net.Listen("tcp", addr)
+		if err != nil {
+			pool.closeListeners()
+			return nil, fmt.Errorf("unable to listen on %s: %w", addr, err)
+		}
+		port.LocalPort = int32(l.Addr().(*net.TCPAddr).Port)
+		pool.listeners = append(pool.listeners, l)
+	}
+	return pool, nil
+}
+
+func (fp *forwardPool) closeListeners() {
+	for _, l := range fp.listeners {
+		l.Close()
+	}
+}
+
+// GetPorts returns the local ports and the target ports they are forwarded to.
+func (fp *forwardPool) GetPorts() ([]portforward.ForwardedPort, error) {
+	fp.p.mu.Lock()
+	defer fp.p.mu.Unlock()
+	var ret []portforward.ForwardedPort
+	for _, port := range fp.p.Ports {
+		ret = append(ret, portforward.ForwardedPort{Local: uint16(port.LocalPort), Remote: uint16(port.TargetPort)})
+	}
+	return ret, nil
+}
+
+// run accepts connections and keeps the set of backends in sync with the ready pods until stopped.
+func (fp *forwardPool) run() {
+	defer close(fp.p.done)
+	for i, l := range fp.listeners {
+		go fp.accept(l, i)
+	}
+
+	ticker := time.NewTicker(poolResyncInterval)
+	defer ticker.Stop()
+	for {
+		pods, changed := fp.p.pods.Ready()
+		fp.sync(pods)
+		select {
+		case <-fp.p.stop:
+			fp.closeListeners()
+			fp.mu.Lock()
+			for name, be := range fp.backends {
+				fp.closeBackend(name, be)
+			}
+			fp.mu.Unlock()
+			return
+		case <-changed:
+		case <-fp.died:
+		case <-ticker.C:
+		}
+	}
+}
+
+// sync adds backends for new pods and removes those for pods that are no longer ready.
+func (fp *forwardPool) sync(pods []string) {
+	ready := map[string]bool{}
+	for _, pod := range pods {
+		ready[pod] = true
+	}
+
+	fp.mu.Lock()
+	for name, be := range fp.backends {
+		select {
+		case <-be.errCh:
+			util.LogError("lost connection to pod %s for %s", name, fp.p.Name)
+			delete(fp.backends, name)
+			continue
+		default:
+		}
+		if !ready[name] {
+			util.LogInfoListItem("removing pod %s from the pool for %s", name, fp.p.Name)
+			fp.closeBackend(name, be)
+		}
+	}
+	var missing []string
+	for _, pod := range pods {
+		if _, ok := fp.backends[pod]; !ok {
+			missing = append(missing, pod)
+		}
+	}
+	fp.mu.Unlock()
+
+	for _, pod := range missing {
+		be, err := fp.newBackend(pod)
+		if err != nil {
+			util.LogError("error forwarding to pod %s for %s: %s", pod, fp.p.Name, err)
+			continue
+		}
+		util.LogInfoListItem("added pod %s to the pool for %s", pod, fp.p.Name)
+		fp.mu.Lock()
+		fp.backends[pod] = be
+		fp.mu.Unlock()
+		fp.p.markReady()
+	}
+}
+
+// closeBackend stops the forward to a pod, the lock must be held
+func (fp *forwardPool) closeBackend(name string, be *poolBackend) {
+	close(be.attempt.stop)
+	delete(fp.backends, name)
+}
+
+func (fp *forwardPool) newBackend(pod string) (*poolBackend, error) {
+	// each pod may have its own numbers for named ports
+	ctx, cancel := fp.p.stopContext()
+	targets, err := fp.p.resolvePorts(ctx, pod)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	var portList []string
+	for _, target := range targets {
+		portList = append(portList, fmt.Sprintf("0:%d", target))
+	}
+	attempt, err := fp.p.dialPod(pod, "127.0.0.1", portList)
+	if err != nil {
+		return nil, err
+	}
+
+	be := &poolBackend{
+		pod:     pod,
+		attempt: attempt,
+		errCh:   make(chan error, 1),
+	}
+	go func() {
+		be.errCh <- attempt.pf.ForwardPorts()
+		// wake up the pool so it can replace us
+		select {
+		case fp.died <- struct{}{}:
+		default:
+		}
+	}()
+
+	select {
+	case <-attempt.ready:
+	case err = <-be.errCh:
+		if err == nil {
+			err = fmt.Errorf("forward closed before it was ready")
+		}
+		return nil, err
+	}
+
+	fwPorts, err := attempt.pf.GetPorts()
+	if err != nil {
+		close(attempt.stop)
+		return nil, err
+	}
+	// the forwarded ports are in the same order as the ports that were requested
+	for _, port := range fwPorts {
+		be.ports = append(be.ports, port.Local)
+	}
+	return be, nil
+}
+
+// pick chooses the backend for a new connection according to the forwarding mode.
+func (fp *forwardPool) pick() *poolBackend {
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if len(fp.backends) == 0 {
+		return nil
+	}
+	pods, _ := fp.p.pods.Ready()
+	var candidates []*poolBackend
+	for _, pod := range pods {
+		if be, ok := fp.backends[pod]; ok {
+			candidates = append(candidates, be)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	fp.next++
+	start := fp.next % len(candidates)
+	if fp.mode == ForwardRoundRobin {
+		return candidates[start]
+	}
+
+	// least connections, starting at a rotating offset so that ties are spread out
+	best := candidates[start]
+	for i := 1; i < len(candidates); i++ {
+		be := candidates[(start+i)%len(candidates)]
+		if atomic.LoadInt64(&be.active) < atomic.LoadInt64(&best.active) {
+			best = be
+		}
+	}
+	return best
+}
+
+func (fp *forwardPool) accept(l net.Listener, port int) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			// the listener is closed when we're stopped
+			return
+		}
+		go fp.proxy(conn, port)
+	}
+}
+
+func (fp *forwardPool) proxy(conn net.Conn, port int) {
+	defer conn.Close()
+	// the ports are updated under the lock each time a forward is set up
+	fp.p.mu.Lock()
+	localPort := fp.p.Ports[port].LocalPort
+	fp.p.mu.Unlock()
+
+	be := fp.pick()
+	if be == nil {
+		util.LogError("no ready pods to forward %s:%d to", fp.p.Name, localPort)
+		return
+	}
+	if port >= len(be.ports) {
+		util.LogError("port %d isn't forwarded to pod %s", localPort, be.pod)
+		return
+	}
+	atomic.AddInt64(&be.active, 1)
+	defer atomic.AddInt64(&be.active, -1)
+
+	remote, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(int(be.ports[port]))))
+	if err != nil {
+		util.LogError("error connecting to pod %s for %s: %s", be.pod, fp.p.Name, err)
+		return
+	}
+	defer remote.Close()
+	util.Pipe(conn, remote)
+}
@@ -1,12 +1,16 @@
 package kube
 
 import (
+	"context"
 	"fmt"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 
 	"github.com/tzneal/supplant/util"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/cli-runtime/pkg/genericclioptions"
 	"k8s.io/client-go/kubernetes/scheme"
 	"k8s.io/client-go/tools/portforward"
@@ -15,85 +19,381 @@ import (
 	"k8s.io/kubectl/pkg/polymorphichelpers"
 )
 
+const (
+	minReconnectDelay = 500 * time.Millisecond
+	maxReconnectDelay = 30 * time.Second
+	// a forward that stays up this long resets the reconnect backoff
+	stableForwardDuration = time.Minute
+)
+
+// PortForwarder forwards local ports to a pod backing a service.  If the pod goes away or the
+// connection to it is lost, the forward is re-established to another ready pod of the service
+// on the same local ports.
 type PortForwarder struct {
 	Namespace string
 	Name      string
 	Ports     []PortConfig
-	Forwarder *portforward.PortForwarder
+	// Ready is closed once the ports are first being forwarded
+	Ready chan struct{}
+
+	f       cmdutil.Factory
+	localIP net.IP
+	stop    chan struct{}
+	done    chan struct{}
+	pods    *podTracker
+	mu      sync.Mutex
+	current *portforward.PortForwarder
+	pool    *forwardPool
+
+	readyOnce sync.Once
 }
 
 type PortConfig struct {
 	LocalPort  int32
 	TargetPort int32
+	// TargetPortName is the name of a container port.  If it's set, the port is found on the pod each time
+	// a forward starts and TargetPort is only used if the pod has no port with the name.
+	TargetPortName string
 }
 
 // PortForward opens up a socket for the given local IP address and port and forwards it to the specified service and target port.
-func PortForward(f cmdutil.Factory, namespace string, svcName string, localIP net.IP, ports []PortConfig) (PortForwarder, error) {
+// The mode determines whether connections are forwarded to a single pod or spread across all of the ready pods of the service.
+// The context only limits setting up the first forward, the forward runs until it's closed.
+func PortForward(ctx context.Context, f cmdutil.Factory, namespace string, svcName string, localIP net.IP, ports []PortConfig, mode ForwardMode) (*PortForwarder, error) {
 	builder := f.NewBuilder().WithScheme(scheme.Scheme, scheme.Scheme.PrioritizedVersionsAllGroups()...).
 		ContinueOnError().NamespaceParam(namespace)
 	builder.ResourceNames("pods", fmt.Sprintf("service/%s", svcName))
 	obj, err := builder.Do().Object()
 	if err != nil {
-		return PortForwarder{}, err
+		return nil, err
 	}
 	if len(ports) == 0 {
 		util.LogError("no ports specified for forwarding")
-		return PortForwarder{}, fmt.Errorf("no ports specified for forwarding")
+		return nil, fmt.Errorf("no ports specified for forwarding")
 	}
 
 	getPodTimeout := 10 * time.Second
 	forwardablePod, err := polymorphichelpers.AttachablePodForObjectFn(f, obj, getPodTimeout)
 	if err != nil {
-		return PortForwarder{}, fmt.Errorf("unable to find pod for service: %w", err)
+		return nil, fmt.Errorf("unable to find pod for service: %w", err)
+	}
+
+	cs, err := f.KubernetesClientSet()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create clientset: %w", err)
+	}
+
+	pf := &PortForwarder{
+		Namespace: namespace,
+		Name:      svcName,
+		Ports:     append([]PortConfig(nil), ports...),
+		Ready:     make(chan struct{}),
+		f:         f,
+		localIP:   localIP,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	pf.pods = newPodTracker(cs, namespace, svcName, pf.stop)
+
+	if mode != ForwardSingle {
+		pf.pool, err = newForwardPool(pf, mode)
+		if err != nil {
+			close(pf.stop)
+			return nil, err
+		}
+		go pf.pool.run()
+		return pf, nil
 	}
 
-	stop := make(chan struct{}, 1)
-	ready := make(chan struct{})
+	// create the first forward synchronously so that configuration errors are reported to the caller
+	fw, err := pf.newForwarder(ctx, forwardablePod.Name)
+	if err != nil {
+		close(pf.stop)
+		return nil, err
+	}
+	go pf.run(fw, forwardablePod.Name)
+	return pf, nil
+}
 
-	restClient, err := f.RESTClient()
+// PortForwardPod forwards the given local IP address and ports to a specific pod.  If the forward is lost, it
+// is re-established to the same pod.  The context only limits setting up the first forward.
+func PortForwardPod(ctx context.Context, f cmdutil.Factory, namespace string, podName string, localIP net.IP, ports []PortConfig) (*PortForwarder, error) {
+	if len(ports) == 0 {
+		return nil, fmt.Errorf("no ports specified for forwarding")
+	}
+	pf := &PortForwarder{
+		Namespace: namespace,
+		Name:      podName,
+		Ports:     append([]PortConfig(nil), ports...),
+		Ready:     make(chan struct{}),
+		f:         f,
+		localIP:   localIP,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	fw, err := pf.newForwarder(ctx, podName)
 	if err != nil {
-		return PortForwarder{}, fmt.Errorf("unable to create rest client: %w", err)
+		return nil, err
+	}
+	go pf.run(fw, podName)
+	return pf, nil
+}
+
+// GetPorts returns the ports that are currently being forwarded.
+func (p *PortForwarder) GetPorts() ([]portforward.ForwardedPort, error) {
+	if p.pool != nil {
+		return p.pool.GetPorts()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.current == nil {
+		return nil, fmt.Errorf("not currently forwarding ports for %s", p.Name)
+	}
+	return p.current.GetPorts()
+}
+
+// LocalIP returns the address that the ports are forwarded on.
+func (p *PortForwarder) LocalIP() net.IP {
+	return p.localIP
+}
+
+// stopContext returns a context that is cancelled when the forwarder is closed, for use when reconnecting.
+func (p *PortForwarder) stopContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		select {
+		case <-p.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// Close stops forwarding and waits for the forward to shut down.
+func (p *PortForwarder) Close() {
+	close(p.stop)
+	<-p.done
+}
+
+// run forwards ports, reconnecting with backoff whenever the forward is lost.
+func (p *PortForwarder) run(fw *forwardAttempt, podName string) {
+	defer close(p.done)
+	delay := minReconnectDelay
+	for {
+		if fw != nil {
+			started := time.Now()
+			p.forward(fw, podName)
+			if time.Since(started) > stableForwardDuration {
+				delay = minReconnectDelay
+			}
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+		if delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+
+		podName = p.pods.Pick(podName)
+		if podName == "" {
+			util.LogError("no ready pods for %s, retrying", p.Name)
+			fw = nil
+			continue
+		}
+		util.LogInfoListItem("reconnecting port forward for %s to pod %s", p.Name, podName)
+		ctx, cancel := p.stopContext()
+		var err error
+		fw, err = p.newForwarder(ctx, podName)
+		cancel()
+		if err != nil {
+			util.LogError("error reconnecting port forward for %s: %s", p.Name, err)
+			fw = nil
+		}
+	}
+}
+
+// forward runs a single forward until it fails, its pod is no longer ready or we are stopped.
+func (p *PortForwarder) forward(fw *forwardAttempt, podName string) {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- fw.pf.ForwardPorts()
+	}()
+
+	select {
+	case <-fw.ready:
+		p.setCurrent(fw.pf)
+	case err := <-errCh:
+		util.LogError("error forwarding ports for %s: %s", p.Name, err)
+		return
+	case <-p.stop:
+		close(fw.stop)
+		<-errCh
+		return
+	}
+
+	cancel := make(chan struct{})
+	defer close(cancel)
+	podGone := p.pods.WaitGone(podName, cancel)
+	select {
+	case err := <-errCh:
+		if err != nil {
+			util.LogError("error forwarding ports for %s: %s", p.Name, err)
+		} else {
+			util.LogError("lost connection to pod %s for %s", podName, p.Name)
+		}
+	case <-podGone:
+		util.LogError("pod %s for %s is no longer ready", podName, p.Name)
+		close(fw.stop)
+		<-errCh
+	case <-p.stop:
+		close(fw.stop)
+		<-errCh
+	}
+	p.setCurrent(nil)
+}
+
+func (p *PortForwarder) setCurrent(fw *portforward.PortForwarder) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.current = fw
+	if fw != nil {
+		p.markReady()
+	}
+}
+
+// markReady closes the ready channel if it isn't already closed
+func (p *PortForwarder) markReady() {
+	p.readyOnce.Do(func() { close(p.Ready) })
+}
+
+type forwardAttempt struct {
+	pf    *portforward.PortForwarder
+	stop  chan struct{}
+	ready chan struct{}
+}
+
+func (p *PortForwarder) newForwarder(ctx context.Context, podName string) (*forwardAttempt, error) {
+	targets, err := p.resolvePorts(ctx, podName)
+	if err != nil {
+		return nil, err
+	}
+	var portList []string
+	p.mu.Lock()
+	for i := range p.Ports {
+		port := &p.Ports[i]
+		// a port is chosen once, before the first attempt, so that every reconnect uses the same local port
+		if port.LocalPort == 0 {
+			if port.LocalPort, err = freeLocalPort(p.localIP); err != nil {
+				p.mu.Unlock()
+				return nil, err
+			}
+		}
+		portList = append(portList, fmt.Sprintf("%d:%d", port.LocalPort, targets[i]))
+	}
+	p.mu.Unlock()
+	return p.dialPod(podName, p.localIP.String(), portList)
+}
+
+// freeLocalPort returns a TCP port that is currently free on ip.
+func freeLocalPort(ip net.IP) (int32, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return 0, fmt.Errorf("unable to find a free port on %s: %w", ip, err)
+	}
+	defer l.Close()
+	return int32(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// resolvePorts returns the target port of each port for a pod, finding named ports among the container
+// ports of the pod.  The resolved ports are recorded in p.Ports.
+func (p *PortForwarder) resolvePorts(ctx context.Context, podName string) ([]int32, error) {
+	p.mu.Lock()
+	ports := append([]PortConfig(nil), p.Ports...)
+	p.mu.Unlock()
+
+	var pod *v1.Pod
+	targets := make([]int32, len(ports))
+	for i, port := range ports {
+		targets[i] = port.TargetPort
+		if port.TargetPortName == "" {
+			continue
+		}
+		if pod == nil {
+			cs, err := p.f.KubernetesClientSet()
+			if err != nil {
+				return nil, fmt.Errorf("unable to create clientset: %w", err)
+			}
+			pod, err = cs.CoreV1().Pods(p.Namespace).Get(ctx, podName, metav1.GetOptions{})
+			if err != nil {
+				return nil, fmt.Errorf("unable to get pod %s to find port %s: %w", podName, port.TargetPortName, err)
+			}
+		}
+		if cp, ok := containerPort(pod, port.TargetPortName); ok {
+			targets[i] = cp
+		} else if port.TargetPort <= 0 {
+			return nil, fmt.Errorf("pod %s has no port named %s", podName, port.TargetPortName)
+		}
+	}
+
+	p.mu.Lock()
+	for i := range targets {
+		p.Ports[i].TargetPort = targets[i]
+	}
+	p.mu.Unlock()
+	return targets, nil
+}
+
+// containerPort finds a named port among the containers of a pod.
+func containerPort(pod *v1.Pod, name string) (int32, bool) {
+	for _, container := range pod.Spec.Containers {
+		for _, port := range container.Ports {
+			if port.Name == name {
+				return port.ContainerPort, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// dialPod creates a port forward to the named pod listening on the given address and ports.  The
+// ports are in the local:remote format used by kubectl port-forward.
+func (p *PortForwarder) dialPod(podName string, address string, portList []string) (*forwardAttempt, error) {
+	restClient, err := p.f.RESTClient()
+	if err != nil {
+		return nil, fmt.Errorf("unable to create rest client: %w", err)
 	}
 
 	req := restClient.Post().
 		Resource("pods").
-		Namespace(namespace).
-		Name(forwardablePod.Name).
+		Namespace(p.Namespace).
+		Name(podName).
 		SubResource("portforward")
 
-	restCfg, err := f.ToRESTConfig()
+	restCfg, err := p.f.ToRESTConfig()
 	if err != nil {
-		return PortForwarder{}, fmt.Errorf("error creating rest model: %w", err)
+		return nil, fmt.Errorf("error creating rest model: %w", err)
 	}
 
 	transport, upgrader, err := spdy.RoundTripperFor(restCfg)
 	if err != nil {
-		return PortForwarder{}, fmt.Errorf("error creating round tripper: %w", err)
+		return nil, fmt.Errorf("error creating round tripper: %w", err)
 	}
 
 	var strm genericclioptions.IOStreams
-	var portList []string
-	for _, port := range ports {
-		portList = append(portList, fmt.Sprintf("%d:%d", port.LocalPort, port.TargetPort))
+
+	attempt := &forwardAttempt{
+		stop:  make(chan struct{}),
+		ready: make(chan struct{}),
 	}
 	dialer := spdy.NewDialer(upgrader, &http.Client{Transport: transport}, "POST", req.URL())
-	address := []string{localIP.String()}
-	fw, err := portforward.NewOnAddresses(dialer, address, portList, stop, ready, strm.Out, strm.ErrOut)
+	attempt.pf, err = portforward.NewOnAddresses(dialer, []string{address}, portList, attempt.stop, attempt.ready, strm.Out, strm.ErrOut)
 	if err != nil {
-		return PortForwarder{}, fmt.Errorf("error creating targetPort forward: %w", err)
+		return nil, fmt.Errorf("error creating targetPort forward: %w", err)
 	}
-
-	go func() {
-		err := fw.ForwardPorts()
-		if err != nil {
-			util.LogError("error forwarding ports for %s: %s", svcName, err)
-		}
-	}()
-
-	return PortForwarder{
-		Namespace: namespace,
-		Name:      svcName,
-		Ports:     ports,
-		Forwarder: fw,
-	}, nil
+	return attempt, nil
 }
@@ -0,0 +1,69 @@
+package model
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/user"
+	"time"
+)
+
+const (
+	// AnnotationSupplanted marks services and endpoints that were created by supplant.
+	AnnotationSupplanted = "supplant"
+	// AnnotationBackup holds the original service on a supplanted service so that it can
+	// be restored from cluster state alone.
+	AnnotationBackup = "supplant/backup"
+	// AnnotationOwner identifies the user and machine that supplanted a service.
+	AnnotationOwner = "supplant/owner"
+	// AnnotationStarted is the time that a service was supplanted in RFC 3339 format.
+	AnnotationStarted = "supplant/started"
+)
+
+const (
+	// LabelSupplant marks every object that supplant creates so that they can be found
+	// with a label selector.
+	LabelSupplant = "supplant"
+	// LabelSession identifies the run of supplant that created an object.
+	LabelSession = "supplant/session"
+)
+
+// NewSessionID returns a random identifier for a run of supplant.
+func NewSessionID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		// fall back to something that is still very likely to be unique
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf)
+}
+
+// SessionLabels returns the labels that are applied to every object created by a session.
+func SessionLabels(session string) map[string]string {
+	return map[string]string{
+		LabelSupplant: "true",
+		LabelSession:  session,
+	}
+}
+
+// Owner returns an identifier for the current user and machine of the form user@host.
+func Owner() string {
+	username := "unknown"
+	if u, err := user.Current(); err == nil {
+		username = u.Username
+	}
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s@%s", username, hostname)
+}
+
+// OwnerAnnotations returns the annotations that record who supplanted a service and when.
+func OwnerAnnotations(started time.Time) map[string]string {
+	return map[string]string{
+		AnnotationOwner:   Owner(),
+		AnnotationStarted: started.UTC().Format(time.RFC3339),
+	}
+}
@@ -0,0 +1,50 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// EncodeServiceBackup serializes the parts of a service that are needed to recreate it.
+func EncodeServiceBackup(svc *v1.Service) (string, error) {
+	backup := v1.Service{
+		TypeMeta: metav1.TypeMeta{Kind: "Service", APIVersion: "v1"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        svc.Name,
+			Namespace:   svc.Namespace,
+			Labels:      svc.Labels,
+			Annotations: map[string]string{},
+		},
+		Spec: svc.Spec,
+	}
+	for k, v := range svc.Annotations {
+		// don't carry our own annotations into the backup if we're somehow backing up a
+		// supplanted service
+		if k == AnnotationSupplanted || strings.HasPrefix(k, AnnotationSupplanted+"/") {
+			continue
+		}
+		backup.Annotations[k] = v
+	}
+	buf, err := json.Marshal(backup)
+	if err != nil {
+		return "", fmt.Errorf("encoding backup of %s: %w", svc.Name, err)
+	}
+	return string(buf), nil
+}
+
+// DecodeServiceBackup reads the original service from the backup annotation of a supplanted service.
+func DecodeServiceBackup(svc *v1.Service) (*v1.Service, error) {
+	data, ok := svc.Annotations[AnnotationBackup]
+	if !ok {
+		return nil, fmt.Errorf("service %s/%s has no %s annotation", svc.Namespace, svc.Name, AnnotationBackup)
+	}
+	backup := &v1.Service{}
+	if err := json.Unmarshal([]byte(data), backup); err != nil {
+		return nil, fmt.Errorf("decoding backup of %s/%s: %w", svc.Namespace, svc.Name, err)
+	}
+	return backup, nil
+}
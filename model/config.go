@@ -3,6 +3,8 @@ package model
 import (
 	"context"
 	"fmt"
+	"net"
+	"strconv"
 
 	"github.com/tzneal/supplant/util"
 	v1 "k8s.io/api/core/v1"
@@ -13,8 +15,14 @@ import (
 )
 
 type Config struct {
+	// Extends are the paths of configurations, relative to this one, that this configuration is merged on top of
+	Extends  []string `yaml:"extends,omitempty"`
 	Supplant []SupplantService
 	External []ExternalService
+	// Profiles are named sets of services to enable, overriding the enabled flag of each service
+	Profiles map[string]Profile `yaml:"profiles,omitempty"`
+	// Filter chooses the services that 'config create' and 'config update' add from the cluster
+	Filter *ServiceFilter `yaml:"filter,omitempty"`
 }
 
 type SupplantService struct {
@@ -24,23 +32,98 @@ type SupplantService struct {
 	Ports     []SupplantPortConfig
 }
 type SupplantPortConfig struct {
+	// Name is the name of the service port.  If it's set, the port is found by name when supplanting so
+	// that Port is only used if the service no longer has a port with the name.
 	Name      string `yaml:"name,omitempty"`
 	Protocol  v1.Protocol
 	Port      int32
 	LocalPort int32
+	// LocalTarget is an optional address (e.g. localhost:8080) that supplant will proxy connections
+	// on the local port to, allowing the replacement to listen on its usual port
+	LocalTarget string `yaml:"localtarget,omitempty"`
+}
+
+// Resolve finds the port on a service that this port refers to, by name if it has one and by number and
+// protocol if it doesn't or if the service has no port with the name.
+func (p SupplantPortConfig) Resolve(svc v1.Service) (v1.ServicePort, bool) {
+	if p.Name != "" {
+		for _, sp := range svc.Spec.Ports {
+			if sp.Name == p.Name {
+				return sp, true
+			}
+		}
+	}
+	for _, sp := range svc.Spec.Ports {
+		if sp.Port == p.Port && NormalizeProtocol(sp.Protocol) == NormalizeProtocol(p.Protocol) {
+			return sp, true
+		}
+	}
+	return v1.ServicePort{}, false
+}
+
+// LocalAddress returns the address on this machine that connections to the port should reach.
+func (p SupplantPortConfig) LocalAddress() string {
+	if p.LocalTarget != "" {
+		return p.LocalTarget
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(int(p.LocalPort)))
 }
 
 type ExternalService struct {
 	Name      string
 	Namespace string
 	Enabled   bool
-	Ports     []ExternalPortConfig
+	// Mode is how connections are spread across the pods of the service, either single (the
+	// default), round-robin or least-connections
+	Mode  string `yaml:"mode,omitempty"`
+	Ports []ExternalPortConfig
 }
 type ExternalPortConfig struct {
 	Name       string `yaml:"name,omitempty"`
 	Protocol   v1.Protocol
 	TargetPort int32
-	LocalPort  int32
+	// TargetPortName is the name of the container port that the service targets.  If it's set, the port
+	// is found on the pod when the forward starts and TargetPort is only used if the pod has no port with
+	// the name.
+	TargetPortName string `yaml:"targetportname,omitempty"`
+	LocalPort      int32
+}
+
+// ServicePort finds the port on a service that this port forwards to, by name if it has one and by
+// protocol and target port otherwise.
+func (p ExternalPortConfig) ServicePort(svc v1.Service) (v1.ServicePort, bool) {
+	for _, sp := range svc.Spec.Ports {
+		if p.Name != "" {
+			if sp.Name == p.Name {
+				return sp, true
+			}
+			continue
+		}
+		if NormalizeProtocol(sp.Protocol) != NormalizeProtocol(p.Protocol) {
+			continue
+		}
+		if (sp.TargetPort.Type == intstr.Int && sp.TargetPort.IntVal == p.TargetPort) ||
+			(sp.TargetPort.Type == intstr.String && sp.TargetPort.StrVal == p.TargetPortName) {
+			return sp, true
+		}
+	}
+	return v1.ServicePort{}, false
+}
+
+// NormalizeProtocol returns the protocol of a port, which is TCP if it isn't set.
+func NormalizeProtocol(protocol v1.Protocol) v1.Protocol {
+	if protocol == "" {
+		return v1.ProtocolTCP
+	}
+	return protocol
+}
+
+// SupportedProtocol returns true if supplant can supplant and forward ports with the protocol.  Port forwards
+// only carry TCP (see https://github.com/kubernetes/kubernetes/issues/47862), so UDP is carried through a
+// relay pod.
+func SupportedProtocol(protocol v1.Protocol) bool {
+	protocol = NormalizeProtocol(protocol)
+	return protocol == v1.ProtocolTCP || protocol == v1.ProtocolUDP
 }
 
 type PortLookup struct {
@@ -62,8 +145,7 @@ func MapSupplantService(pl *PortLookup, svc v1.Service) SupplantService {
 		Enabled:   false,
 	}
 	for _, port := range svc.Spec.Ports {
-		// doesn't support UDP port forwarding yet see https://github.com/kubernetes/kubernetes/issues/47862
-		if port.Protocol != "TCP" {
+		if !SupportedProtocol(port.Protocol) {
 			continue
 		}
 		ret.Ports = append(ret.Ports, SupplantPortConfig{
@@ -76,42 +158,45 @@ func MapSupplantService(pl *PortLookup, svc v1.Service) SupplantService {
 	return ret
 }
 
-func MapExternalService(pl *PortLookup, svc v1.Service) ExternalService {
+func MapExternalService(ctx context.Context, pl *PortLookup, svc v1.Service) ExternalService {
 	ret := ExternalService{
 		Name:      svc.Name,
 		Namespace: svc.Namespace,
 		Enabled:   false,
 	}
 	for _, port := range svc.Spec.Ports {
-		// doesn't support UDP port forwarding yet see https://github.com/kubernetes/kubernetes/issues/47862
-		if port.Protocol != "TCP" {
+		if !SupportedProtocol(port.Protocol) {
 			continue
 		}
-		ret.Ports = append(ret.Ports, ExternalPortConfig{
+		epc := ExternalPortConfig{
 			Name:       port.Name,
-			TargetPort: pl.LookupPort(svc, port.TargetPort),
+			TargetPort: pl.LookupPort(ctx, svc, port.TargetPort),
 			Protocol:   port.Protocol,
 			LocalPort:  0,
-		})
+		}
+		// keep the name so that the port is found on the pod when forwarding
+		if port.TargetPort.Type == intstr.String {
+			epc.TargetPortName = port.TargetPort.StrVal
+		}
+		ret.Ports = append(ret.Ports, epc)
 	}
 	return ret
 }
 
-func (pl *PortLookup) LookupPort(svc v1.Service, port intstr.IntOrString) int32 {
+func (pl *PortLookup) LookupPort(ctx context.Context, svc v1.Service, port intstr.IntOrString) int32 {
 	if port.Type == intstr.Int {
 		return port.IntVal
 	}
-	key := fmt.Sprintf("%s/%s", svc.Namespace, svc.Name)
+	key := fmt.Sprintf("%s/%s/%s", svc.Namespace, svc.Name, port.StrVal)
 	if port, ok := pl.cache[key]; ok {
 		return port
 	}
 
-	ctx := context.Background()
 	listOpts := metav1.ListOptions{
 		LabelSelector: labels.FormatLabels(svc.Spec.Selector),
 	}
 
-	pods, err := pl.cs.CoreV1().Pods("").List(ctx, listOpts)
+	pods, err := pl.cs.CoreV1().Pods(svc.Namespace).List(ctx, listOpts)
 	if err != nil {
 		util.LogError("error looking up named port %s: %s", port.StrVal, err)
 		return -1
@@ -0,0 +1,99 @@
+package model
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// EnvVar is an environment variable describing where a service can be reached.
+type EnvVar struct {
+	Name  string
+	Value string
+}
+
+// EnvPort is a port that a service can be reached on.
+type EnvPort struct {
+	Name     string
+	Protocol v1.Protocol
+	// Port is the port of the service in the cluster and is used to name the variables
+	Port int32
+	// Local is the port that the service can be reached on
+	Local int32
+}
+
+// EnvName converts a service or port name to the form used in environment variable names.
+func EnvName(name string) string {
+	return strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// ServiceEnv returns the variables that Kubernetes provides to pods for a service, pointing at host and
+// the local port of each port.
+func ServiceEnv(svcName string, host string, ports []EnvPort) []EnvVar {
+	if len(ports) == 0 {
+		return nil
+	}
+	prefix := EnvName(svcName)
+	env := []EnvVar{
+		{prefix + "_SERVICE_HOST", host},
+		{prefix + "_SERVICE_PORT", fmt.Sprint(ports[0].Local)},
+	}
+	for _, port := range ports {
+		if port.Name != "" {
+			env = append(env, EnvVar{fmt.Sprintf("%s_SERVICE_PORT_%s", prefix, EnvName(port.Name)), fmt.Sprint(port.Local)})
+		}
+	}
+
+	// and the older docker link style variables
+	env = append(env, EnvVar{prefix + "_PORT", envURL(host, ports[0])})
+	for _, port := range ports {
+		proto := strings.ToLower(string(port.Protocol))
+		if proto == "" {
+			proto = "tcp"
+		}
+		name := fmt.Sprintf("%s_PORT_%d_%s", prefix, port.Port, strings.ToUpper(proto))
+		env = append(env,
+			EnvVar{name, envURL(host, port)},
+			EnvVar{name + "_PROTO", proto},
+			EnvVar{name + "_PORT", fmt.Sprint(port.Local)},
+			EnvVar{name + "_ADDR", host},
+		)
+	}
+	return env
+}
+
+func envURL(host string, port EnvPort) string {
+	proto := strings.ToLower(string(port.Protocol))
+	if proto == "" {
+		proto = "tcp"
+	}
+	return fmt.Sprintf("%s://%s", proto, net.JoinHostPort(host, fmt.Sprint(port.Local)))
+}
+
+// SupplantEnv returns variables with the local ports that a replacement for a supplanted service should
+// listen on, named SUPPLANT_<SVC>_PORT for the first port and SUPPLANT_<SVC>_PORT_<PORT> for each port
+// by number and by name.
+func SupplantEnv(svc SupplantService) []EnvVar {
+	if len(svc.Ports) == 0 {
+		return nil
+	}
+	prefix := "SUPPLANT_" + EnvName(svc.Name)
+	var env []EnvVar
+	for i, port := range svc.Ports {
+		// with a local target, the replacement listens on the target instead of the local port
+		local := fmt.Sprint(port.LocalPort)
+		if _, p, err := net.SplitHostPort(port.LocalAddress()); err == nil {
+			local = p
+		}
+		if i == 0 {
+			env = append(env, EnvVar{prefix + "_PORT", local})
+		}
+		env = append(env, EnvVar{fmt.Sprintf("%s_PORT_%d", prefix, port.Port), local})
+		if port.Name != "" {
+			env = append(env, EnvVar{fmt.Sprintf("%s_PORT_%s", prefix, EnvName(port.Name)), local})
+		}
+	}
+	return env
+}
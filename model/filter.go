@@ -0,0 +1,106 @@
+package model
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// DefaultExclude are the services that are left out of a new configuration unless asked for.
+var DefaultExclude = []string{"kube-system/*", "default/kubernetes"}
+
+// ServiceFilter chooses which services in the cluster are added to a configuration and which of them start
+// out enabled.  Patterns are globs matched against the service name, or against namespace/name if they
+// contain a slash.
+type ServiceFilter struct {
+	// Namespaces limits the services to these namespaces, or all namespaces if it's empty
+	Namespaces []string `yaml:"namespaces,omitempty"`
+	// Selector is a label selector that services must match
+	Selector string `yaml:"selector,omitempty"`
+	// Include limits the services to those matching at least one pattern, if there are any
+	Include []string `yaml:"include,omitempty"`
+	// Exclude leaves out services matching any of the patterns
+	Exclude []string `yaml:"exclude,omitempty"`
+	// Enable are the patterns of services that start out enabled for supplanting
+	Enable []string `yaml:"enable,omitempty"`
+	// EnableExternal are the patterns of services that start out enabled for forwarding
+	EnableExternal []string `yaml:"enableexternal,omitempty"`
+}
+
+// DefaultServiceFilter returns the filter used when a configuration doesn't have one.
+func DefaultServiceFilter() ServiceFilter {
+	return ServiceFilter{
+		Exclude: append([]string{}, DefaultExclude...),
+	}
+}
+
+// Validate checks that the selector and each of the patterns can be parsed.
+func (f ServiceFilter) Validate() error {
+	if _, err := labels.Parse(f.Selector); err != nil {
+		return fmt.Errorf("invalid selector %q: %w", f.Selector, err)
+	}
+	for _, patterns := range [][]string{f.Include, f.Exclude, f.Enable, f.EnableExternal} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// InNamespace returns true if services in the namespace are considered by the filter.
+func (f ServiceFilter) InNamespace(namespace string) bool {
+	if len(f.Namespaces) == 0 {
+		return true
+	}
+	for _, ns := range f.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// Matches returns true if the service should be added to a configuration.
+func (f ServiceFilter) Matches(svc v1.Service) bool {
+	if !f.InNamespace(svc.Namespace) {
+		return false
+	}
+	if f.Selector != "" {
+		sel, err := labels.Parse(f.Selector)
+		if err != nil || !sel.Matches(labels.Set(svc.Labels)) {
+			return false
+		}
+	}
+	if len(f.Include) != 0 && !matchAny(f.Include, svc) {
+		return false
+	}
+	return !matchAny(f.Exclude, svc)
+}
+
+// EnableSupplant returns true if the service should start out enabled for supplanting.
+func (f ServiceFilter) EnableSupplant(svc v1.Service) bool {
+	return matchAny(f.Enable, svc)
+}
+
+// EnableForward returns true if the service should start out enabled for forwarding.
+func (f ServiceFilter) EnableForward(svc v1.Service) bool {
+	return matchAny(f.EnableExternal, svc)
+}
+
+func matchAny(patterns []string, svc v1.Service) bool {
+	for _, pattern := range patterns {
+		name := svc.Name
+		if strings.Contains(pattern, "/") {
+			name = svc.Namespace + "/" + svc.Name
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
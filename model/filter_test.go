@@ -0,0 +1,82 @@
+package model
+
+import (
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestServiceFilterMatches(t *testing.T) {
+	svc := func(namespace, name string, labels map[string]string) v1.Service {
+		return v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Labels: labels}}
+	}
+	web := svc("shop", "web", map[string]string{"tier": "frontend"})
+	db := svc("shop", "db", map[string]string{"tier": "backend"})
+	dns := svc("kube-system", "kube-dns", nil)
+	kubernetes := svc("default", "kubernetes", nil)
+
+	tests := []struct {
+		name   string
+		filter ServiceFilter
+		svc    v1.Service
+		want   bool
+	}{
+		{"empty matches everything", ServiceFilter{}, dns, true},
+		{"default excludes kube-system", DefaultServiceFilter(), dns, false},
+		{"default excludes the api server", DefaultServiceFilter(), kubernetes, false},
+		{"default keeps the rest", DefaultServiceFilter(), web, true},
+		{"namespace", ServiceFilter{Namespaces: []string{"shop"}}, web, true},
+		{"other namespace", ServiceFilter{Namespaces: []string{"shop"}}, kubernetes, false},
+		{"selector", ServiceFilter{Selector: "tier=frontend"}, web, true},
+		{"selector mismatch", ServiceFilter{Selector: "tier=frontend"}, db, false},
+		{"selector without labels", ServiceFilter{Selector: "tier"}, dns, false},
+		{"invalid selector", ServiceFilter{Selector: "tier=="}, web, false},
+		{"include name", ServiceFilter{Include: []string{"w*"}}, web, true},
+		{"include name mismatch", ServiceFilter{Include: []string{"w*"}}, db, false},
+		{"include namespace/name", ServiceFilter{Include: []string{"shop/*"}}, db, true},
+		{"name pattern doesn't match namespace", ServiceFilter{Include: []string{"shop"}}, db, false},
+		{"exclude wins over include", ServiceFilter{Include: []string{"*"}, Exclude: []string{"shop/db"}}, db, false},
+		{"exclude name in any namespace", ServiceFilter{Exclude: []string{"kube-*"}}, dns, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.filter.Matches(tc.svc); got != tc.want {
+				t.Errorf("Matches(%s/%s) = %v, want %v", tc.svc.Namespace, tc.svc.Name, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestServiceFilterEnable(t *testing.T) {
+	f := ServiceFilter{Enable: []string{"shop/web"}, EnableExternal: []string{"d*"}}
+	web := v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "web"}}
+	db := v1.Service{ObjectMeta: metav1.ObjectMeta{Namespace: "shop", Name: "db"}}
+	if !f.EnableSupplant(web) || f.EnableSupplant(db) {
+		t.Errorf("expected only web to be enabled for supplanting")
+	}
+	if f.EnableForward(web) || !f.EnableForward(db) {
+		t.Errorf("expected only db to be enabled for forwarding")
+	}
+}
+
+func TestServiceFilterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  ServiceFilter
+		wantErr bool
+	}{
+		{"default", DefaultServiceFilter(), false},
+		{"selector", ServiceFilter{Selector: "app in (a, b),tier!=db"}, false},
+		{"bad selector", ServiceFilter{Selector: "app in ("}, true},
+		{"bad include", ServiceFilter{Include: []string{"[a-"}}, true},
+		{"bad enable", ServiceFilter{EnableExternal: []string{"ns/[x"}}, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if err := tc.filter.Validate(); (err != nil) != tc.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tc.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	hostsBegin = "# BEGIN supplant, this block is replaced each time supplant starts and removed when it exits"
+	hostsEnd   = "# END supplant"
+)
+
+// HostsEntry is a line of a hosts file.
+type HostsEntry struct {
+	IP    string
+	Names []string
+}
+
+// LoopbackAlias returns the loopback address given to the i'th forwarded service, starting with 127.1.0.1.
+func LoopbackAlias(i int) net.IP {
+	return net.IPv4(127, 1, byte(i/254), byte(i%254+1))
+}
+
+// HostsEntries returns the hosts file entries for the forwarded services.  Each service is given the names
+// that a pod in the cluster could use for it.  The short name of a service is only used for the services in
+// namespace or if it isn't shared by a service in another namespace.
+func HostsEntries(forwards []ForwardMapping, namespace string, clusterDomain string) []HostsEntry {
+	type svcKey struct {
+		namespace string
+		name      string
+	}
+	var order []svcKey
+	hosts := map[svcKey]string{}
+	nameCount := map[string]int{}
+	for _, fwd := range forwards {
+		key := svcKey{fwd.Namespace, fwd.Service}
+		if _, ok := hosts[key]; ok {
+			continue
+		}
+		host, _, err := net.SplitHostPort(fwd.Local)
+		if err != nil {
+			continue
+		}
+		hosts[key] = host
+		order = append(order, key)
+		nameCount[fwd.Service]++
+	}
+
+	clusterDomain = strings.Trim(clusterDomain, ".")
+	var entries []HostsEntry
+	for _, key := range order {
+		var names []string
+		if key.namespace == namespace || nameCount[key.name] == 1 {
+			names = append(names, key.name)
+		}
+		qualified := fmt.Sprintf("%s.%s", key.name, key.namespace)
+		names = append(names, qualified, qualified+".svc")
+		if clusterDomain != "" {
+			names = append(names, qualified+".svc."+clusterDomain)
+		}
+		entries = append(entries, HostsEntry{IP: hosts[key], Names: names})
+	}
+	return entries
+}
+
+// ReplaceHostsBlock returns the contents of a hosts file with the blocks of entries that supplant manages
+// replaced by entries, or removed if there are none.  The rest of the file is left as is, including the
+// lines after a block that has no end since we can't tell where a block that we didn't write ends.
+func ReplaceHostsBlock(data []byte, entries []HostsEntry) []byte {
+	var out, block bytes.Buffer
+	inBlock := false
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		text := strings.TrimRight(string(line), "\r\n")
+		switch {
+		case strings.HasPrefix(text, "# BEGIN supplant"):
+			// a block that is started again never ended
+			out.Write(block.Bytes())
+			block.Reset()
+			block.Write(line)
+			inBlock = true
+		case inBlock && text == hostsEnd:
+			block.Reset()
+			inBlock = false
+		case inBlock:
+			block.Write(line)
+		default:
+			out.Write(line)
+		}
+	}
+	out.Write(block.Bytes())
+	if len(entries) == 0 {
+		return out.Bytes()
+	}
+
+	if out.Len() > 0 && !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteString("\n")
+	}
+	fmt.Fprintln(&out, hostsBegin)
+	for _, e := range entries {
+		fmt.Fprintf(&out, "%s\t%s\n", e.IP, strings.Join(e.Names, " "))
+	}
+	fmt.Fprintln(&out, hostsEnd)
+	return out.Bytes()
+}
@@ -0,0 +1,113 @@
+package model
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostsEntries(t *testing.T) {
+	forwards := []ForwardMapping{
+		{Namespace: "shop", Service: "web", Port: 80, Local: "127.1.0.1:80"},
+		{Namespace: "shop", Service: "web", Port: 443, Local: "127.1.0.1:443"},
+		{Namespace: "blog", Service: "web", Port: 80, Local: "127.1.0.2:80"},
+		{Namespace: "blog", Service: "admin", Port: 8080, Local: "127.1.0.3:8080"},
+		{Namespace: "data", Service: "db", Port: 5432, Local: "127.1.0.4:5432"},
+		{Namespace: "cache", Service: "db", Port: 6379, Local: "127.1.0.5:6379"},
+		{Namespace: "data", Service: "queue", Port: 5672, Local: "[::1]:5672"},
+	}
+	tests := []struct {
+		name          string
+		namespace     string
+		clusterDomain string
+		want          []HostsEntry
+	}{
+		{
+			name:          "short names for the namespace and unique services",
+			namespace:     "shop",
+			clusterDomain: "cluster.local",
+			want: []HostsEntry{
+				{IP: "127.1.0.1", Names: []string{"web", "web.shop", "web.shop.svc", "web.shop.svc.cluster.local"}},
+				{IP: "127.1.0.2", Names: []string{"web.blog", "web.blog.svc", "web.blog.svc.cluster.local"}},
+				{IP: "127.1.0.3", Names: []string{"admin", "admin.blog", "admin.blog.svc", "admin.blog.svc.cluster.local"}},
+				{IP: "127.1.0.4", Names: []string{"db.data", "db.data.svc", "db.data.svc.cluster.local"}},
+				{IP: "127.1.0.5", Names: []string{"db.cache", "db.cache.svc", "db.cache.svc.cluster.local"}},
+				{IP: "::1", Names: []string{"queue", "queue.data", "queue.data.svc", "queue.data.svc.cluster.local"}},
+			},
+		},
+		{
+			name:          "another namespace and a cluster domain with a trailing dot",
+			namespace:     "data",
+			clusterDomain: "cluster.local.",
+			want: []HostsEntry{
+				{IP: "127.1.0.1", Names: []string{"web.shop", "web.shop.svc", "web.shop.svc.cluster.local"}},
+				{IP: "127.1.0.2", Names: []string{"web.blog", "web.blog.svc", "web.blog.svc.cluster.local"}},
+				{IP: "127.1.0.3", Names: []string{"admin", "admin.blog", "admin.blog.svc", "admin.blog.svc.cluster.local"}},
+				{IP: "127.1.0.4", Names: []string{"db", "db.data", "db.data.svc", "db.data.svc.cluster.local"}},
+				{IP: "127.1.0.5", Names: []string{"db.cache", "db.cache.svc", "db.cache.svc.cluster.local"}},
+				{IP: "::1", Names: []string{"queue", "queue.data", "queue.data.svc", "queue.data.svc.cluster.local"}},
+			},
+		},
+		{
+			name:      "no cluster domain",
+			namespace: "blog",
+			want: []HostsEntry{
+				{IP: "127.1.0.1", Names: []string{"web.shop", "web.shop.svc"}},
+				{IP: "127.1.0.2", Names: []string{"web", "web.blog", "web.blog.svc"}},
+				{IP: "127.1.0.3", Names: []string{"admin", "admin.blog", "admin.blog.svc"}},
+				{IP: "127.1.0.4", Names: []string{"db.data", "db.data.svc"}},
+				{IP: "127.1.0.5", Names: []string{"db.cache", "db.cache.svc"}},
+				{IP: "::1", Names: []string{"queue", "queue.data", "queue.data.svc"}},
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := HostsEntries(forwards, tc.namespace, tc.clusterDomain)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("HostsEntries() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReplaceHostsBlock(t *testing.T) {
+	const block = hostsBegin + "\n127.1.0.1\tweb web.shop\n" + hostsEnd + "\n"
+	entries := []HostsEntry{{IP: "127.1.0.2", Names: []string{"db", "db.data"}}}
+	const newBlock = hostsBegin + "\n127.1.0.2\tdb db.data\n" + hostsEnd + "\n"
+
+	tests := []struct {
+		name    string
+		data    string
+		entries []HostsEntry
+		want    string
+	}{
+		{"empty file", "", entries, newBlock},
+		{"empty file without entries", "", nil, ""},
+		{"added", "127.0.0.1 localhost\n", entries, "127.0.0.1 localhost\n" + newBlock},
+		{"replaced", "127.0.0.1 localhost\n" + block + "::1 localhost\n", entries, "127.0.0.1 localhost\n::1 localhost\n" + newBlock},
+		{"removed", "127.0.0.1 localhost\n" + block + "::1 localhost\n", nil, "127.0.0.1 localhost\n::1 localhost\n"},
+		{"no trailing newline", "127.0.0.1 localhost", entries, "127.0.0.1 localhost\n" + newBlock},
+		{"no trailing newline is kept", "127.0.0.1 localhost", nil, "127.0.0.1 localhost"},
+		{"block without trailing newline", "127.0.0.1 localhost\n" + block[:len(block)-1], nil, "127.0.0.1 localhost\n"},
+		{"carriage returns", "127.0.0.1 localhost\r\n" + hostsBegin + "\r\n127.1.0.1\tweb\r\n" + hostsEnd + "\r\n", nil,
+			"127.0.0.1 localhost\r\n"},
+		{"duplicated blocks", block + "127.0.0.1 localhost\n" + block, entries, "127.0.0.1 localhost\n" + newBlock},
+		{"missing end", "127.0.0.1 localhost\n" + hostsBegin + "\n10.0.0.1 mine\n", entries,
+			"127.0.0.1 localhost\n" + hostsBegin + "\n10.0.0.1 mine\n" + newBlock},
+		{"missing end without trailing newline", hostsBegin + "\n10.0.0.1 mine", nil, hostsBegin + "\n10.0.0.1 mine"},
+		{"missing end before a block", hostsBegin + "\n10.0.0.1 mine\n" + block + "::1 localhost\n", nil,
+			hostsBegin + "\n10.0.0.1 mine\n::1 localhost\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := string(ReplaceHostsBlock([]byte(tc.data), tc.entries))
+			if got != tc.want {
+				t.Errorf("ReplaceHostsBlock() = %q, want %q", got, tc.want)
+			}
+			// replacing the block again gives the same file
+			if again := string(ReplaceHostsBlock([]byte(got), tc.entries)); again != got {
+				t.Errorf("expected a second replace to make no changes, got %q", again)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package model
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// JournalOp identifies the type of change recorded in a journal entry.
+type JournalOp string
+
+const (
+	// JournalBackupService records the original service before it is replaced.
+	JournalBackupService JournalOp = "backup-service"
+	// JournalRestoreService records that a backed up service was put back.
+	JournalRestoreService JournalOp = "restore-service"
+	// JournalCreateEndpoints records endpoints that supplant is about to create.
+	JournalCreateEndpoints JournalOp = "create-endpoints"
+	// JournalDeleteEndpoints records that endpoints created by supplant were removed.
+	JournalDeleteEndpoints JournalOp = "delete-endpoints"
+	// JournalCreateEndpointSlice records an endpoint slice that supplant is about to create
+	// for the named service.
+	JournalCreateEndpointSlice JournalOp = "create-endpointslice"
+	// JournalDeleteEndpointSlice records that the endpoint slice created by supplant for the
+	// named service was removed.
+	JournalDeleteEndpointSlice JournalOp = "delete-endpointslice"
+	// JournalCreatePod records a relay pod that supplant is about to create.
+	JournalCreatePod JournalOp = "create-pod"
+	// JournalDeletePod records that a relay pod created by supplant was removed.
+	JournalDeletePod JournalOp = "delete-pod"
+	// JournalOpen records the process that is writing to the journal.
+	JournalOpen JournalOp = "open"
+)
+
+// JournalEntry is a single change written to the journal.
+type JournalEntry struct {
+	Time      time.Time   `json:"time"`
+	Op        JournalOp   `json:"op"`
+	Namespace string      `json:"namespace"`
+	Name      string      `json:"name"`
+	Service   *v1.Service `json:"service,omitempty"`
+	PID       int         `json:"pid,omitempty"`
+}
+
+// Journal is an append-only on-disk log of the changes made to the cluster. Each entry
+// is synced to disk before the change is applied so that the changes can be undone
+// even if supplant is killed.
+type Journal struct {
+	mu      sync.Mutex
+	path    string
+	f       *os.File
+	entries []JournalEntry
+}
+
+// JournalDir returns the directory that journals are written to by default.
+func JournalDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "supplant"), nil
+}
+
+// NewJournalPath returns a unique path for a new journal in the default journal directory.
+func NewJournalPath() (string, error) {
+	dir, err := JournalDir()
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("journal-%s-%d.jsonl", time.Now().Format("20060102-150405"), os.Getpid())
+	return filepath.Join(dir, name), nil
+}
+
+// ListJournals returns the paths of all journals in the default journal directory.
+func ListJournals() ([]string, error) {
+	dir, err := JournalDir()
+	if err != nil {
+		return nil, err
+	}
+	paths, err := filepath.Glob(filepath.Join(dir, "journal-*.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// OpenJournal opens the journal at path for appending, creating it if necessary. Any
+// entries already in the journal are loaded.
+func OpenJournal(path string) (*Journal, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("creating journal directory: %w", err)
+	}
+	entries, err := ReadJournal(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("opening journal: %w", err)
+	}
+	// terminate any partially written entry so that new entries start on their own line
+	if st, err := f.Stat(); err == nil && st.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = f.ReadAt(last, st.Size()-1); err == nil && last[0] != '\n' {
+			_, _ = f.Write([]byte{'\n'})
+		}
+	}
+	return &Journal{path: path, f: f, entries: entries}, nil
+}
+
+// ReadJournal reads all of the entries from the journal at path.
+func ReadJournal(path string) ([]JournalEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(f)
+	// services can be large, so allow for long lines
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	var parseErr error
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		// a partially written final line is expected if we were killed mid-write, but
+		// anything else is corruption
+		if parseErr != nil {
+			return nil, parseErr
+		}
+		var e JournalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			parseErr = fmt.Errorf("%s:%d: %w", path, line, err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Path returns the location of the journal on disk.
+func (j *Journal) Path() string {
+	return j.path
+}
+
+// Record appends an entry to the journal and syncs it to disk.
+func (j *Journal) Record(e JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	buf = append(buf, '\n')
+	if _, err = j.f.Write(buf); err != nil {
+		return fmt.Errorf("writing journal: %w", err)
+	}
+	if err = j.f.Sync(); err != nil {
+		return fmt.Errorf("syncing journal: %w", err)
+	}
+	j.entries = append(j.entries, e)
+	return nil
+}
+
+// JournalOwner returns the ID of the process that most recently opened the journal for writing, or zero
+// if it isn't known.
+func JournalOwner(entries []JournalEntry) int {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i].Op == JournalOpen {
+			return entries[i].PID
+		}
+	}
+	return 0
+}
+
+// JournalInUse returns the ID of the process that owns the journal at path if that process is still
+// running, or zero otherwise.
+func JournalInUse(path string) (int, error) {
+	entries, err := ReadJournal(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	pid := JournalOwner(entries)
+	if pid == 0 || pid == os.Getpid() || !processAlive(pid) {
+		return 0, nil
+	}
+	return pid, nil
+}
+
+// Pending returns the entries in the journal whose changes have not been undone.
+func (j *Journal) Pending() []JournalEntry {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return PendingEntries(j.entries)
+}
+
+// Close closes the journal.  If every change recorded in the journal has been undone,
+// the journal is also removed from disk.
+func (j *Journal) Close() error {
+	pending := j.Pending()
+	if err := j.f.Close(); err != nil {
+		return err
+	}
+	if len(pending) == 0 {
+		return os.Remove(j.path)
+	}
+	return nil
+}
+
+// PendingEntries returns the backup and create entries that have no matching restore
+// or delete entry, in the order that they were recorded.
+func PendingEntries(entries []JournalEntry) []JournalEntry {
+	type key struct {
+		// the op that creates the pending change
+		op        JournalOp
+		namespace string
+		name      string
+	}
+	pending := map[key]int{}
+	for i, e := range entries {
+		switch e.Op {
+		case JournalBackupService:
+			k := key{e.Op, e.Namespace, e.Name}
+			// we only care about the first backup as that is the original service
+			if _, ok := pending[k]; !ok {
+				pending[k] = i
+			}
+		case JournalRestoreService:
+			delete(pending, key{JournalBackupService, e.Namespace, e.Name})
+		case JournalCreateEndpoints, JournalCreateEndpointSlice, JournalCreatePod:
+			pending[key{e.Op, e.Namespace, e.Name}] = i
+		case JournalDeleteEndpoints:
+			delete(pending, key{JournalCreateEndpoints, e.Namespace, e.Name})
+		case JournalDeleteEndpointSlice:
+			delete(pending, key{JournalCreateEndpointSlice, e.Namespace, e.Name})
+		case JournalDeletePod:
+			delete(pending, key{JournalCreatePod, e.Namespace, e.Name})
+		}
+	}
+
+	var idx []int
+	for _, i := range pending {
+		idx = append(idx, i)
+	}
+	sort.Ints(idx)
+	var ret []JournalEntry
+	for _, i := range idx {
+		ret = append(ret, entries[i])
+	}
+	return ret
+}
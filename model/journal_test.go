@@ -0,0 +1,190 @@
+package model
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPendingEntries(t *testing.T) {
+	entry := func(op JournalOp, name string) JournalEntry {
+		return JournalEntry{Op: op, Namespace: "default", Name: name}
+	}
+	tests := []struct {
+		name    string
+		entries []JournalEntry
+		want    []JournalEntry
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "everything undone",
+			entries: []JournalEntry{
+				entry(JournalBackupService, "a"),
+				entry(JournalCreateEndpoints, "a"),
+				entry(JournalCreatePod, "relay"),
+				entry(JournalDeletePod, "relay"),
+				entry(JournalDeleteEndpoints, "a"),
+				entry(JournalRestoreService, "a"),
+			},
+		},
+		{
+			name: "recording order is kept",
+			entries: []JournalEntry{
+				entry(JournalOpen, ""),
+				entry(JournalBackupService, "a"),
+				entry(JournalCreateEndpoints, "a"),
+				entry(JournalBackupService, "b"),
+				entry(JournalCreateEndpointSlice, "b"),
+				entry(JournalCreatePod, "relay"),
+			},
+			want: []JournalEntry{
+				entry(JournalBackupService, "a"),
+				entry(JournalCreateEndpoints, "a"),
+				entry(JournalBackupService, "b"),
+				entry(JournalCreateEndpointSlice, "b"),
+				entry(JournalCreatePod, "relay"),
+			},
+		},
+		{
+			name: "partially undone",
+			entries: []JournalEntry{
+				entry(JournalBackupService, "a"),
+				entry(JournalCreateEndpoints, "a"),
+				entry(JournalBackupService, "b"),
+				entry(JournalCreateEndpoints, "b"),
+				entry(JournalDeleteEndpoints, "b"),
+				entry(JournalRestoreService, "b"),
+			},
+			want: []JournalEntry{
+				entry(JournalBackupService, "a"),
+				entry(JournalCreateEndpoints, "a"),
+			},
+		},
+		{
+			name: "first backup is the original",
+			entries: []JournalEntry{
+				{Op: JournalBackupService, Namespace: "default", Name: "a", PID: 1},
+				{Op: JournalBackupService, Namespace: "default", Name: "a", PID: 2},
+			},
+			want: []JournalEntry{
+				{Op: JournalBackupService, Namespace: "default", Name: "a", PID: 1},
+			},
+		},
+		{
+			name: "recreated after delete",
+			entries: []JournalEntry{
+				entry(JournalCreateEndpoints, "a"),
+				entry(JournalCreatePod, "relay"),
+				entry(JournalDeleteEndpoints, "a"),
+				entry(JournalCreateEndpoints, "a"),
+			},
+			want: []JournalEntry{
+				entry(JournalCreatePod, "relay"),
+				entry(JournalCreateEndpoints, "a"),
+			},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := PendingEntries(tc.entries)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("PendingEntries() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestJournalRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.jsonl")
+	jrnl, err := OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %s", err)
+	}
+	for _, e := range []JournalEntry{
+		{Op: JournalCreateEndpoints, Namespace: "default", Name: "a"},
+		{Op: JournalCreatePod, Namespace: "default", Name: "relay"},
+	} {
+		if err = jrnl.Record(e); err != nil {
+			t.Fatalf("Record() error = %s", err)
+		}
+	}
+	if err = jrnl.Close(); err != nil {
+		t.Fatalf("Close() error = %s", err)
+	}
+
+	// simulate being killed in the middle of writing an entry
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = f.WriteString(`{"op":"delete-pod","name`)
+	f.Close()
+
+	jrnl, err = OpenJournal(path)
+	if err != nil {
+		t.Fatalf("OpenJournal() error = %s", err)
+	}
+	if got := len(jrnl.Pending()); got != 2 {
+		t.Errorf("expected 2 pending entries, got %d", got)
+	}
+	if err = jrnl.Record(JournalEntry{Op: JournalDeletePod, Namespace: "default", Name: "relay"}); err != nil {
+		t.Fatalf("Record() error = %s", err)
+	}
+	if err = jrnl.Record(JournalEntry{Op: JournalDeleteEndpoints, Namespace: "default", Name: "a"}); err != nil {
+		t.Fatalf("Record() error = %s", err)
+	}
+	if err = jrnl.Close(); err != nil {
+		t.Fatalf("Close() error = %s", err)
+	}
+	if _, err = os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected journal to be removed once everything was undone, got %v", err)
+	}
+}
+
+func TestJournalInUse(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, pid int) string {
+		path := filepath.Join(dir, name)
+		jrnl, err := OpenJournal(path)
+		if err != nil {
+			t.Fatalf("OpenJournal() error = %s", err)
+		}
+		if pid != 0 {
+			if err = jrnl.Record(JournalEntry{Op: JournalOpen, PID: pid}); err != nil {
+				t.Fatalf("Record() error = %s", err)
+			}
+		}
+		if err = jrnl.Record(JournalEntry{Op: JournalCreatePod, Namespace: "default", Name: "relay"}); err != nil {
+			t.Fatalf("Record() error = %s", err)
+		}
+		if err = jrnl.Close(); err != nil {
+			t.Fatalf("Close() error = %s", err)
+		}
+		return path
+	}
+
+	tests := []struct {
+		name string
+		path string
+		want int
+	}{
+		{"missing", filepath.Join(dir, "missing.jsonl"), 0},
+		{"no owner", write("none.jsonl", 0), 0},
+		{"ourselves", write("self.jsonl", os.Getpid()), 0},
+		{"running owner", write("parent.jsonl", os.Getppid()), os.Getppid()},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := JournalInUse(tc.path)
+			if err != nil {
+				t.Fatalf("JournalInUse() error = %s", err)
+			}
+			if got != tc.want {
+				t.Errorf("JournalInUse() = %d, want %d", got, tc.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// SessionInfo describes where the services of a running session can be reached so that it can be written
+// out for tools that aren't started by supplant.
+type SessionInfo struct {
+	Env        []EnvVar
+	Forwards   []ForwardMapping
+	Supplanted []SupplantMapping
+}
+
+// ForwardMapping is a local port that is forwarded to a service in the cluster.
+type ForwardMapping struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Name      string `json:"name,omitempty"`
+	Protocol  string `json:"protocol"`
+	// Port is the port in the cluster that is forwarded to
+	Port int32 `json:"port"`
+	// Local is the local address that is forwarded
+	Local string `json:"local"`
+}
+
+// SupplantMapping is a port of a supplanted service that now points to this machine.
+type SupplantMapping struct {
+	Namespace string `json:"namespace"`
+	Service   string `json:"service"`
+	Name      string `json:"name,omitempty"`
+	Protocol  string `json:"protocol"`
+	Port      int32  `json:"port"`
+	// Endpoint is the address that the cluster connects to
+	Endpoint string `json:"endpoint"`
+	// Local is the address that the replacement should listen on
+	Local string `json:"local"`
+}
+
+// AddForward records the ports forwarded to a service, reachable on host.
+func (s *SessionInfo) AddForward(namespace, svcName, host string, ports []EnvPort) {
+	for _, port := range ports {
+		s.Forwards = append(s.Forwards, ForwardMapping{
+			Namespace: namespace,
+			Service:   svcName,
+			Name:      port.Name,
+			Protocol:  string(NormalizeProtocol(port.Protocol)),
+			Port:      port.Port,
+			Local:     net.JoinHostPort(host, strconv.Itoa(int(port.Local))),
+		})
+	}
+	s.Env = append(s.Env, ServiceEnv(svcName, host, ports)...)
+}
+
+// AddSupplant records a supplanted service whose endpoints point to endpointIP.
+func (s *SessionInfo) AddSupplant(svc SupplantService, endpointIP net.IP) {
+	for _, port := range svc.Ports {
+		s.Supplanted = append(s.Supplanted, SupplantMapping{
+			Namespace: svc.Namespace,
+			Service:   svc.Name,
+			Name:      port.Name,
+			Protocol:  string(NormalizeProtocol(port.Protocol)),
+			Port:      port.Port,
+			Endpoint:  net.JoinHostPort(endpointIP.String(), strconv.Itoa(int(port.LocalPort))),
+			Local:     port.LocalAddress(),
+		})
+	}
+	s.Env = append(s.Env, SupplantEnv(svc)...)
+}
+
+// WriteDotenv writes the environment variables in the .env format read by docker-compose and most IDEs.
+func (s *SessionInfo) WriteDotenv(w io.Writer) error {
+	for _, e := range s.Env {
+		if _, err := fmt.Fprintf(w, "%s=%s\n", e.Name, e.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteShell writes the environment variables as a script of export statements that can be sourced.
+func (s *SessionInfo) WriteShell(w io.Writer) error {
+	for _, e := range s.Env {
+		value := "'" + strings.ReplaceAll(e.Value, "'", `'\''`) + "'"
+		if _, err := fmt.Fprintf(w, "export %s=%s\n", e.Name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON writes the forwarded and supplanted ports as JSON.
+func (s *SessionInfo) WriteJSON(w io.Writer) error {
+	out := struct {
+		Forwards   []ForwardMapping  `json:"forwards"`
+		Supplanted []SupplantMapping `json:"supplanted"`
+	}{
+		Forwards:   s.Forwards,
+		Supplanted: s.Supplanted,
+	}
+	if out.Forwards == nil {
+		out.Forwards = []ForwardMapping{}
+	}
+	if out.Supplanted == nil {
+		out.Supplanted = []SupplantMapping{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(out)
+}
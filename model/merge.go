@@ -0,0 +1,233 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+// LoadConfig strictly reads a configuration file and merges it on top of the configurations that it
+// extends.  The positions record the file and line that each entry of the merged configuration was last
+// changed in.
+func LoadConfig(path string) (*Config, *ConfigPositions, error) {
+	return loadConfig(path, map[string]bool{})
+}
+
+func loadConfig(path string, loading map[string]bool) (*Config, *ConfigPositions, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	if loading[abs] {
+		return nil, nil, fmt.Errorf("%s extends itself", path)
+	}
+	loading[abs] = true
+	defer delete(loading, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg, pos, err := ParseConfig(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", path, err)
+	}
+	pos.setFile(path)
+	if len(cfg.Extends) == 0 {
+		return cfg, pos, nil
+	}
+
+	// bases are merged in order, relative to the file that extends them, and then this file is merged on top
+	merged, mergedPos := Config{}, &ConfigPositions{}
+	for _, base := range cfg.Extends {
+		if !filepath.IsAbs(base) {
+			base = filepath.Join(filepath.Dir(path), base)
+		}
+		baseCfg, basePos, err := loadConfig(base, loading)
+		if err != nil {
+			return nil, nil, err
+		}
+		merged, mergedPos = mergeConfig(merged, *baseCfg, mergedPos, basePos)
+	}
+	merged, mergedPos = mergeConfig(merged, *cfg, mergedPos, pos)
+	return &merged, mergedPos, nil
+}
+
+// MergeConfig returns overlay merged on top of base.  Services are matched by namespace and name:
+//   - a service that is only in one of the configurations is kept as is
+//   - a service in both takes its enabled flag from overlay, and its mode if overlay sets one.  When
+//     configuration files are merged by LoadConfig, the enabled flag is only taken from an overlay entry that
+//     sets it, so that an entry that only changes a port doesn't disable the service.
+//   - ports are matched by name if they have one or by number and protocol otherwise, with the local port
+//     and local target from overlay replacing those of base if they are set, and new ports are added
+//
+// Profiles are matched by name with those from overlay replacing those of base, and the filter from
+// overlay replaces the filter of base if it has one.
+func MergeConfig(base, overlay Config) Config {
+	ret, _ := mergeConfig(base, overlay, nil, nil)
+	return ret
+}
+
+// mergeConfig merges overlay on top of base as MergeConfig does, along with the positions of each.  An
+// entry that is in both configurations takes its position from overlay since that's where it was last
+// changed.  If overlayPos is nil, every overlay entry sets its enabled flag.
+func mergeConfig(base, overlay Config, basePos, overlayPos *ConfigPositions) (Config, *ConfigPositions) {
+	ret := Config{
+		Filter:   base.Filter,
+		Profiles: map[string]Profile{},
+	}
+	retPos := &ConfigPositions{Profiles: map[string]Position{}}
+	if basePos != nil {
+		retPos.Filter = basePos.Filter
+	}
+	if overlay.Filter != nil {
+		ret.Filter = overlay.Filter
+		if overlayPos != nil {
+			retPos.Filter = overlayPos.Filter
+		}
+	}
+	for name, profile := range base.Profiles {
+		ret.Profiles[name] = profile
+		retPos.Profiles[name] = basePos.ProfilePosition(name)
+	}
+	for name, profile := range overlay.Profiles {
+		ret.Profiles[name] = profile
+		retPos.Profiles[name] = overlayPos.ProfilePosition(name)
+	}
+	if len(ret.Profiles) == 0 {
+		ret.Profiles = nil
+	}
+
+	ret.Supplant = append(ret.Supplant, copySupplant(base.Supplant)...)
+	for i := range base.Supplant {
+		retPos.Supplant = append(retPos.Supplant, copyEntryPosition(basePos.SupplantPosition, basePos.SupplantEnabledPosition, i, len(base.Supplant[i].Ports)))
+	}
+	for oi, svc := range overlay.Supplant {
+		i := indexOfService(len(ret.Supplant), func(i int) (string, string) {
+			return ret.Supplant[i].Namespace, ret.Supplant[i].Name
+		}, svc.Namespace, svc.Name)
+		if i == -1 {
+			ret.Supplant = append(ret.Supplant, copySupplant([]SupplantService{svc})...)
+			retPos.Supplant = append(retPos.Supplant, copyEntryPosition(overlayPos.SupplantPosition, overlayPos.SupplantEnabledPosition, oi, len(svc.Ports)))
+			continue
+		}
+		merged, mergedPos := &ret.Supplant[i], &retPos.Supplant[i]
+		if enabledAt := overlayPos.SupplantEnabledPosition(oi); overlayPos == nil || enabledAt.Line != 0 {
+			merged.Enabled = svc.Enabled
+			mergedPos.Enabled = enabledAt
+		}
+		mergedPos.Position = overlayPos.SupplantPosition(oi, -1)
+		for oj, port := range svc.Ports {
+			j := -1
+			for k, existing := range merged.Ports {
+				if samePort(existing.Name, existing.Port, existing.Protocol, port.Name, port.Port, port.Protocol) {
+					j = k
+					break
+				}
+			}
+			if j == -1 {
+				merged.Ports = append(merged.Ports, port)
+				mergedPos.Ports = append(mergedPos.Ports, overlayPos.SupplantPosition(oi, oj))
+				continue
+			}
+			if port.LocalPort != 0 {
+				merged.Ports[j].LocalPort = port.LocalPort
+			}
+			if port.LocalTarget != "" {
+				merged.Ports[j].LocalTarget = port.LocalTarget
+			}
+			mergedPos.Ports[j] = overlayPos.SupplantPosition(oi, oj)
+		}
+	}
+
+	ret.External = append(ret.External, copyExternal(base.External)...)
+	for i := range base.External {
+		retPos.External = append(retPos.External, copyEntryPosition(basePos.ExternalPosition, basePos.ExternalEnabledPosition, i, len(base.External[i].Ports)))
+	}
+	for oi, svc := range overlay.External {
+		i := indexOfService(len(ret.External), func(i int) (string, string) {
+			return ret.External[i].Namespace, ret.External[i].Name
+		}, svc.Namespace, svc.Name)
+		if i == -1 {
+			ret.External = append(ret.External, copyExternal([]ExternalService{svc})...)
+			retPos.External = append(retPos.External, copyEntryPosition(overlayPos.ExternalPosition, overlayPos.ExternalEnabledPosition, oi, len(svc.Ports)))
+			continue
+		}
+		merged, mergedPos := &ret.External[i], &retPos.External[i]
+		if enabledAt := overlayPos.ExternalEnabledPosition(oi); overlayPos == nil || enabledAt.Line != 0 {
+			merged.Enabled = svc.Enabled
+			mergedPos.Enabled = enabledAt
+		}
+		if svc.Mode != "" {
+			merged.Mode = svc.Mode
+		}
+		mergedPos.Position = overlayPos.ExternalPosition(oi, -1)
+		for oj, port := range svc.Ports {
+			j := -1
+			for k, existing := range merged.Ports {
+				if samePort(existing.Name, existing.TargetPort, existing.Protocol, port.Name, port.TargetPort, port.Protocol) {
+					j = k
+					break
+				}
+			}
+			if j == -1 {
+				merged.Ports = append(merged.Ports, port)
+				mergedPos.Ports = append(mergedPos.Ports, overlayPos.ExternalPosition(oi, oj))
+				continue
+			}
+			if port.LocalPort != 0 {
+				merged.Ports[j].LocalPort = port.LocalPort
+			}
+			mergedPos.Ports[j] = overlayPos.ExternalPosition(oi, oj)
+		}
+	}
+	return ret, retPos
+}
+
+// copyEntryPosition returns the position of an entry with n ports, which has a position for each port even
+// if the configuration wasn't read from a file.
+func copyEntryPosition(position func(entry, port int) Position, enabled func(entry int) Position, entry int, n int) EntryPosition {
+	ret := EntryPosition{Position: position(entry, -1), Enabled: enabled(entry)}
+	for j := 0; j < n; j++ {
+		ret.Ports = append(ret.Ports, position(entry, j))
+	}
+	return ret
+}
+
+func indexOfService(n int, entry func(i int) (string, string), namespace, name string) int {
+	for i := 0; i < n; i++ {
+		if ns, nm := entry(i); ns == namespace && nm == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// samePort returns true if two ports refer to the same service port.  Ports are matched by name if both
+// have one, and by number and protocol otherwise.
+func samePort(aName string, aPort int32, aProtocol v1.Protocol, bName string, bPort int32, bProtocol v1.Protocol) bool {
+	if aName != "" && bName != "" {
+		return aName == bName
+	}
+	return newPortKey("", "", aPort, aProtocol) == newPortKey("", "", bPort, bProtocol)
+}
+
+func copySupplant(svcs []SupplantService) []SupplantService {
+	var ret []SupplantService
+	for _, svc := range svcs {
+		svc.Ports = append([]SupplantPortConfig(nil), svc.Ports...)
+		ret = append(ret, svc)
+	}
+	return ret
+}
+
+func copyExternal(svcs []ExternalService) []ExternalService {
+	var ret []ExternalService
+	for _, svc := range svcs {
+		svc.Ports = append([]ExternalPortConfig(nil), svc.Ports...)
+		ret = append(ret, svc)
+	}
+	return ret
+}
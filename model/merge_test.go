@@ -0,0 +1,233 @@
+package model
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestMergeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    Config
+		overlay Config
+		want    Config
+	}{
+		{
+			name: "services only in one are kept",
+			base: Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop"}}},
+			overlay: Config{
+				Supplant: []SupplantService{{Name: "api", Namespace: "data"}},
+				External: []ExternalService{{Name: "db", Namespace: "data"}},
+			},
+			want: Config{
+				Supplant: []SupplantService{{Name: "api", Namespace: "shop"}, {Name: "api", Namespace: "data"}},
+				External: []ExternalService{{Name: "db", Namespace: "data"}},
+			},
+		},
+		{
+			name:    "overlay sets enabled even when disabling",
+			base:    Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop", Enabled: true}}},
+			overlay: Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop"}}},
+			want:    Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop"}}},
+		},
+		{
+			name: "ports are matched by name",
+			base: Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop",
+				Ports: []SupplantPortConfig{{Name: "http", Port: 80, LocalPort: 8080}}}}},
+			overlay: Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop", Enabled: true,
+				Ports: []SupplantPortConfig{{Name: "http", Port: 8000, LocalPort: 9000, LocalTarget: "127.0.0.2"}}}}},
+			want: Config{Supplant: []SupplantService{{Name: "api", Namespace: "shop", Enabled: true,
+				Ports: []SupplantPortConfig{{Name: "http", Port: 80, LocalPort: 9000, LocalTarget: "127.0.0.2"}}}}},
+		},
+		{
+			name: "unset local ports are kept",
+			base: Config{External: []ExternalService{{Name: "db", Namespace: "data", Mode: "pool",
+				Ports: []ExternalPortConfig{{TargetPort: 5432, LocalPort: 15432}}}}},
+			overlay: Config{External: []ExternalService{{Name: "db", Namespace: "data", Enabled: true,
+				Ports: []ExternalPortConfig{{TargetPort: 5432}}}}},
+			want: Config{External: []ExternalService{{Name: "db", Namespace: "data", Enabled: true, Mode: "pool",
+				Ports: []ExternalPortConfig{{TargetPort: 5432, LocalPort: 15432}}}}},
+		},
+		{
+			name: "ports with another protocol are added",
+			base: Config{External: []ExternalService{{Name: "dns", Namespace: "kube-system",
+				Ports: []ExternalPortConfig{{TargetPort: 53}}}}},
+			overlay: Config{External: []ExternalService{{Name: "dns", Namespace: "kube-system", Enabled: true,
+				Ports: []ExternalPortConfig{{TargetPort: 53, Protocol: v1.ProtocolUDP, LocalPort: 5353}}}}},
+			want: Config{External: []ExternalService{{Name: "dns", Namespace: "kube-system", Enabled: true,
+				Ports: []ExternalPortConfig{{TargetPort: 53}, {TargetPort: 53, Protocol: v1.ProtocolUDP, LocalPort: 5353}}}}},
+		},
+		{
+			name:    "profiles and filter",
+			base:    Config{Filter: &ServiceFilter{Selector: "a"}, Profiles: map[string]Profile{"x": {Supplant: []string{"a"}}, "y": {}}},
+			overlay: Config{Filter: &ServiceFilter{Selector: "b"}, Profiles: map[string]Profile{"x": {Supplant: []string{"b"}}}},
+			want:    Config{Filter: &ServiceFilter{Selector: "b"}, Profiles: map[string]Profile{"x": {Supplant: []string{"b"}}, "y": {}}},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := MergeConfig(tc.base, tc.overlay)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("MergeConfig() = %+v, want %+v", got, tc.want)
+			}
+		})
+	}
+}
+
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadConfigExtends(t *testing.T) {
+	tests := []struct {
+		name    string
+		files   map[string]string
+		wantErr string
+		want    []string
+	}{
+		{
+			name: "bases are relative and merged in order",
+			files: map[string]string{
+				"base/a.yml": "supplant:\n- name: api\n  namespace: shop\n  ports:\n  - port: 80\n    localport: 1\n",
+				"base/b.yml": "extends: [a.yml]\nsupplant:\n- name: api\n  namespace: shop\n  ports:\n  - port: 80\n    localport: 2\n",
+				"c.yml":      "supplant:\n- name: api\n  namespace: shop\n  ports:\n  - port: 80\n    localport: 3\n",
+				"main.yml":   "extends: [c.yml, base/b.yml]\nsupplant:\n- name: api\n  namespace: shop\n  enabled: true\n",
+			},
+			want: []string{"shop/api true 80:2"},
+		},
+		{
+			name: "enabled is kept unless the overlay sets it",
+			files: map[string]string{
+				"base.yml": "supplant:\n- name: api\n  namespace: shop\n  enabled: true\n  ports:\n  - port: 80\n    localport: 1\n" +
+					"- name: web\n  namespace: shop\n  enabled: true\n",
+				"main.yml": "extends: [base.yml]\nsupplant:\n- name: api\n  namespace: shop\n  ports:\n  - port: 80\n    localport: 2\n" +
+					"- name: web\n  namespace: shop\n  enabled: false\n",
+			},
+			want: []string{"shop/api true 80:2", "shop/web"},
+		},
+		{
+			name: "cycle",
+			files: map[string]string{
+				"main.yml":  "extends: [other.yml]\n",
+				"other.yml": "extends: [main.yml]\n",
+			},
+			wantErr: "extends itself",
+		},
+		{
+			name: "missing base",
+			files: map[string]string{
+				"main.yml": "extends: [missing.yml]\n",
+			},
+			wantErr: "missing.yml",
+		},
+		{
+			name: "unknown key in a base",
+			files: map[string]string{
+				"base.yml": "supplnt: []\n",
+				"main.yml": "extends: [base.yml]\n",
+			},
+			wantErr: "base.yml",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writeConfigFiles(t, tc.files)
+			cfg, _, err := LoadConfig(filepath.Join(dir, "main.yml"))
+			if tc.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tc.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadConfig() error = %s", err)
+			}
+			var got []string
+			for _, svc := range cfg.Supplant {
+				s := svc.Namespace + "/" + svc.Name
+				if svc.Enabled {
+					s += " true"
+				}
+				for _, port := range svc.Ports {
+					s += fmt.Sprintf(" %d:%d", port.Port, port.LocalPort)
+				}
+				got = append(got, s)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("LoadConfig() = %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPositions(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"base.yml": `supplant:
+- name: api
+  namespace: shop
+  ports:
+  - port: 80
+  - port: 81
+external:
+- name: db
+  namespace: data
+  ports:
+  - targetport: 5432
+    localport: 8080
+`,
+		"main.yml": `extends: [base.yml]
+supplant:
+- name: api
+  namespace: shop
+  enabled: true
+  ports:
+  - port: 81
+    localport: 8080
+- name: web
+  namespace: shop
+  enabled: true
+`,
+	})
+	base, main := filepath.Join(dir, "base.yml"), filepath.Join(dir, "main.yml")
+	cfg, pos, err := LoadConfig(main)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.External[0].Enabled = true
+
+	want := []EntryPosition{
+		{Position: Position{main, 3}, Ports: []Position{{base, 5}, {main, 7}}, Enabled: Position{main, 5}},
+		{Position: Position{main, 9}, Enabled: Position{main, 11}},
+	}
+	if !reflect.DeepEqual(pos.Supplant, want) {
+		t.Errorf("expected supplant positions %v, got %v", want, pos.Supplant)
+	}
+
+	// errors are reported against the file that they come from
+	errs := ValidateConfig(cfg, pos, nil, false)
+	if len(errs) != 2 {
+		t.Fatalf("expected two errors, got %v", errs)
+	}
+	if got := errs[0].Error(); !strings.HasPrefix(got, base+":11: local port 8080") || !strings.Contains(got, "on "+main+":7") {
+		t.Errorf("unexpected error %s", got)
+	}
+	if got := errs[1].Error(); got != main+":9: supplant entry web has no ports" {
+		t.Errorf("unexpected error %s", got)
+	}
+}
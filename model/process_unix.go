@@ -0,0 +1,21 @@
+//go:build !windows
+// +build !windows
+
+package model
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// processAlive returns true if a process with the given ID is running.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// signal 0 only checks for existence, EPERM means it exists but belongs to someone else
+	err = p.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
@@ -0,0 +1,114 @@
+package model
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Profile is a named set of services to supplant and forward, chosen from the services listed in a
+// configuration.  Services are referred to by name, or by namespace/name if the name alone is ambiguous.
+type Profile struct {
+	Supplant []string `yaml:"supplant,omitempty"`
+	External []string `yaml:"external,omitempty"`
+}
+
+// ProfileNames returns the names of the profiles in a configuration in sorted order.
+func (c *Config) ProfileNames() []string {
+	var names []string
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ApplyProfile enables the services referred to by the named profile and disables every other service.
+func (c *Config) ApplyProfile(name string) error {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		if len(c.Profiles) == 0 {
+			return fmt.Errorf("profile %s not found, the configuration has no profiles", name)
+		}
+		return fmt.Errorf("profile %s not found, must be one of %s", name, strings.Join(c.ProfileNames(), ", "))
+	}
+	supplant, external, err := c.resolveProfile(profile)
+	if err != nil {
+		return fmt.Errorf("profile %s: %w", name, err)
+	}
+	for i := range c.Supplant {
+		c.Supplant[i].Enabled = supplant[i]
+	}
+	for i := range c.External {
+		c.External[i].Enabled = external[i]
+	}
+	return nil
+}
+
+// InAnyProfile returns the supplant and external entries that are referred to by at least one profile.
+// References that can't be resolved are ignored.
+func (c *Config) InAnyProfile() (supplant map[int]bool, external map[int]bool) {
+	supplant = map[int]bool{}
+	external = map[int]bool{}
+	for _, profile := range c.Profiles {
+		for _, ref := range profile.Supplant {
+			if i, err := findRef(ref, len(c.Supplant), func(i int) (string, string) {
+				return c.Supplant[i].Namespace, c.Supplant[i].Name
+			}); err == nil {
+				supplant[i] = true
+			}
+		}
+		for _, ref := range profile.External {
+			if i, err := findRef(ref, len(c.External), func(i int) (string, string) {
+				return c.External[i].Namespace, c.External[i].Name
+			}); err == nil {
+				external[i] = true
+			}
+		}
+	}
+	return supplant, external
+}
+
+// resolveProfile returns the index of each supplant and external entry that the profile refers to.
+func (c *Config) resolveProfile(profile Profile) (map[int]bool, map[int]bool, error) {
+	supplant := map[int]bool{}
+	for _, ref := range profile.Supplant {
+		i, err := findRef(ref, len(c.Supplant), func(i int) (string, string) {
+			return c.Supplant[i].Namespace, c.Supplant[i].Name
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("supplant %w", err)
+		}
+		supplant[i] = true
+	}
+	external := map[int]bool{}
+	for _, ref := range profile.External {
+		i, err := findRef(ref, len(c.External), func(i int) (string, string) {
+			return c.External[i].Namespace, c.External[i].Name
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("external %w", err)
+		}
+		external[i] = true
+	}
+	return supplant, external, nil
+}
+
+// findRef finds the single entry that a name or namespace/name reference refers to.
+func findRef(ref string, n int, entry func(i int) (namespace string, name string)) (int, error) {
+	found := -1
+	for i := 0; i < n; i++ {
+		namespace, name := entry(i)
+		if ref != name && ref != namespace+"/"+name {
+			continue
+		}
+		if found != -1 {
+			return 0, fmt.Errorf("service %s is ambiguous, use namespace/name", ref)
+		}
+		found = i
+	}
+	if found == -1 {
+		return 0, fmt.Errorf("service %s not found", ref)
+	}
+	return found, nil
+}
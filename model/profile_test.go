@@ -0,0 +1,148 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func profileConfig() Config {
+	return Config{
+		Supplant: []SupplantService{
+			{Name: "api", Namespace: "shop", Enabled: true},
+			{Name: "web", Namespace: "shop"},
+			{Name: "web", Namespace: "blog"},
+		},
+		External: []ExternalService{
+			{Name: "db", Namespace: "data", Enabled: true},
+			{Name: "cache", Namespace: "data"},
+		},
+		Profiles: map[string]Profile{
+			"frontend":  {Supplant: []string{"shop/web", "blog/web"}, External: []string{"db"}},
+			"api":       {Supplant: []string{"api"}},
+			"ambiguous": {Supplant: []string{"web"}},
+			"missing":   {External: []string{"queue"}},
+		},
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	tests := []struct {
+		profile      string
+		wantSupplant []bool
+		wantExternal []bool
+		wantErr      string
+	}{
+		{profile: "frontend", wantSupplant: []bool{false, true, true}, wantExternal: []bool{true, false}},
+		{profile: "api", wantSupplant: []bool{true, false, false}, wantExternal: []bool{false, false}},
+		{profile: "ambiguous", wantErr: "profile ambiguous: supplant service web is ambiguous, use namespace/name"},
+		{profile: "missing", wantErr: "profile missing: external service queue not found"},
+		{profile: "other", wantErr: "profile other not found, must be one of ambiguous, api, frontend, missing"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.profile, func(t *testing.T) {
+			cfg := profileConfig()
+			err := cfg.ApplyProfile(tc.profile)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Fatalf("expected error %q, got %v", tc.wantErr, err)
+				}
+				// nothing is changed when the profile can't be applied
+				if !reflect.DeepEqual(cfg, profileConfig()) {
+					t.Errorf("expected the config to be unchanged")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("ApplyProfile() error = %s", err)
+			}
+			var supplant, external []bool
+			for _, svc := range cfg.Supplant {
+				supplant = append(supplant, svc.Enabled)
+			}
+			for _, svc := range cfg.External {
+				external = append(external, svc.Enabled)
+			}
+			if !reflect.DeepEqual(supplant, tc.wantSupplant) || !reflect.DeepEqual(external, tc.wantExternal) {
+				t.Errorf("enabled supplant %v and external %v, want %v and %v", supplant, external, tc.wantSupplant, tc.wantExternal)
+			}
+		})
+	}
+
+	var empty Config
+	if err := empty.ApplyProfile("x"); err == nil || !strings.Contains(err.Error(), "has no profiles") {
+		t.Errorf("expected an error about having no profiles, got %v", err)
+	}
+}
+
+func TestFindRef(t *testing.T) {
+	entries := [][2]string{{"shop", "web"}, {"blog", "web"}, {"shop", "api"}}
+	entry := func(i int) (string, string) { return entries[i][0], entries[i][1] }
+	tests := []struct {
+		ref     string
+		want    int
+		wantErr string
+	}{
+		{ref: "api", want: 2},
+		{ref: "blog/web", want: 1},
+		{ref: "web", wantErr: "service web is ambiguous, use namespace/name"},
+		{ref: "shop/api", want: 2},
+		{ref: "data/web", wantErr: "service data/web not found"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.ref, func(t *testing.T) {
+			got, err := findRef(tc.ref, len(entries), entry)
+			if tc.wantErr != "" {
+				if err == nil || err.Error() != tc.wantErr {
+					t.Errorf("findRef(%q) error = %v, want %q", tc.ref, err, tc.wantErr)
+				}
+				return
+			}
+			if err != nil || got != tc.want {
+				t.Errorf("findRef(%q) = %d, %v, want %d", tc.ref, got, err, tc.want)
+			}
+		})
+	}
+}
+
+func TestInAnyProfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		profiles     map[string]Profile
+		wantSupplant map[int]bool
+		wantExternal map[int]bool
+	}{
+		{
+			name:         "no profiles",
+			wantSupplant: map[int]bool{},
+			wantExternal: map[int]bool{},
+		},
+		{
+			name: "every profile counts",
+			profiles: map[string]Profile{
+				"a": {Supplant: []string{"api"}},
+				"b": {Supplant: []string{"blog/web"}, External: []string{"cache"}},
+			},
+			wantSupplant: map[int]bool{0: true, 2: true},
+			wantExternal: map[int]bool{1: true},
+		},
+		{
+			name: "unresolved references are skipped, the rest are kept",
+			profiles: map[string]Profile{
+				"a": {Supplant: []string{"web", "shop/web", "missing"}, External: []string{"data/db"}},
+			},
+			wantSupplant: map[int]bool{1: true},
+			wantExternal: map[int]bool{0: true},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := profileConfig()
+			cfg.Profiles = tc.profiles
+			supplant, external := cfg.InAnyProfile()
+			if !reflect.DeepEqual(supplant, tc.wantSupplant) || !reflect.DeepEqual(external, tc.wantExternal) {
+				t.Errorf("InAnyProfile() = %v, %v, want %v, %v", supplant, external, tc.wantSupplant, tc.wantExternal)
+			}
+		})
+	}
+}
@@ -0,0 +1,411 @@
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+// MissingComment marks entries in a configuration that were not found in the cluster by UpdateConfig.
+const MissingComment = "# not found in the cluster"
+
+// ConfigUpdate describes how to re-sync a configuration with the services in a cluster.
+type ConfigUpdate struct {
+	// Current is the configuration generated from every service that was listed from the cluster
+	Current Config
+	// Add returns true if a service that isn't in the configuration should be added to it
+	Add func(namespace, name string) bool
+	// InScope returns true if services in the namespace were listed, entries in other namespaces are left alone
+	InScope func(namespace string) bool
+	// Prune removes entries that no longer exist instead of marking them with MissingComment
+	Prune bool
+}
+
+// UpdateChange is a change made to a configuration by UpdateConfig.
+type UpdateChange struct {
+	Section   string
+	Namespace string
+	Name      string
+	// Port is the port (or target port for external services) that changed, or zero if the whole service did
+	Port int32
+	// PortName is the name of the port that changed if it has one
+	PortName string
+	Action   string
+}
+
+func (c UpdateChange) String() string {
+	if c.Name == "" {
+		return fmt.Sprintf("%s %s", c.Action, c.Section)
+	}
+	if c.PortName != "" {
+		return fmt.Sprintf("%s %s port %s on %s/%s", c.Action, c.Section, c.PortName, c.Namespace, c.Name)
+	}
+	if c.Port == 0 {
+		return fmt.Sprintf("%s %s service %s/%s", c.Action, c.Section, c.Namespace, c.Name)
+	}
+	return fmt.Sprintf("%s %s port %d on %s/%s", c.Action, c.Section, c.Port, c.Namespace, c.Name)
+}
+
+const (
+	UpdateAdded   = "added"
+	UpdateMissing = "marked missing"
+	UpdatePruned  = "pruned"
+	// UpdateRenumbered is a named port whose number changed
+	UpdateRenumbered = "renumbered"
+)
+
+// UpdateConfig updates a parsed configuration document in place so that it matches the cluster. New
+// services and ports are added disabled and entries that no longer exist are marked or pruned. Everything
+// else in the document, including comments and the enabled flags and local ports, is kept.
+func UpdateConfig(doc *yaml.Node, u ConfigUpdate) ([]UpdateChange, error) {
+	if doc.Kind == 0 {
+		// an empty file
+		doc.Kind = yaml.DocumentNode
+	}
+	if doc.Kind != yaml.DocumentNode {
+		return nil, fmt.Errorf("expected a yaml document")
+	}
+	if len(doc.Content) == 0 {
+		doc.Content = append(doc.Content, &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"})
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected a mapping", root.Line)
+	}
+
+	var supplant []sectionEntry
+	for _, svc := range u.Current.Supplant {
+		e := sectionEntry{namespace: svc.Namespace, name: svc.Name, value: svc}
+		for _, p := range svc.Ports {
+			e.ports = append(e.ports, portEntry{key: newPortKey(p.Name, "", p.Port, p.Protocol), number: p.Port, value: p})
+		}
+		supplant = append(supplant, e)
+	}
+	var external []sectionEntry
+	for _, svc := range u.Current.External {
+		e := sectionEntry{namespace: svc.Namespace, name: svc.Name, value: svc}
+		for _, p := range svc.Ports {
+			e.ports = append(e.ports, portEntry{key: newPortKey(p.Name, p.TargetPortName, p.TargetPort, p.Protocol), number: p.TargetPort, value: p})
+		}
+		external = append(external, e)
+	}
+
+	var changes []UpdateChange
+	for _, section := range []struct {
+		name    string
+		portKey string
+		entries []sectionEntry
+	}{
+		{"supplant", "port", supplant},
+		{"external", "targetport", external},
+	} {
+		seq := mappingValue(root, section.name)
+		if seq == nil {
+			root.Content = append(root.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: section.name},
+				&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"})
+			seq = root.Content[len(root.Content)-1]
+		}
+		if seq.Kind == yaml.ScalarNode && seq.Tag == "!!null" {
+			// 'supplant:' with nothing after it
+			*seq = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		}
+		if seq.Kind != yaml.SequenceNode {
+			return nil, fmt.Errorf("line %d: expected %s to be a list", seq.Line, section.name)
+		}
+		sc, err := updateSection(seq, section.name, section.portKey, section.entries, u)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, sc...)
+	}
+	return changes, nil
+}
+
+// SetFilter replaces the filter in a parsed configuration document.
+func SetFilter(doc *yaml.Node, filter ServiceFilter) error {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping")
+	}
+	root := doc.Content[0]
+	node := &yaml.Node{}
+	if err := node.Encode(filter); err != nil {
+		return err
+	}
+	if existing := mappingValue(root, "filter"); existing != nil {
+		node.HeadComment = existing.HeadComment
+		*existing = *node
+		return nil
+	}
+	root.Content = append(root.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "filter"}, node)
+	return nil
+}
+
+// SetChoices updates the enabled flags and local ports in a parsed configuration document to match cfg,
+// which must have been decoded from the same document.  Everything else in the document is kept.
+func SetChoices(doc *yaml.Node, cfg Config) error {
+	if len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return fmt.Errorf("expected a mapping")
+	}
+	root := doc.Content[0]
+	if seq := mappingValue(root, "supplant"); seq != nil && seq.Kind == yaml.SequenceNode {
+		if len(seq.Content) != len(cfg.Supplant) {
+			return fmt.Errorf("expected %d supplant entries, found %d", len(cfg.Supplant), len(seq.Content))
+		}
+		for i, item := range seq.Content {
+			setScalar(item, "enabled", "!!bool", strconv.FormatBool(cfg.Supplant[i].Enabled))
+			if ports := mappingValue(item, "ports"); ports != nil && ports.Kind == yaml.SequenceNode {
+				for j, port := range ports.Content {
+					if j < len(cfg.Supplant[i].Ports) {
+						setScalar(port, "localport", "!!int", strconv.Itoa(int(cfg.Supplant[i].Ports[j].LocalPort)))
+					}
+				}
+			}
+		}
+	}
+	if seq := mappingValue(root, "external"); seq != nil && seq.Kind == yaml.SequenceNode {
+		if len(seq.Content) != len(cfg.External) {
+			return fmt.Errorf("expected %d external entries, found %d", len(cfg.External), len(seq.Content))
+		}
+		for i, item := range seq.Content {
+			setScalar(item, "enabled", "!!bool", strconv.FormatBool(cfg.External[i].Enabled))
+			if ports := mappingValue(item, "ports"); ports != nil && ports.Kind == yaml.SequenceNode {
+				for j, port := range ports.Content {
+					if j < len(cfg.External[i].Ports) {
+						setScalar(port, "localport", "!!int", strconv.Itoa(int(cfg.External[i].Ports[j].LocalPort)))
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// setScalar sets the value of a key in a mapping node, adding the key if it doesn't exist.
+func setScalar(node *yaml.Node, key string, tag string, value string) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	if v := mappingValue(node, key); v != nil {
+		v.Kind = yaml.ScalarNode
+		v.Tag = tag
+		v.Value = value
+		v.Style = 0
+		return
+	}
+	node.Content = append(node.Content,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: value})
+}
+
+type sectionEntry struct {
+	namespace string
+	name      string
+	value     interface{}
+	ports     []portEntry
+}
+
+type portEntry struct {
+	key portKey
+	// number is the current port number, which may have changed for a named port and is negative if a
+	// named target port couldn't be found on any pod
+	number int32
+	value  interface{}
+}
+
+// portKey identifies a port by the name of the service port if it has one, or by the name of the container
+// port it targets, so that a renumbered port is still the same port, or by number otherwise.
+type portKey struct {
+	name     string
+	target   string
+	port     int32
+	protocol v1.Protocol
+}
+
+func newPortKey(name string, target string, port int32, protocol v1.Protocol) portKey {
+	protocol = NormalizeProtocol(protocol)
+	if name != "" {
+		target = ""
+	}
+	if name != "" || target != "" {
+		port = 0
+	}
+	return portKey{name, target, port, protocol}
+}
+
+// named returns true if the port is identified by name rather than by number.
+func (k portKey) named() bool {
+	return k.name != "" || k.target != ""
+}
+
+// change returns an UpdateChange for the port.
+func (k portKey) change(section string, e sectionEntry, action string) UpdateChange {
+	name := k.name
+	if name == "" {
+		name = k.target
+	}
+	return UpdateChange{Section: section, Namespace: e.namespace, Name: e.name, Port: k.port, PortName: name, Action: action}
+}
+
+func updateSection(seq *yaml.Node, section string, portField string, entries []sectionEntry, u ConfigUpdate) ([]UpdateChange, error) {
+	var changes []UpdateChange
+	type svcKey struct {
+		namespace string
+		name      string
+	}
+	current := map[svcKey]sectionEntry{}
+	for _, e := range entries {
+		current[svcKey{e.namespace, e.name}] = e
+	}
+
+	seen := map[svcKey]bool{}
+	var kept []*yaml.Node
+	for _, item := range seq.Content {
+		key := svcKey{scalarValue(item, "namespace"), scalarValue(item, "name")}
+		if u.InScope != nil && !u.InScope(key.namespace) {
+			kept = append(kept, item)
+			continue
+		}
+		seen[key] = true
+		e, ok := current[key]
+		if !ok {
+			if u.Prune {
+				changes = append(changes, UpdateChange{Section: section, Namespace: key.namespace, Name: key.name, Action: UpdatePruned})
+				continue
+			}
+			if markMissing(item, "name") {
+				changes = append(changes, UpdateChange{Section: section, Namespace: key.namespace, Name: key.name, Action: UpdateMissing})
+			}
+			kept = append(kept, item)
+			continue
+		}
+		clearMissing(item, "name")
+		pc, err := updatePorts(item, section, portField, e, u)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, pc...)
+		kept = append(kept, item)
+	}
+
+	for _, e := range entries {
+		key := svcKey{e.namespace, e.name}
+		if seen[key] || (u.Add != nil && !u.Add(e.namespace, e.name)) {
+			continue
+		}
+		node := &yaml.Node{}
+		if err := node.Encode(e.value); err != nil {
+			return nil, err
+		}
+		kept = append(kept, node)
+		changes = append(changes, UpdateChange{Section: section, Namespace: e.namespace, Name: e.name, Action: UpdateAdded})
+	}
+	seq.Content = kept
+	return changes, nil
+}
+
+func updatePorts(item *yaml.Node, section string, portField string, e sectionEntry, u ConfigUpdate) ([]UpdateChange, error) {
+	var changes []UpdateChange
+	ports := mappingValue(item, "ports")
+	if ports == nil {
+		item.Content = append(item.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "ports"},
+			&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"})
+		ports = item.Content[len(item.Content)-1]
+	}
+	if ports.Kind == yaml.ScalarNode && ports.Tag == "!!null" {
+		*ports = yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	}
+	if ports.Kind != yaml.SequenceNode {
+		return nil, fmt.Errorf("line %d: expected ports to be a list", ports.Line)
+	}
+
+	current := map[portKey]portEntry{}
+	for _, p := range e.ports {
+		current[p.key] = p
+	}
+	seen := map[portKey]bool{}
+	var kept []*yaml.Node
+	for _, port := range ports.Content {
+		name := scalarValue(port, "name")
+		target := scalarValue(port, "targetportname")
+		var number int64
+		if name == "" && target == "" {
+			var err error
+			number, err = strconv.ParseInt(scalarValue(port, portField), 10, 32)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid %s: %s", port.Line, portField, err)
+			}
+		}
+		key := newPortKey(name, target, int32(number), v1.Protocol(scalarValue(port, "protocol")))
+		seen[key] = true
+		if cur, ok := current[key]; ok {
+			clearMissing(port, portField)
+			// a named port may have been renumbered, but a named target port that can't be found on any
+			// pod keeps the number it had
+			if key.named() && cur.number >= 0 && scalarValue(port, portField) != strconv.Itoa(int(cur.number)) {
+				setScalar(port, portField, "!!int", strconv.Itoa(int(cur.number)))
+				changes = append(changes, key.change(section, e, UpdateRenumbered))
+			}
+			kept = append(kept, port)
+			continue
+		}
+		if u.Prune {
+			changes = append(changes, key.change(section, e, UpdatePruned))
+			continue
+		}
+		if markMissing(port, portField) {
+			changes = append(changes, key.change(section, e, UpdateMissing))
+		}
+		kept = append(kept, port)
+	}
+
+	for _, p := range e.ports {
+		// a port whose number isn't known is added once it can be found
+		if seen[p.key] || p.number < 0 {
+			continue
+		}
+		node := &yaml.Node{}
+		if err := node.Encode(p.value); err != nil {
+			return nil, err
+		}
+		kept = append(kept, node)
+		changes = append(changes, p.key.change(section, e, UpdateAdded))
+	}
+	ports.Content = kept
+	return changes, nil
+}
+
+// scalarValue returns the value of a scalar key in a mapping node, or an empty string if it isn't found.
+func scalarValue(node *yaml.Node, key string) string {
+	v := mappingValue(node, key)
+	if v == nil || v.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return v.Value
+}
+
+// markMissing adds MissingComment to the value of key, returning true if it wasn't already marked.  Any
+// comment the user had there is kept.
+func markMissing(node *yaml.Node, key string) bool {
+	v := mappingValue(node, key)
+	if v == nil || strings.HasSuffix(v.LineComment, MissingComment) {
+		return false
+	}
+	if v.LineComment == "" {
+		v.LineComment = MissingComment
+	} else {
+		v.LineComment += " " + MissingComment
+	}
+	return true
+}
+
+// clearMissing removes MissingComment from the value of key if a previous update added it.
+func clearMissing(node *yaml.Node, key string) {
+	if v := mappingValue(node, key); v != nil && strings.HasSuffix(v.LineComment, MissingComment) {
+		v.LineComment = strings.TrimSpace(strings.TrimSuffix(v.LineComment, MissingComment))
+	}
+}
@@ -0,0 +1,171 @@
+package model
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestUpdateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		doc     string
+		current Config
+		prune   bool
+		want    []string
+		// contains and excludes are checked against the updated document
+		contains []string
+		excludes []string
+	}{
+		{
+			name: "unchanged",
+			doc: `supplant:
+- name: api
+  namespace: default
+  enabled: true
+  ports:
+  - port: 80
+    localport: 8080
+`,
+			current: Config{Supplant: []SupplantService{{Name: "api", Namespace: "default",
+				Ports: []SupplantPortConfig{{Port: 80}}}}},
+			contains: []string{"enabled: true", "localport: 8080"},
+		},
+		{
+			name: "added and missing",
+			doc: `external:
+- name: old
+  namespace: default
+  ports:
+  - targetport: 80
+`,
+			current: Config{External: []ExternalService{{Name: "new", Namespace: "default",
+				Ports: []ExternalPortConfig{{TargetPort: 80}}}}},
+			want:     []string{"marked missing external service default/old", "added external service default/new"},
+			contains: []string{"name: old " + MissingComment, "name: new"},
+		},
+		{
+			name: "pruned",
+			doc: `external:
+- name: old
+  namespace: default
+  ports:
+  - targetport: 80
+`,
+			prune:    true,
+			want:     []string{"pruned external service default/old"},
+			excludes: []string{"old"},
+		},
+		{
+			name: "renumbered named port",
+			doc: `supplant:
+- name: api
+  namespace: default
+  ports:
+  - name: http
+    port: 80
+`,
+			current: Config{Supplant: []SupplantService{{Name: "api", Namespace: "default",
+				Ports: []SupplantPortConfig{{Name: "http", Port: 8000}}}}},
+			want:     []string{"renumbered supplant port http on default/api"},
+			contains: []string{"port: 8000"},
+		},
+		{
+			name: "renumbered named target port",
+			doc: `external:
+- name: api
+  namespace: default
+  ports:
+  - targetport: 8080
+    targetportname: web
+`,
+			current: Config{External: []ExternalService{{Name: "api", Namespace: "default",
+				Ports: []ExternalPortConfig{{TargetPort: 9090, TargetPortName: "web"}}}}},
+			want:     []string{"renumbered external port web on default/api"},
+			contains: []string{"targetport: 9090"},
+		},
+		{
+			name: "named target port without pods is kept",
+			doc: `external:
+- name: api
+  namespace: default
+  ports:
+  - targetport: 8080
+    targetportname: web
+`,
+			current: Config{External: []ExternalService{{Name: "api", Namespace: "default",
+				Ports: []ExternalPortConfig{{TargetPort: -1, TargetPortName: "web"}}}}},
+			contains: []string{"targetport: 8080"},
+			excludes: []string{MissingComment, "-1"},
+		},
+		{
+			name: "new named target port without pods isn't added",
+			doc: `external:
+- name: api
+  namespace: default
+  ports: []
+`,
+			current: Config{External: []ExternalService{{Name: "api", Namespace: "default",
+				Ports: []ExternalPortConfig{{TargetPort: -1, TargetPortName: "web"}}}}},
+			excludes: []string{"web"},
+		},
+		{
+			name: "protocols are distinct",
+			doc: `external:
+- name: dns
+  namespace: default
+  ports:
+  - targetport: 53
+`,
+			current: Config{External: []ExternalService{{Name: "dns", Namespace: "default",
+				Ports: []ExternalPortConfig{{TargetPort: 53, Protocol: v1.ProtocolUDP}}}}},
+			want: []string{"marked missing external port 53 on default/dns", "added external port 53 on default/dns"},
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(tc.doc), &doc); err != nil {
+				t.Fatal(err)
+			}
+			changes, err := UpdateConfig(&doc, ConfigUpdate{Current: tc.current, Prune: tc.prune})
+			if err != nil {
+				t.Fatalf("UpdateConfig() error = %s", err)
+			}
+			var got []string
+			for _, c := range changes {
+				got = append(got, c.String())
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("UpdateConfig() changes = %q, want %q", got, tc.want)
+			}
+
+			out, err := yaml.Marshal(&doc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, s := range tc.contains {
+				if !strings.Contains(string(out), s) {
+					t.Errorf("expected updated config to contain %q:\n%s", s, out)
+				}
+			}
+			for _, s := range tc.excludes {
+				if strings.Contains(string(out), s) {
+					t.Errorf("expected updated config not to contain %q:\n%s", s, out)
+				}
+			}
+
+			// updating again with the same cluster doesn't change anything
+			changes, err = UpdateConfig(&doc, ConfigUpdate{Current: tc.current, Prune: tc.prune})
+			if err != nil {
+				t.Fatalf("UpdateConfig() error = %s", err)
+			}
+			if len(changes) != 0 {
+				t.Errorf("expected a second update to make no changes, got %v", changes)
+			}
+		})
+	}
+}
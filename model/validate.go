@@ -0,0 +1,407 @@
+package model
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+
+	"gopkg.in/yaml.v3"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	// RelayTunnelPort is the port that relay pods accept tunnels from supplant on
+	RelayTunnelPort = 17000
+	// RelayUDPForwardPort is the first of the ports that relay pods accept streams of datagrams on, one for
+	// each UDP port of a forwarded service
+	RelayUDPForwardPort = 17001
+)
+
+// ValidationError is a problem found with a configuration file.
+type ValidationError struct {
+	// Position is where the problem was found, or the zero position if unknown
+	Position
+	Message string
+}
+
+func (e ValidationError) Error() string {
+	if e.Position == (Position{}) {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s", e.Position, e.Message)
+}
+
+// Position is the file and line that part of a configuration was read from.  The file is empty when the
+// configuration wasn't read by LoadConfig.
+type Position struct {
+	File string
+	Line int
+}
+
+func (p Position) String() string {
+	switch {
+	case p.Line == 0:
+		return p.File
+	case p.File == "":
+		return fmt.Sprintf("line %d", p.Line)
+	}
+	return fmt.Sprintf("%s:%d", p.File, p.Line)
+}
+
+// before orders positions by file and then by line.
+func (p Position) before(o Position) bool {
+	if p.File != o.File {
+		return p.File < o.File
+	}
+	return p.Line < o.Line
+}
+
+// ConfigPositions records where each service and port of a configuration was read from.
+type ConfigPositions struct {
+	Supplant []EntryPosition
+	External []EntryPosition
+	Profiles map[string]Position
+	Filter   Position
+}
+
+// EntryPosition is the position of a service entry and each of its ports.
+type EntryPosition struct {
+	Position
+	Ports []Position
+	// Enabled is the position of the entry's enabled key, or the zero position if the entry doesn't set it
+	Enabled Position
+}
+
+func entryPosition(entries []EntryPosition, entry int, port int) Position {
+	if entry >= len(entries) {
+		return Position{}
+	}
+	if port >= 0 && port < len(entries[entry].Ports) {
+		return entries[entry].Ports[port]
+	}
+	return entries[entry].Position
+}
+
+func enabledPosition(entries []EntryPosition, entry int) Position {
+	if entry >= len(entries) {
+		return Position{}
+	}
+	return entries[entry].Enabled
+}
+
+// SupplantPosition returns the position of a supplant entry, or of one of its ports if port isn't negative.
+func (p *ConfigPositions) SupplantPosition(entry, port int) Position {
+	if p == nil {
+		return Position{}
+	}
+	return entryPosition(p.Supplant, entry, port)
+}
+
+// ExternalPosition returns the position of an external entry, or of one of its ports if port isn't negative.
+func (p *ConfigPositions) ExternalPosition(entry, port int) Position {
+	if p == nil {
+		return Position{}
+	}
+	return entryPosition(p.External, entry, port)
+}
+
+// SupplantEnabledPosition returns the position of the enabled key of a supplant entry, or the zero position if
+// the entry doesn't set it.
+func (p *ConfigPositions) SupplantEnabledPosition(entry int) Position {
+	if p == nil {
+		return Position{}
+	}
+	return enabledPosition(p.Supplant, entry)
+}
+
+// ExternalEnabledPosition returns the position of the enabled key of an external entry, or the zero position if
+// the entry doesn't set it.
+func (p *ConfigPositions) ExternalEnabledPosition(entry int) Position {
+	if p == nil {
+		return Position{}
+	}
+	return enabledPosition(p.External, entry)
+}
+
+// ProfilePosition returns the position of a profile.
+func (p *ConfigPositions) ProfilePosition(name string) Position {
+	if p == nil {
+		return Position{}
+	}
+	return p.Profiles[name]
+}
+
+// setFile records that every position was read from file.
+func (p *ConfigPositions) setFile(file string) {
+	set := func(entries []EntryPosition) {
+		for i := range entries {
+			entries[i].File = file
+			for j := range entries[i].Ports {
+				entries[i].Ports[j].File = file
+			}
+			if entries[i].Enabled.Line != 0 {
+				entries[i].Enabled.File = file
+			}
+		}
+	}
+	set(p.Supplant)
+	set(p.External)
+	for name, pos := range p.Profiles {
+		pos.File = file
+		p.Profiles[name] = pos
+	}
+	if p.Filter.Line != 0 {
+		p.Filter.File = file
+	}
+}
+
+// ParseConfig strictly decodes a configuration, rejecting unknown keys, and records the line that each
+// entry was read from.
+func ParseConfig(data []byte) (*Config, *ConfigPositions, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+	cfg := Config{}
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+	pos := &ConfigPositions{}
+	if len(root.Content) > 0 {
+		doc := root.Content[0]
+		pos.Supplant = sequencePositions(mappingValue(doc, "supplant"))
+		pos.External = sequencePositions(mappingValue(doc, "external"))
+		if filter := mappingValue(doc, "filter"); filter != nil {
+			pos.Filter = Position{Line: filter.Line}
+		}
+		if profiles := mappingValue(doc, "profiles"); profiles != nil && profiles.Kind == yaml.MappingNode {
+			pos.Profiles = map[string]Position{}
+			for i := 0; i+1 < len(profiles.Content); i += 2 {
+				pos.Profiles[profiles.Content[i].Value] = Position{Line: profiles.Content[i].Line}
+			}
+		}
+	}
+	return &cfg, pos, nil
+}
+
+// mappingValue returns the value for key in a mapping node, or nil if it isn't found.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func sequencePositions(seq *yaml.Node) []EntryPosition {
+	if seq == nil || seq.Kind != yaml.SequenceNode {
+		return nil
+	}
+	var ret []EntryPosition
+	for _, item := range seq.Content {
+		ep := EntryPosition{Position: Position{Line: item.Line}}
+		if enabled := mappingValue(item, "enabled"); enabled != nil {
+			ep.Enabled = Position{Line: enabled.Line}
+		}
+		if ports := mappingValue(item, "ports"); ports != nil && ports.Kind == yaml.SequenceNode {
+			for _, port := range ports.Content {
+				ep.Ports = append(ep.Ports, Position{Line: port.Line})
+			}
+		}
+		ret = append(ret, ep)
+	}
+	return ret
+}
+
+// ValidateConfig checks the enabled entries of a configuration against each other and against the
+// services running in the cluster.  If svcs is nil, the checks against the cluster are skipped.  If relay
+// is true, the local ports of supplanted services are also checked against the ports that relay pods use.
+func ValidateConfig(cfg *Config, pos *ConfigPositions, svcs []v1.Service, relay bool) []ValidationError {
+	var errs []ValidationError
+	addErr := func(at Position, format string, a ...interface{}) {
+		errs = append(errs, ValidationError{Position: at, Message: fmt.Sprintf(format, a...)})
+	}
+
+	if cfg.Filter != nil {
+		if err := cfg.Filter.Validate(); err != nil {
+			var at Position
+			if pos != nil {
+				at = pos.Filter
+			}
+			addErr(at, "filter: %s", err)
+		}
+	}
+	for _, name := range cfg.ProfileNames() {
+		if _, _, err := cfg.resolveProfile(cfg.Profiles[name]); err != nil {
+			addErr(pos.ProfilePosition(name), "profile %s: %s", name, err)
+		}
+	}
+
+	// local ports must be unique for each protocol since we listen on each of them
+	type portUse struct {
+		at   Position
+		desc string
+	}
+	type localPort struct {
+		port     int32
+		protocol v1.Protocol
+	}
+	localPorts := map[localPort]portUse{}
+	checkLocalPort := func(port int32, protocol v1.Protocol, at Position, desc string) {
+		if !SupportedProtocol(protocol) {
+			addErr(at, "protocol %s of %s is not supported", protocol, desc)
+			return
+		}
+		if port == 0 {
+			return
+		}
+		key := localPort{port, NormalizeProtocol(protocol)}
+		if prev, ok := localPorts[key]; ok {
+			addErr(at, "local port %d for %s is already used by %s on %s", port, desc, prev.desc, prev.at)
+			return
+		}
+		localPorts[key] = portUse{at, desc}
+	}
+
+	type svcKey struct {
+		namespace string
+		name      string
+	}
+	svcMap := map[svcKey]v1.Service{}
+	for _, svc := range svcs {
+		svcMap[svcKey{svc.Namespace, svc.Name}] = svc
+	}
+	lookup := func(namespace, name string, at Position) (v1.Service, bool) {
+		if svcs == nil {
+			return v1.Service{}, false
+		}
+		svc, ok := svcMap[svcKey{namespace, name}]
+		if !ok {
+			addErr(at, "service %s/%s not found", namespace, name)
+		}
+		return svc, ok
+	}
+
+	// a relay pod listens on the local ports of the supplanted services alongside its own ports
+	udpForwards := 0
+	for _, es := range cfg.External {
+		n := 0
+		for _, port := range es.Ports {
+			if es.Enabled && NormalizeProtocol(port.Protocol) == v1.ProtocolUDP {
+				n++
+			}
+		}
+		if n > udpForwards {
+			udpForwards = n
+		}
+	}
+	checkRelayPort := func(port int32, protocol v1.Protocol, at Position, desc string) {
+		if !relay || port == 0 || NormalizeProtocol(protocol) != v1.ProtocolTCP {
+			return
+		}
+		if port == RelayTunnelPort || (port >= RelayUDPForwardPort && port < RelayUDPForwardPort+int32(udpForwards)) {
+			addErr(at, "local port %d for %s is reserved for relay pods", port, desc)
+		}
+	}
+
+	for i, ss := range cfg.Supplant {
+		if !ss.Enabled {
+			continue
+		}
+		at := pos.SupplantPosition(i, -1)
+		if ss.Name == "" || ss.Namespace == "" {
+			addErr(at, "supplant entry must have a name and namespace")
+		}
+		if len(ss.Ports) == 0 {
+			addErr(at, "supplant entry %s has no ports", ss.Name)
+		}
+		for j, port := range ss.Ports {
+			desc := fmt.Sprintf("supplanted service %s:%d", ss.Name, port.Port)
+			checkLocalPort(port.LocalPort, port.Protocol, pos.SupplantPosition(i, j), desc)
+			checkRelayPort(port.LocalPort, port.Protocol, pos.SupplantPosition(i, j), desc)
+		}
+
+		svc, ok := lookup(ss.Namespace, ss.Name, at)
+		if !ok {
+			continue
+		}
+		if len(svc.Spec.Selector) == 0 {
+			if _, supplanted := svc.Annotations[AnnotationSupplanted]; supplanted {
+				addErr(at, "service %s/%s is already supplanted", ss.Namespace, ss.Name)
+			} else {
+				addErr(at, "service %s/%s has no selector and can't be supplanted", ss.Namespace, ss.Name)
+			}
+		}
+		for j, port := range ss.Ports {
+			if _, ok := port.Resolve(svc); !ok {
+				if port.Name != "" {
+					addErr(pos.SupplantPosition(i, j), "service %s/%s has no port named %s or numbered %d", svc.Namespace, svc.Name, port.Name, port.Port)
+				} else {
+					addErr(pos.SupplantPosition(i, j), "service %s/%s has no port %d", svc.Namespace, svc.Name, port.Port)
+				}
+			}
+		}
+	}
+
+	for i, es := range cfg.External {
+		if !es.Enabled {
+			continue
+		}
+		at := pos.ExternalPosition(i, -1)
+		if es.Name == "" || es.Namespace == "" {
+			addErr(at, "external entry must have a name and namespace")
+		}
+		for j, port := range es.Ports {
+			checkLocalPort(port.LocalPort, port.Protocol, pos.ExternalPosition(i, j), fmt.Sprintf("external service %s:%d", es.Name, port.TargetPort))
+		}
+
+		svc, ok := lookup(es.Namespace, es.Name, at)
+		if !ok {
+			continue
+		}
+		if len(svc.Spec.Selector) == 0 {
+			addErr(at, "service %s/%s has no selector so it can't be forwarded to", es.Namespace, es.Name)
+		}
+		for j, port := range es.Ports {
+			if _, ok := port.ServicePort(svc); ok {
+				continue
+			}
+			switch {
+			case port.Name != "":
+				addErr(pos.ExternalPosition(i, j), "service %s/%s has no port named %s", es.Namespace, es.Name, port.Name)
+			case port.TargetPortName != "":
+				addErr(pos.ExternalPosition(i, j), "service %s/%s has no %s port targeting %s", es.Namespace, es.Name,
+					NormalizeProtocol(port.Protocol), port.TargetPortName)
+			case hasNamedTargetPort(svc, port.Protocol):
+				// the number may be what a named target port is on the pods, which can't be checked here
+			default:
+				addErr(pos.ExternalPosition(i, j), "service %s/%s has no %s port targeting %d", es.Namespace, es.Name,
+					NormalizeProtocol(port.Protocol), port.TargetPort)
+			}
+		}
+	}
+
+	sort.SliceStable(errs, func(a, b int) bool {
+		return errs[a].Position.before(errs[b].Position)
+	})
+	return errs
+}
+
+// hasNamedTargetPort returns true if a service has a port with the protocol that targets a named container port.
+func hasNamedTargetPort(svc v1.Service, protocol v1.Protocol) bool {
+	for _, sp := range svc.Spec.Ports {
+		if sp.TargetPort.Type == intstr.String && NormalizeProtocol(sp.Protocol) == NormalizeProtocol(protocol) {
+			return true
+		}
+	}
+	return false
+}
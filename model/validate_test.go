@@ -0,0 +1,159 @@
+package model
+
+import (
+	"strings"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+func TestValidateConfigExternalPorts(t *testing.T) {
+	svc := v1.Service{
+		ObjectMeta: metav1.ObjectMeta{Name: "web", Namespace: "default"},
+		Spec: v1.ServiceSpec{
+			Selector: map[string]string{"app": "web"},
+			Ports: []v1.ServicePort{
+				{Name: "http", Port: 80, TargetPort: intstr.FromInt(8080), Protocol: v1.ProtocolTCP},
+				{Name: "dns", Port: 53, TargetPort: intstr.FromString("dns"), Protocol: v1.ProtocolUDP},
+			},
+		},
+	}
+	tests := []struct {
+		name string
+		port ExternalPortConfig
+		want string
+	}{
+		{
+			name: "by name",
+			port: ExternalPortConfig{Name: "http", TargetPort: 8080},
+		},
+		{
+			name: "missing name",
+			port: ExternalPortConfig{Name: "https", TargetPort: 8443},
+			want: "no port named https",
+		},
+		{
+			name: "by number",
+			port: ExternalPortConfig{TargetPort: 8080, Protocol: v1.ProtocolTCP},
+		},
+		{
+			name: "missing number",
+			port: ExternalPortConfig{TargetPort: 9090, Protocol: v1.ProtocolTCP},
+			want: "no TCP port targeting 9090",
+		},
+		{
+			name: "number with the wrong protocol",
+			port: ExternalPortConfig{TargetPort: 8080, Protocol: v1.ProtocolUDP},
+		},
+		{
+			name: "by target port name",
+			port: ExternalPortConfig{TargetPort: 5353, TargetPortName: "dns", Protocol: v1.ProtocolUDP},
+		},
+		{
+			name: "missing target port name",
+			port: ExternalPortConfig{TargetPort: 5353, TargetPortName: "mdns", Protocol: v1.ProtocolUDP},
+			want: "no UDP port targeting mdns",
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := &Config{External: []ExternalService{{
+				Name:      "web",
+				Namespace: "default",
+				Enabled:   true,
+				Ports:     []ExternalPortConfig{tc.port},
+			}}}
+			errs := ValidateConfig(cfg, nil, []v1.Service{svc}, false)
+			if tc.want == "" {
+				if len(errs) != 0 {
+					t.Errorf("expected no errors, got %v", errs)
+				}
+				return
+			}
+			if len(errs) != 1 || !strings.Contains(errs[0].Message, tc.want) {
+				t.Errorf("expected an error containing %q, got %v", tc.want, errs)
+			}
+		})
+	}
+}
+
+func TestValidateConfigLocalPorts(t *testing.T) {
+	cfg := &Config{
+		Supplant: []SupplantService{{
+			Name:      "api",
+			Namespace: "default",
+			Enabled:   true,
+			Ports:     []SupplantPortConfig{{Port: 80, LocalPort: 8080}},
+		}},
+		External: []ExternalService{
+			{
+				Name:      "web",
+				Namespace: "default",
+				Enabled:   true,
+				Ports:     []ExternalPortConfig{{TargetPort: 80, LocalPort: 8080}},
+			},
+			{
+				// the same local port with another protocol doesn't conflict
+				Name:      "dns",
+				Namespace: "default",
+				Enabled:   true,
+				Ports:     []ExternalPortConfig{{TargetPort: 53, LocalPort: 8080, Protocol: v1.ProtocolUDP}},
+			},
+		},
+	}
+	pos := &ConfigPositions{
+		Supplant: []EntryPosition{{Position: Position{Line: 2}, Ports: []Position{{Line: 5}}}},
+		External: []EntryPosition{{Position: Position{Line: 10}, Ports: []Position{{Line: 13}}}, {Position: Position{Line: 20}, Ports: []Position{{Line: 23}}}},
+	}
+	errs := ValidateConfig(cfg, pos, nil, false)
+	if len(errs) != 1 {
+		t.Fatalf("expected a single error, got %v", errs)
+	}
+	if errs[0].Line != 13 || !strings.Contains(errs[0].Message, "already used by supplanted service api:80 on line 5") {
+		t.Errorf("unexpected error %s", errs[0])
+	}
+}
+
+func TestValidateConfigRelayPorts(t *testing.T) {
+	cfg := &Config{
+		Supplant: []SupplantService{{
+			Name:      "api",
+			Namespace: "default",
+			Enabled:   true,
+			Ports: []SupplantPortConfig{
+				{Port: 80, LocalPort: RelayTunnelPort},
+				{Port: 81, LocalPort: RelayUDPForwardPort + 1},
+				{Port: 82, LocalPort: RelayUDPForwardPort + 2},
+				// the relay's ports are all TCP
+				{Port: 53, LocalPort: RelayUDPForwardPort, Protocol: v1.ProtocolUDP},
+			},
+		}},
+		External: []ExternalService{{
+			Name:      "dns",
+			Namespace: "default",
+			Enabled:   true,
+			Ports:     []ExternalPortConfig{{TargetPort: 53, Protocol: v1.ProtocolUDP}, {TargetPort: 5353, Protocol: v1.ProtocolUDP}},
+		}},
+	}
+	pos := &ConfigPositions{
+		Supplant: []EntryPosition{{Position: Position{Line: 2}, Ports: []Position{{Line: 5}, {Line: 7}, {Line: 9}, {Line: 11}}}},
+	}
+
+	if errs := ValidateConfig(cfg, pos, nil, false); len(errs) != 0 {
+		t.Errorf("expected no errors without the relay, got %v", errs)
+	}
+	errs := ValidateConfig(cfg, pos, nil, true)
+	var got []string
+	for _, e := range errs {
+		got = append(got, e.Error())
+	}
+	want := []string{
+		"line 5: local port 17000 for supplanted service api:80 is reserved for relay pods",
+		"line 7: local port 17002 for supplanted service api:81 is reserved for relay pods",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got errors %q, want %q", got, want)
+	}
+}
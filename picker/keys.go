@@ -0,0 +1,79 @@
+package picker
+
+// Key is a key press that drives the picker.
+type Key struct {
+	Type KeyType
+	// Rune is the character typed for KeyRune
+	Rune rune
+}
+
+// KeyType identifies a key press.
+type KeyType int
+
+const (
+	KeyRune KeyType = iota
+	KeyUp
+	KeyDown
+	KeyPageUp
+	KeyPageDown
+	KeyEnter
+	KeyBackspace
+	KeyEscape
+	KeyInterrupt
+)
+
+// Rune returns the key press for typing a character.
+func Rune(r rune) Key {
+	return Key{Type: KeyRune, Rune: r}
+}
+
+// ParseKeys converts the bytes read from a terminal in raw mode to key presses.  An escape sequence that
+// may have been cut off at the end of b, including a lone escape, is returned so that it can be completed
+// by the next read.  Escape sequences that aren't understood are dropped.
+func ParseKeys(b []byte) ([]Key, []byte) {
+	var keys []Key
+	for i := 0; i < len(b); i++ {
+		switch c := b[i]; {
+		case c == 0x1b:
+			if i+1 >= len(b) {
+				return keys, b[i:]
+			}
+			if b[i+1] != '[' {
+				keys = append(keys, Key{Type: KeyEscape})
+				continue
+			}
+			// the start of an escape sequence such as an arrow key
+			if i+2 >= len(b) {
+				return keys, b[i:]
+			}
+			i += 2
+			switch b[i] {
+			case 'A':
+				keys = append(keys, Key{Type: KeyUp})
+			case 'B':
+				keys = append(keys, Key{Type: KeyDown})
+			case '5', '6':
+				if i+1 >= len(b) {
+					return keys, b[i-2:]
+				}
+				if b[i+1] == '~' {
+					if b[i] == '5' {
+						keys = append(keys, Key{Type: KeyPageUp})
+					} else {
+						keys = append(keys, Key{Type: KeyPageDown})
+					}
+					i++
+				}
+			}
+		case c == '\r' || c == '\n':
+			keys = append(keys, Key{Type: KeyEnter})
+		case c == 0x7f || c == 0x08:
+			keys = append(keys, Key{Type: KeyBackspace})
+		case c == 0x03:
+			keys = append(keys, Key{Type: KeyInterrupt})
+		case c >= 0x20 && c < 0x7f:
+			keys = append(keys, Rune(rune(c)))
+		}
+	}
+	return keys, nil
+}
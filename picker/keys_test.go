@@ -0,0 +1,60 @@
+package picker
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseKeys(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want []Key
+		rest string
+	}{
+		{"runes", "ab/", []Key{Rune('a'), Rune('b'), Rune('/')}, ""},
+		{"control keys", "\r\n\x7f\x08\x03", []Key{{Type: KeyEnter}, {Type: KeyEnter}, {Type: KeyBackspace}, {Type: KeyBackspace}, {Type: KeyInterrupt}}, ""},
+		{"arrows", "\x1b[A\x1b[B", []Key{{Type: KeyUp}, {Type: KeyDown}}, ""},
+		{"pages", "\x1b[5~\x1b[6~", []Key{{Type: KeyPageUp}, {Type: KeyPageDown}}, ""},
+		{"lone escape", "\x1b", nil, "\x1b"},
+		{"escape then rune", "\x1bq", []Key{{Type: KeyEscape}, Rune('q')}, ""},
+		{"unknown sequence is dropped", "\x1b[Cx", []Key{Rune('x')}, ""},
+		{"cut off after bracket", "j\x1b[", []Key{Rune('j')}, "\x1b["},
+		{"cut off page key", "\x1b[5", nil, "\x1b[5"},
+		{"non-ascii is dropped", "\xc3\xa9z", []Key{Rune('z')}, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, rest := ParseKeys([]byte(tc.in))
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("ParseKeys(%q) = %v, want %v", tc.in, got, tc.want)
+			}
+			if string(rest) != tc.rest {
+				t.Errorf("ParseKeys(%q) left %q, want %q", tc.in, rest, tc.rest)
+			}
+		})
+	}
+}
+
+func TestParseKeysSplitAcrossReads(t *testing.T) {
+	for _, seq := range []struct {
+		in   string
+		want Key
+	}{
+		{"\x1b[A", Key{Type: KeyUp}},
+		{"\x1b[B", Key{Type: KeyDown}},
+		{"\x1b[5~", Key{Type: KeyPageUp}},
+		{"\x1b[6~", Key{Type: KeyPageDown}},
+	} {
+		for split := 1; split < len(seq.in); split++ {
+			first, rest := ParseKeys([]byte(seq.in[:split]))
+			if len(first) != 0 {
+				t.Errorf("%q split at %d: expected no keys from the first read, got %v", seq.in, split, first)
+			}
+			second, rest := ParseKeys(append(rest, seq.in[split:]...))
+			if !reflect.DeepEqual(second, []Key{seq.want}) || len(rest) != 0 {
+				t.Errorf("%q split at %d: got %v with %q left, want %v", seq.in, split, second, rest, seq.want)
+			}
+		}
+	}
+}
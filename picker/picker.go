@@ -0,0 +1,403 @@
+package picker
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/tzneal/supplant/model"
+)
+
+const helpText = "up/down move, s supplant, e forward, a supplant all, A forward all, / filter, enter set local port, w save, q quit"
+
+type rowKind int
+
+const (
+	rowService rowKind = iota
+	rowSupplantPort
+	rowExternalPort
+)
+
+// row is a line in the picker, either a service or one of its ports.
+type row struct {
+	kind      rowKind
+	namespace string
+	name      string
+	// supplant and external are the indexes of the service's entries in the config, or -1
+	supplant int
+	external int
+	port     int
+}
+
+// Model is the state of the picker.  It is changed by passing key presses to Update and rendered with View,
+// so it can be driven by scripted keys as well as by a terminal.
+type Model struct {
+	// Height is the number of rows shown at once
+	Height int
+
+	cfg  model.Config
+	rows []row
+	// visible are the indexes of the rows that match the filter, the cursor is an index into visible
+	visible   []int
+	cursor    int
+	offset    int
+	editing   bool
+	input     string
+	filtering bool
+	filter    string
+	message   string
+	done      bool
+	saved     bool
+}
+
+// New constructs a picker for the services in a configuration.  The configuration isn't modified, the
+// choices are returned by Config.
+func New(cfg model.Config) *Model {
+	m := &Model{Height: 20}
+	m.cfg.Profiles = cfg.Profiles
+	m.cfg.Filter = cfg.Filter
+	for _, svc := range cfg.Supplant {
+		svc.Ports = append([]model.SupplantPortConfig{}, svc.Ports...)
+		m.cfg.Supplant = append(m.cfg.Supplant, svc)
+	}
+	for _, svc := range cfg.External {
+		svc.Ports = append([]model.ExternalPortConfig{}, svc.Ports...)
+		m.cfg.External = append(m.cfg.External, svc)
+	}
+
+	// each service is shown once with both its supplant and external entries
+	type svcKey struct {
+		namespace string
+		name      string
+	}
+	var order []svcKey
+	services := map[svcKey]*row{}
+	lookup := func(namespace, name string) *row {
+		key := svcKey{namespace, name}
+		r, ok := services[key]
+		if !ok {
+			r = &row{kind: rowService, namespace: namespace, name: name, supplant: -1, external: -1}
+			services[key] = r
+			order = append(order, key)
+		}
+		return r
+	}
+	for i, svc := range m.cfg.Supplant {
+		lookup(svc.Namespace, svc.Name).supplant = i
+	}
+	for i, svc := range m.cfg.External {
+		lookup(svc.Namespace, svc.Name).external = i
+	}
+
+	for _, key := range order {
+		r := *services[key]
+		m.rows = append(m.rows, r)
+		if r.supplant != -1 {
+			for j := range m.cfg.Supplant[r.supplant].Ports {
+				pr := r
+				pr.kind = rowSupplantPort
+				pr.port = j
+				m.rows = append(m.rows, pr)
+			}
+		}
+		if r.external != -1 {
+			for j := range m.cfg.External[r.external].Ports {
+				pr := r
+				pr.kind = rowExternalPort
+				pr.port = j
+				m.rows = append(m.rows, pr)
+			}
+		}
+	}
+	m.applyFilter()
+	return m
+}
+
+// Config returns the configuration with the choices that have been made.
+func (m *Model) Config() model.Config {
+	return m.cfg
+}
+
+// Done returns true once the user has saved or quit.
+func (m *Model) Done() bool {
+	return m.done
+}
+
+// Saved returns true if the user chose to save their changes.
+func (m *Model) Saved() bool {
+	return m.saved
+}
+
+// Update applies a key press to the picker.
+func (m *Model) Update(k Key) {
+	if m.done {
+		return
+	}
+	if m.editing {
+		m.updateEditing(k)
+		return
+	}
+	if m.filtering {
+		m.updateFiltering(k)
+		return
+	}
+	m.message = ""
+
+	switch {
+	case k.Type == KeyUp || (k.Type == KeyRune && k.Rune == 'k'):
+		m.move(-1)
+	case k.Type == KeyDown || (k.Type == KeyRune && k.Rune == 'j'):
+		m.move(1)
+	case k.Type == KeyPageUp:
+		m.move(-m.Height)
+	case k.Type == KeyPageDown:
+		m.move(m.Height)
+	case k.Type == KeyRune && (k.Rune == 's' || k.Rune == ' '):
+		m.toggleSupplant()
+	case k.Type == KeyRune && k.Rune == 'e':
+		m.toggleExternal()
+	case k.Type == KeyRune && k.Rune == 'a':
+		m.toggleAll(true)
+	case k.Type == KeyRune && k.Rune == 'A':
+		m.toggleAll(false)
+	case k.Type == KeyRune && k.Rune == '/':
+		m.filtering = true
+	case k.Type == KeyEnter:
+		r, ok := m.current()
+		if !ok || r.kind == rowService {
+			m.message = "select a port to set its local port"
+			return
+		}
+		m.editing = true
+		m.input = strconv.Itoa(int(m.localPort(r)))
+	case k.Type == KeyRune && k.Rune == 'w':
+		m.done = true
+		m.saved = true
+	case k.Type == KeyRune && k.Rune == 'q', k.Type == KeyEscape, k.Type == KeyInterrupt:
+		m.done = true
+	}
+}
+
+func (m *Model) updateEditing(k Key) {
+	switch {
+	case k.Type == KeyRune && k.Rune >= '0' && k.Rune <= '9':
+		m.input += string(k.Rune)
+	case k.Type == KeyBackspace:
+		if len(m.input) > 0 {
+			m.input = m.input[:len(m.input)-1]
+		}
+	case k.Type == KeyEscape:
+		m.editing = false
+	case k.Type == KeyInterrupt:
+		m.editing = false
+		m.done = true
+	case k.Type == KeyEnter:
+		port, err := strconv.ParseUint(m.input, 10, 16)
+		if m.input == "" {
+			port, err = 0, nil
+		}
+		if err != nil {
+			m.message = fmt.Sprintf("invalid port %s", m.input)
+			return
+		}
+		r, _ := m.current()
+		m.setLocalPort(r, int32(port))
+		m.editing = false
+	}
+}
+
+// updateFiltering changes the filter as it's typed.  Enter keeps the filter and escape clears it.
+func (m *Model) updateFiltering(k Key) {
+	switch {
+	case k.Type == KeyRune:
+		m.filter += string(k.Rune)
+	case k.Type == KeyBackspace:
+		if len(m.filter) > 0 {
+			m.filter = m.filter[:len(m.filter)-1]
+		}
+	case k.Type == KeyEnter:
+		m.filtering = false
+	case k.Type == KeyEscape:
+		m.filtering = false
+		m.filter = ""
+	case k.Type == KeyInterrupt:
+		m.filtering = false
+		m.done = true
+	}
+	m.applyFilter()
+}
+
+// applyFilter shows the services whose namespace/name contain the filter, along with their ports.
+func (m *Model) applyFilter() {
+	var selected row
+	if r, ok := m.current(); ok {
+		selected = r
+	}
+	filter := strings.ToLower(m.filter)
+	m.visible = m.visible[:0]
+	m.cursor = 0
+	for i, r := range m.rows {
+		if !strings.Contains(strings.ToLower(r.namespace+"/"+r.name), filter) {
+			continue
+		}
+		// stay on the same row if it's still shown
+		if r == selected {
+			m.cursor = len(m.visible)
+		}
+		m.visible = append(m.visible, i)
+	}
+	m.offset = 0
+}
+
+// current returns the row under the cursor.
+func (m *Model) current() (row, bool) {
+	if m.cursor < 0 || m.cursor >= len(m.visible) {
+		return row{}, false
+	}
+	return m.rows[m.visible[m.cursor]], true
+}
+
+func (m *Model) move(delta int) {
+	m.cursor += delta
+	if m.cursor >= len(m.visible) {
+		m.cursor = len(m.visible) - 1
+	}
+	if m.cursor < 0 {
+		m.cursor = 0
+	}
+}
+
+// toggleAll enables supplanting, or forwarding if supplant is false, for every shown service.  If they are all
+// already enabled, they are all disabled instead.
+func (m *Model) toggleAll(supplant bool) {
+	var enabled []*bool
+	for _, i := range m.visible {
+		r := m.rows[i]
+		if r.kind != rowService {
+			continue
+		}
+		if supplant && r.supplant != -1 {
+			enabled = append(enabled, &m.cfg.Supplant[r.supplant].Enabled)
+		} else if !supplant && r.external != -1 {
+			enabled = append(enabled, &m.cfg.External[r.external].Enabled)
+		}
+	}
+	all := true
+	for _, e := range enabled {
+		all = all && *e
+	}
+	for _, e := range enabled {
+		*e = !all
+	}
+}
+
+func (m *Model) toggleSupplant() {
+	r, ok := m.current()
+	if !ok {
+		return
+	}
+	if r.supplant == -1 {
+		m.message = fmt.Sprintf("%s has no ports that can be supplanted", r.name)
+		return
+	}
+	m.cfg.Supplant[r.supplant].Enabled = !m.cfg.Supplant[r.supplant].Enabled
+}
+
+func (m *Model) toggleExternal() {
+	r, ok := m.current()
+	if !ok {
+		return
+	}
+	if r.external == -1 {
+		m.message = fmt.Sprintf("%s has no ports that can be forwarded", r.name)
+		return
+	}
+	m.cfg.External[r.external].Enabled = !m.cfg.External[r.external].Enabled
+}
+
+func (m *Model) localPort(r row) int32 {
+	if r.kind == rowSupplantPort {
+		return m.cfg.Supplant[r.supplant].Ports[r.port].LocalPort
+	}
+	return m.cfg.External[r.external].Ports[r.port].LocalPort
+}
+
+func (m *Model) setLocalPort(r row, port int32) {
+	if r.kind == rowSupplantPort {
+		m.cfg.Supplant[r.supplant].Ports[r.port].LocalPort = port
+		return
+	}
+	m.cfg.External[r.external].Ports[r.port].LocalPort = port
+}
+
+// View renders the picker.
+func (m *Model) View() string {
+	var sb strings.Builder
+	sb.WriteString(helpText)
+	sb.WriteString("\n")
+	if m.filtering {
+		fmt.Fprintf(&sb, "filter: %s_\n", m.filter)
+	} else if m.filter != "" {
+		fmt.Fprintf(&sb, "filter: %s\n", m.filter)
+	}
+
+	// keep the cursor on screen
+	height := m.Height
+	if height < 1 {
+		height = 1
+	}
+	if m.cursor < m.offset {
+		m.offset = m.cursor
+	}
+	if m.cursor >= m.offset+height {
+		m.offset = m.cursor - height + 1
+	}
+
+	for i := m.offset; i < len(m.visible) && i < m.offset+height; i++ {
+		r := m.rows[m.visible[i]]
+		cursor := "  "
+		if i == m.cursor {
+			cursor = "> "
+		}
+		sb.WriteString(cursor)
+		switch r.kind {
+		case rowService:
+			fmt.Fprintf(&sb, "%s %s %s/%s", m.check(r.supplant != -1 && m.cfg.Supplant[r.supplant].Enabled, "S"),
+				m.check(r.external != -1 && m.cfg.External[r.external].Enabled, "E"), r.namespace, r.name)
+		case rowSupplantPort:
+			port := m.cfg.Supplant[r.supplant].Ports[r.port]
+			fmt.Fprintf(&sb, "      supplant %d/%s -> local %s", port.Port, port.Protocol, m.portText(i, port.LocalPort))
+		case rowExternalPort:
+			port := m.cfg.External[r.external].Ports[r.port]
+			fmt.Fprintf(&sb, "      forward  %d/%s <- local %s", port.TargetPort, port.Protocol, m.portText(i, port.LocalPort))
+		}
+		sb.WriteString("\n")
+	}
+	if len(m.rows) == 0 {
+		sb.WriteString("no services\n")
+	} else if len(m.visible) == 0 {
+		sb.WriteString("no services match the filter\n")
+	}
+	if m.message != "" {
+		sb.WriteString(m.message)
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+func (m *Model) check(on bool, label string) string {
+	if on {
+		return "[" + label + "]"
+	}
+	return "[ ]"
+}
+
+func (m *Model) portText(i int, port int32) string {
+	if m.editing && i == m.cursor {
+		return m.input + "_"
+	}
+	if port == 0 {
+		return "random"
+	}
+	return strconv.Itoa(int(port))
+}
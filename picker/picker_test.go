@@ -0,0 +1,233 @@
+package picker
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/tzneal/supplant/model"
+)
+
+func testConfig() model.Config {
+	return model.Config{
+		Supplant: []model.SupplantService{
+			{Name: "api", Namespace: "shop", Ports: []model.SupplantPortConfig{{Port: 80}}},
+			{Name: "web", Namespace: "shop", Ports: []model.SupplantPortConfig{{Port: 80}}},
+			{Name: "db", Namespace: "data", Ports: []model.SupplantPortConfig{{Port: 5432}}},
+		},
+		External: []model.ExternalService{
+			{Name: "api", Namespace: "shop", Ports: []model.ExternalPortConfig{{TargetPort: 8080}}},
+			{Name: "db", Namespace: "data", Ports: []model.ExternalPortConfig{{TargetPort: 5432}}},
+		},
+	}
+}
+
+// press sends each key to the model.
+func press(m *Model, keys ...Key) {
+	for _, k := range keys {
+		m.Update(k)
+	}
+}
+
+// typed returns the keys for typing s.
+func typed(s string) []Key {
+	var keys []Key
+	for _, r := range s {
+		keys = append(keys, Rune(r))
+	}
+	return keys
+}
+
+func enabled(cfg model.Config) (supplant []string, external []string) {
+	for _, svc := range cfg.Supplant {
+		if svc.Enabled {
+			supplant = append(supplant, svc.Name)
+		}
+	}
+	for _, svc := range cfg.External {
+		if svc.Enabled {
+			external = append(external, svc.Name)
+		}
+	}
+	return supplant, external
+}
+
+func TestPickerToggle(t *testing.T) {
+	cfg := testConfig()
+	m := New(cfg)
+	// api, then down past its two ports to web
+	press(m, Rune('s'), Rune('e'), Key{Type: KeyDown}, Key{Type: KeyDown}, Key{Type: KeyDown}, Rune('s'))
+	// toggling twice turns it back off
+	press(m, Rune('s'), Rune('s'), Rune('w'))
+
+	if !m.Done() || !m.Saved() {
+		t.Fatalf("expected the picker to be saved")
+	}
+	supplant, external := enabled(m.Config())
+	if strings.Join(supplant, ",") != "api,web" || strings.Join(external, ",") != "api" {
+		t.Errorf("got supplant %v and external %v", supplant, external)
+	}
+	// the original configuration isn't changed
+	if supplant, _ := enabled(cfg); len(supplant) != 0 {
+		t.Errorf("expected the original config to be unchanged, got %v", supplant)
+	}
+}
+
+func TestPickerToggleMissingEntry(t *testing.T) {
+	m := New(testConfig())
+	// web has no external entry
+	press(m, typed("/web")...)
+	press(m, Key{Type: KeyEnter}, Rune('e'))
+	if !strings.Contains(m.View(), "web has no ports that can be forwarded") {
+		t.Errorf("expected a message about web, got:\n%s", m.View())
+	}
+}
+
+func TestPickerLocalPort(t *testing.T) {
+	m := New(testConfig())
+	press(m, Key{Type: KeyEnter})
+	if !strings.Contains(m.View(), "select a port") {
+		t.Errorf("expected a message about selecting a port, got:\n%s", m.View())
+	}
+	press(m, Key{Type: KeyDown}, Key{Type: KeyEnter})
+	press(m, typed("90x90")...)
+	press(m, Key{Type: KeyBackspace}, Rune('1'), Key{Type: KeyEnter}, Rune('w'))
+	if got := m.Config().Supplant[0].Ports[0].LocalPort; got != 9091 {
+		t.Errorf("expected local port 9091, got %d", got)
+	}
+}
+
+func TestPickerFilter(t *testing.T) {
+	m := New(testConfig())
+	press(m, Rune('/'))
+	press(m, typed("DATA")...)
+	view := m.View()
+	if !strings.Contains(view, "filter: DATA_") || !strings.Contains(view, "data/db") || strings.Contains(view, "shop/") {
+		t.Errorf("expected only data/db to be shown:\n%s", view)
+	}
+
+	// keys go to the filter until it's accepted
+	press(m, Rune('s'), Key{Type: KeyBackspace}, Key{Type: KeyEnter})
+	if supplant, _ := enabled(m.Config()); len(supplant) != 0 {
+		t.Errorf("expected typing in the filter not to toggle, got %v", supplant)
+	}
+	press(m, Rune('s'))
+	if supplant, _ := enabled(m.Config()); strings.Join(supplant, ",") != "db" {
+		t.Errorf("expected db to be toggled, got %v", supplant)
+	}
+
+	// escape clears the filter
+	press(m, Rune('/'), Rune('x'), Key{Type: KeyEscape})
+	view = m.View()
+	if strings.Contains(view, "filter:") || !strings.Contains(view, "shop/api") {
+		t.Errorf("expected the filter to be cleared:\n%s", view)
+	}
+
+	press(m, Rune('/'), Rune('z'), Key{Type: KeyEnter})
+	if !strings.Contains(m.View(), "no services match the filter") {
+		t.Errorf("expected no services to match:\n%s", m.View())
+	}
+	// nothing happens without a row
+	press(m, Rune('s'), Rune('e'), Key{Type: KeyEnter}, Key{Type: KeyDown})
+}
+
+func TestPickerSelectAll(t *testing.T) {
+	m := New(testConfig())
+	press(m, Rune('a'))
+	if supplant, _ := enabled(m.Config()); strings.Join(supplant, ",") != "api,web,db" {
+		t.Errorf("expected every service to be supplanted, got %v", supplant)
+	}
+	// once they are all enabled, they are all disabled
+	press(m, Rune('a'))
+	if supplant, _ := enabled(m.Config()); len(supplant) != 0 {
+		t.Errorf("expected no services to be supplanted, got %v", supplant)
+	}
+
+	// only the shown services are changed, and the partially enabled ones are all enabled
+	press(m, Rune('/'))
+	press(m, typed("shop/")...)
+	press(m, Key{Type: KeyEnter}, Rune('s'), Rune('a'), Rune('A'))
+	supplant, external := enabled(m.Config())
+	if strings.Join(supplant, ",") != "api,web" || strings.Join(external, ",") != "api" {
+		t.Errorf("got supplant %v and external %v", supplant, external)
+	}
+}
+
+func TestPickerCancel(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		keys []Key
+	}{
+		{"quit", []Key{Rune('s'), Rune('q')}},
+		{"escape", []Key{Rune('s'), {Type: KeyEscape}}},
+		{"interrupt", []Key{Rune('s'), {Type: KeyInterrupt}}},
+		{"interrupt while editing", []Key{{Type: KeyDown}, {Type: KeyEnter}, {Type: KeyInterrupt}}},
+		{"interrupt while filtering", []Key{Rune('/'), {Type: KeyInterrupt}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := New(testConfig())
+			press(m, tc.keys...)
+			if !m.Done() || m.Saved() {
+				t.Errorf("expected the picker to quit without saving")
+			}
+			// nothing changes once it's done
+			press(m, Rune('w'))
+			if m.Saved() {
+				t.Errorf("expected keys to be ignored once done")
+			}
+		})
+	}
+
+	// escape while editing only stops editing
+	m := New(testConfig())
+	press(m, Key{Type: KeyDown}, Key{Type: KeyEnter}, Rune('5'), Key{Type: KeyEscape})
+	if m.Done() {
+		t.Fatalf("expected escape to stop editing without quitting")
+	}
+	if got := m.Config().Supplant[0].Ports[0].LocalPort; got != 0 {
+		t.Errorf("expected the local port to be unchanged, got %d", got)
+	}
+}
+
+// chunkReader returns a single chunk for each read.
+type chunkReader struct {
+	chunks []string
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if len(r.chunks) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.chunks[0])
+	r.chunks = r.chunks[1:]
+	return n, nil
+}
+
+func TestDrive(t *testing.T) {
+	// the down arrows are split across reads, including after the escape of a read that fills the buffer
+	in := &chunkReader{chunks: []string{"\x1b[", "B" + strings.Repeat("x", 62) + "\x1b", "[B\x1b[", "Bs", "w"}}
+	m := New(testConfig())
+	var out strings.Builder
+	saved, err := Drive(in, &out, m)
+	if err != nil || !saved {
+		t.Fatalf("Drive() = %v, %v", saved, err)
+	}
+	if supplant, _ := enabled(m.Config()); strings.Join(supplant, ",") != "web" {
+		t.Errorf("expected web to be supplanted, got %v", supplant)
+	}
+
+	// a lone escape at the end of a short read is the escape key
+	saved, err = Drive(&chunkReader{chunks: []string{"s\x1b", "w"}}, io.Discard, New(testConfig()))
+	if err != nil || saved {
+		t.Errorf("Drive() = %v, %v, expected escape to quit without saving", saved, err)
+	}
+	if strings.Contains(out.String(), "\n") && !strings.Contains(out.String(), "\r\n") {
+		t.Errorf("expected carriage returns in the output")
+	}
+
+	// input that ends early quits without saving
+	saved, err = Drive(&chunkReader{chunks: []string{"s"}}, io.Discard, New(testConfig()))
+	if err != nil || saved {
+		t.Errorf("Drive() = %v, %v, expected to quit without saving", saved, err)
+	}
+}
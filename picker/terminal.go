@@ -0,0 +1,62 @@
+package picker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const clearScreen = "\x1b[H\x1b[2J"
+
+// Run shows the picker on a terminal until the user saves or quits, returning true if they saved.
+func Run(in *os.File, out io.Writer, m *Model) (bool, error) {
+	fd := int(in.Fd())
+	if !term.IsTerminal(fd) {
+		return false, fmt.Errorf("interactive mode requires a terminal")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return false, err
+	}
+	defer term.Restore(fd, state)
+
+	// leave room for the help and message lines
+	if _, height, err := term.GetSize(fd); err == nil && height > 4 {
+		m.Height = height - 3
+	}
+	return Drive(in, out, m)
+}
+
+// Drive renders the picker to out and updates it with the keys read from in until the user saves or
+// quits.  Input that ends early is treated as quitting without saving.
+func Drive(in io.Reader, out io.Writer, m *Model) (bool, error) {
+	buf := make([]byte, 64)
+	// the start of an escape sequence that was cut off by the previous read
+	var pending []byte
+	for !m.Done() {
+		// the terminal is in raw mode so each line needs a carriage return
+		fmt.Fprint(out, clearScreen+strings.ReplaceAll(m.View(), "\n", "\r\n"))
+		n, err := in.Read(buf)
+		var keys []Key
+		keys, pending = ParseKeys(append(pending, buf[:n]...))
+		// a sequence is only cut off when the read fills the buffer, otherwise a lone escape is the escape key
+		if n < len(buf) && len(pending) == 1 {
+			keys = append(keys, Key{Type: KeyEscape})
+			pending = nil
+		}
+		for _, k := range keys {
+			m.Update(k)
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+	fmt.Fprint(out, clearScreen)
+	return m.Saved(), nil
+}
@@ -0,0 +1,338 @@
+// Package tunnel carries connections from inside the cluster back to the developer's machine for
+// clusters that can't connect to it directly.  A relay runs in a pod and the client keeps idle
+// connections open to it through a port forward.  When a connection arrives at the relay, it hands
+// the connection to one of the idle tunnels along with the port it arrived on, and the client proxies
+// it to a local address.  Datagrams that arrive at the relay's UDP ports are carried through the
+// tunnels in the same way, and the relay can also send datagrams from the client on to addresses in
+// the cluster since port forwards only carry TCP.
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/tzneal/supplant/util"
+)
+
+// headerSize is the size of the header written by the relay when it claims a tunnel, holding the
+// port that the connection arrived on as a big endian uint32
+const headerSize = 4
+
+// headerUDP is set in the header for datagrams that arrived on a UDP port, which are then carried
+// through the tunnel as described by WriteDatagram
+const headerUDP = 1 << 31
+
+const (
+	// maxIdleTunnels limits the number of idle tunnels the relay will hold on to
+	maxIdleTunnels = 64
+	// claimTimeout is how long the relay will wait for an idle tunnel before dropping a connection
+	claimTimeout = 10 * time.Second
+	// DefaultIdle is the number of idle tunnels kept open by the client if not specified
+	DefaultIdle = 4
+)
+
+// Relay accepts tunnels from the client and connections from within the cluster, joining them together.
+type Relay struct {
+	idle chan *idleTunnel
+}
+
+// NewRelay constructs a new relay.
+func NewRelay() *Relay {
+	return &Relay{
+		idle: make(chan *idleTunnel, maxIdleTunnels),
+	}
+}
+
+// idleTunnel watches an unclaimed tunnel so that tunnels that the client has closed can be discarded.
+type idleTunnel struct {
+	conn net.Conn
+	done chan struct{}
+	n    int
+	err  error
+}
+
+func newIdleTunnel(conn net.Conn) *idleTunnel {
+	it := &idleTunnel{conn: conn, done: make(chan struct{})}
+	go func() {
+		// the client never writes before the tunnel is claimed, so this only returns when the tunnel
+		// is closed or when we interrupt it to claim the tunnel
+		var buf [1]byte
+		it.n, it.err = conn.Read(buf[:])
+		close(it.done)
+	}()
+	return it
+}
+
+// claim stops watching the tunnel and returns true if it is still usable.
+func (it *idleTunnel) claim() bool {
+	_ = it.conn.SetReadDeadline(time.Now())
+	<-it.done
+	if ne, ok := it.err.(net.Error); !ok || !ne.Timeout() || it.n != 0 {
+		it.conn.Close()
+		return false
+	}
+	_ = it.conn.SetReadDeadline(time.Time{})
+	return true
+}
+
+// ServeTunnels accepts tunnels from the client on l until l is closed.
+func (r *Relay) ServeTunnels(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		it := newIdleTunnel(conn)
+		select {
+		case r.idle <- it:
+		default:
+			// we're full, so replace the oldest tunnel which is the most likely to be dead
+			select {
+			case old := <-r.idle:
+				old.conn.Close()
+			default:
+			}
+			r.idle <- it
+		}
+	}
+}
+
+// ServePort accepts connections on l and sends each through a tunnel tagged with port until l is closed.
+func (r *Relay) ServePort(l net.Listener, port int32) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.relay(conn, port)
+	}
+}
+
+// ServeUDPPort reads datagrams from pc and sends the datagrams from each address through a tunnel tagged
+// with port until pc is closed.
+func (r *Relay) ServeUDPPort(pc net.PacketConn, port int32) error {
+	return ServeDatagrams(pc, func() (net.Conn, error) {
+		return r.claim(uint32(port) | headerUDP)
+	})
+}
+
+func (r *Relay) relay(conn net.Conn, port int32) {
+	defer conn.Close()
+	tunnel, err := r.claim(uint32(port))
+	if err != nil {
+		util.LogError("%s for connection from %s to port %d", err, conn.RemoteAddr(), port)
+		return
+	}
+	defer tunnel.Close()
+	util.Pipe(conn, tunnel)
+}
+
+// claim waits for an idle tunnel and writes the header to it.
+func (r *Relay) claim(header uint32) (net.Conn, error) {
+	timeout := time.NewTimer(claimTimeout)
+	defer timeout.Stop()
+	for {
+		var it *idleTunnel
+		select {
+		case it = <-r.idle:
+		case <-timeout.C:
+			return nil, fmt.Errorf("no tunnel available")
+		}
+		if !it.claim() {
+			continue
+		}
+
+		var hdr [headerSize]byte
+		binary.BigEndian.PutUint32(hdr[:], header)
+		if _, err := it.conn.Write(hdr[:]); err != nil {
+			it.conn.Close()
+			continue
+		}
+		return it.conn, nil
+	}
+}
+
+// Client keeps idle tunnels open to a relay and proxies the connections that arrive on them to local addresses.
+type Client struct {
+	// Dial opens a new tunnel to the relay
+	Dial func() (net.Conn, error)
+	// Targets maps the port a connection arrived on at the relay to the local address it is proxied to
+	Targets map[int32]string
+	// UDPTargets maps the UDP port datagrams arrived on at the relay to the local address they are sent to
+	UDPTargets map[int32]string
+	// Idle is the number of tunnels kept open waiting for connections, DefaultIdle if zero
+	Idle int
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+}
+
+// Run maintains the idle tunnels until stop is closed.
+func (c *Client) Run(stop <-chan struct{}) {
+	c.mu.Lock()
+	c.conns = map[net.Conn]struct{}{}
+	c.mu.Unlock()
+
+	idle := c.Idle
+	if idle <= 0 {
+		idle = DefaultIdle
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < idle; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.worker(stop)
+		}()
+	}
+
+	<-stop
+	c.mu.Lock()
+	for conn := range c.conns {
+		conn.Close()
+	}
+	c.mu.Unlock()
+	wg.Wait()
+}
+
+// worker keeps a single idle tunnel open, replacing it each time it's claimed.
+func (c *Client) worker(stop <-chan struct{}) {
+	const minDelay = 100 * time.Millisecond
+	const maxDelay = 10 * time.Second
+	delay := minDelay
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		conn, header, err := c.wait()
+		if err != nil {
+			select {
+			case <-stop:
+				return
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > maxDelay {
+				delay = maxDelay
+			}
+			continue
+		}
+		delay = minDelay
+		go c.proxy(conn, header)
+	}
+}
+
+// wait opens a tunnel and waits for the relay to claim it, returning the header that the relay wrote.
+func (c *Client) wait() (net.Conn, uint32, error) {
+	conn, err := c.Dial()
+	if err != nil {
+		return nil, 0, err
+	}
+	c.track(conn, true)
+	var hdr [headerSize]byte
+	if _, err = io.ReadFull(conn, hdr[:]); err != nil {
+		c.track(conn, false)
+		conn.Close()
+		return nil, 0, err
+	}
+	return conn, binary.BigEndian.Uint32(hdr[:]), nil
+}
+
+func (c *Client) proxy(conn net.Conn, header uint32) {
+	defer c.track(conn, false)
+	defer conn.Close()
+	port := int32(header &^ headerUDP)
+	if header&headerUDP != 0 {
+		target, ok := c.UDPTargets[port]
+		if !ok {
+			util.LogError("relay sent datagrams for unknown UDP port %d", port)
+			return
+		}
+		local, err := net.Dial("udp", target)
+		if err != nil {
+			util.LogError("error connecting to %s: %s", target, err)
+			return
+		}
+		defer local.Close()
+		PipeDatagrams(conn, local)
+		return
+	}
+
+	target, ok := c.Targets[port]
+	if !ok {
+		util.LogError("relay sent a connection for unknown port %d", port)
+		return
+	}
+	local, err := net.Dial("tcp", target)
+	if err != nil {
+		util.LogError("error connecting to %s: %s", target, err)
+		return
+	}
+	defer local.Close()
+	util.Pipe(conn, local)
+}
+
+func (c *Client) track(conn net.Conn, add bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if add {
+		c.conns[conn] = struct{}{}
+	} else {
+		delete(c.conns, conn)
+	}
+}
+
+// RelayConfig describes the ports that a relay listens on.
+type RelayConfig struct {
+	// TunnelPort accepts tunnels from the client
+	TunnelPort int32
+	// Ports accept connections and UDPPorts accept datagrams, both of which are sent through the tunnels
+	Ports    []int32
+	UDPPorts []int32
+	// UDPForwardPort is the first of the ports that accept streams of datagrams from the client, with the
+	// datagrams from the streams on UDPForwardPort+i sent to UDPForwards[i]
+	UDPForwardPort int32
+	UDPForwards    []string
+}
+
+// ListenAndServe runs a relay that listens on each of the ports in cfg.
+func ListenAndServe(cfg RelayConfig) error {
+	r := NewRelay()
+	errCh := make(chan error, len(cfg.Ports)+len(cfg.UDPPorts)+len(cfg.UDPForwards)+1)
+	tl, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.TunnelPort))
+	if err != nil {
+		return err
+	}
+	go func() { errCh <- r.ServeTunnels(tl) }()
+	for _, port := range cfg.Ports {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return err
+		}
+		port := port
+		go func() { errCh <- r.ServePort(l, port) }()
+	}
+	for _, port := range cfg.UDPPorts {
+		pc, err := net.ListenPacket("udp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return err
+		}
+		port := port
+		go func() { errCh <- r.ServeUDPPort(pc, port) }()
+	}
+	for i, target := range cfg.UDPForwards {
+		l, err := net.Listen("tcp", fmt.Sprintf(":%d", cfg.UDPForwardPort+int32(i)))
+		if err != nil {
+			return err
+		}
+		target := target
+		go func() { errCh <- ServeDatagramForward(l, target) }()
+	}
+	return <-errCh
+}
@@ -0,0 +1,224 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRelay is a relay listening on the loopback interface.
+type fakeRelay struct {
+	relay   *Relay
+	tunnels net.Listener
+	ports   map[int32]net.Listener
+}
+
+func newFakeRelay(t *testing.T, ports ...int32) *fakeRelay {
+	t.Helper()
+	fr := &fakeRelay{relay: NewRelay(), ports: map[int32]net.Listener{}}
+	var err error
+	fr.tunnels, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = fr.relay.ServeTunnels(fr.tunnels) }()
+	for _, port := range ports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fr.ports[port] = l
+		port := port
+		go func() { _ = fr.relay.ServePort(l, port) }()
+	}
+	t.Cleanup(func() {
+		fr.tunnels.Close()
+		for _, l := range fr.ports {
+			l.Close()
+		}
+	})
+	return fr
+}
+
+// dial connects to the relay as if from within the cluster on port.
+func (fr *fakeRelay) dial(t *testing.T, port int32) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", fr.ports[port].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	return conn
+}
+
+// runClient runs a client against the relay until the test finishes.
+func (fr *fakeRelay) runClient(t *testing.T, targets map[int32]string) {
+	t.Helper()
+	client := &Client{
+		Dial:    func() (net.Conn, error) { return net.Dial("tcp", fr.tunnels.Addr().String()) },
+		Targets: targets,
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Run(stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Error("client didn't stop")
+		}
+	})
+}
+
+// serve runs a local server that calls handle for each connection.
+func serve(t *testing.T, handle func(conn net.Conn)) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handle(conn)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestRelayHeader(t *testing.T) {
+	fr := newFakeRelay(t, 8080)
+
+	tun, err := net.Dial("tcp", fr.tunnels.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tun.Close()
+	_ = tun.SetDeadline(time.Now().Add(10 * time.Second))
+
+	conn := fr.dial(t, 8080)
+	var hdr [headerSize]byte
+	if _, err = io.ReadFull(tun, hdr[:]); err != nil {
+		t.Fatalf("reading header: %s", err)
+	}
+	if got := binary.BigEndian.Uint32(hdr[:]); got != 8080 {
+		t.Errorf("expected header for port 8080, got %d", got)
+	}
+
+	// after the header the tunnel carries the connection in both directions
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err = io.ReadFull(tun, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("expected ping through the tunnel, got %q, %v", buf, err)
+	}
+	if _, err = tun.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = io.ReadFull(conn, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("expected pong from the tunnel, got %q, %v", buf, err)
+	}
+}
+
+func TestClientMultipleStreams(t *testing.T) {
+	echo := serve(t, func(conn net.Conn) { _, _ = io.Copy(conn, conn) })
+	hello := serve(t, func(conn net.Conn) { _, _ = conn.Write([]byte("hello")) })
+	fr := newFakeRelay(t, 80, 443)
+	fr.runClient(t, map[int32]string{80: echo, 443: hello})
+
+	// more streams than idle tunnels at once, each must get its own data back
+	var wg sync.WaitGroup
+	for i := 0; i < 3*DefaultIdle; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			conn := fr.dial(t, 80)
+			msg := fmt.Sprintf("stream %d", i)
+			if _, err := conn.Write([]byte(msg)); err != nil {
+				t.Errorf("writing %s: %s", msg, err)
+				return
+			}
+			buf := make([]byte, len(msg))
+			if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != msg {
+				t.Errorf("expected %q, got %q, %v", msg, buf, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// connections are sent to the target for the port they arrived on
+	got, err := io.ReadAll(fr.dial(t, 443))
+	if err != nil || string(got) != "hello" {
+		t.Errorf("expected hello from port 443, got %q, %v", got, err)
+	}
+}
+
+func TestClientHalfClose(t *testing.T) {
+	// the target only responds once it has read the entire request
+	upper := serve(t, func(conn net.Conn) {
+		req, _ := io.ReadAll(conn)
+		_, _ = conn.Write([]byte(strings.ToUpper(string(req))))
+	})
+	fr := newFakeRelay(t, 80)
+	fr.runClient(t, map[int32]string{80: upper})
+
+	conn := fr.dial(t, 80)
+	if _, err := conn.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil || string(got) != "REQUEST" {
+		t.Errorf("expected REQUEST, got %q, %v", got, err)
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	// the target closes as soon as it has read a line, which must close the connection in the cluster
+	closer := serve(t, func(conn net.Conn) {
+		buf := make([]byte, 1)
+		for {
+			if _, err := conn.Read(buf); err != nil || buf[0] == '\n' {
+				return
+			}
+		}
+	})
+	fr := newFakeRelay(t, 80)
+	fr.runClient(t, map[int32]string{80: closer})
+
+	conn := fr.dial(t, 80)
+	if _, err := conn.Write([]byte("bye\n")); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF after the target closed, got %d bytes, %v", n, err)
+	}
+
+	// connections to unknown ports are closed by the client
+	fr2 := newFakeRelay(t, 80, 81)
+	fr2.runClient(t, map[int32]string{80: closer})
+	conn = fr2.dial(t, 81)
+	if n, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF for an unknown port, got %d bytes, %v", n, err)
+	}
+}
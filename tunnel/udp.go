@@ -0,0 +1,233 @@
+package tunnel
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/tzneal/supplant/util"
+)
+
+// Datagrams are carried over streams, either tunnels or port forwards, with each datagram written as a
+// big endian uint16 length followed by the datagram.  A stream carries the datagrams between a single
+// pair of addresses, so a new stream is opened for each address that datagrams arrive from.
+
+const (
+	// maxDatagramSize is the largest datagram that can be carried over a stream
+	maxDatagramSize = 65535
+	// datagramQueueSize is the number of datagrams from an address that are held while its stream is opened
+	datagramQueueSize = 64
+	// DatagramIdleTimeout is how long a stream carrying datagrams is kept open without any traffic
+	DatagramIdleTimeout = 2 * time.Minute
+)
+
+// WriteDatagram writes a single datagram to a stream.
+func WriteDatagram(w io.Writer, b []byte) error {
+	if len(b) > maxDatagramSize {
+		return fmt.Errorf("datagram of %d bytes is too large", len(b))
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadDatagram reads a single datagram from a stream into buf, which must be large enough for any datagram.
+func ReadDatagram(r io.Reader, buf []byte) (int, error) {
+	var hdr [2]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return 0, err
+	}
+	n := int(binary.BigEndian.Uint16(hdr[:]))
+	if n > len(buf) {
+		return 0, fmt.Errorf("datagram of %d bytes is larger than the buffer", n)
+	}
+	_, err := io.ReadFull(r, buf[:n])
+	return n, err
+}
+
+// PipeDatagrams copies datagrams in both directions between a stream and a connected UDP socket until either
+// side is closed or there has been no traffic for DatagramIdleTimeout.
+func PipeDatagrams(stream net.Conn, conn net.Conn) {
+	var last int64
+	touch := func() { atomic.StoreInt64(&last, time.Now().UnixNano()) }
+	idle := func() bool { return time.Since(time.Unix(0, atomic.LoadInt64(&last))) > DatagramIdleTimeout }
+	touch()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := ReadDatagram(stream, buf)
+			if err != nil {
+				break
+			}
+			touch()
+			// a failed send is a lost datagram, which the protocol on top of UDP has to handle anyway
+			_, _ = conn.Write(buf[:n])
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			_ = conn.SetReadDeadline(time.Now().Add(DatagramIdleTimeout))
+			n, err := conn.Read(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if idle() {
+					break
+				}
+				continue
+			}
+			// nothing was listening when we sent the last datagram, but something may be by the next one
+			if errors.Is(err, syscall.ECONNREFUSED) {
+				continue
+			}
+			if err != nil {
+				break
+			}
+			touch()
+			if err = WriteDatagram(stream, buf[:n]); err != nil {
+				break
+			}
+		}
+		done <- struct{}{}
+	}()
+	<-done
+}
+
+// ServeDatagrams reads datagrams from pc until it's closed, sending the datagrams from each address through
+// a stream returned by open and sending the datagrams read from the stream back to the address.
+func ServeDatagrams(pc net.PacketConn, open func() (net.Conn, error)) error {
+	closed := make(chan struct{})
+	defer close(closed)
+
+	var mu sync.Mutex
+	sessions := map[string]chan []byte{}
+	buf := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		b := append([]byte(nil), buf[:n]...)
+
+		key := addr.String()
+		mu.Lock()
+		queue, ok := sessions[key]
+		if !ok {
+			queue = make(chan []byte, datagramQueueSize)
+			sessions[key] = queue
+			go func() {
+				serveDatagramSession(pc, addr, queue, open, closed, DatagramIdleTimeout)
+				mu.Lock()
+				delete(sessions, key)
+				mu.Unlock()
+			}()
+		}
+		select {
+		case queue <- b:
+		default:
+			// the stream can't keep up, so drop the datagram as a congested network would
+		}
+		mu.Unlock()
+	}
+}
+
+// serveDatagramSession carries the datagrams between a single address and a stream until there has been no
+// traffic in either direction for idleTimeout.
+func serveDatagramSession(pc net.PacketConn, addr net.Addr, queue <-chan []byte, open func() (net.Conn, error), closed <-chan struct{}, idleTimeout time.Duration) {
+	stream, err := open()
+	if err != nil {
+		util.LogError("error opening stream for datagrams from %s: %s", addr, err)
+		return
+	}
+	defer stream.Close()
+
+	var last int64
+	touch := func() { atomic.StoreInt64(&last, time.Now().UnixNano()) }
+	touch()
+
+	replies := make(chan struct{})
+	go func() {
+		defer close(replies)
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, err := ReadDatagram(stream, buf)
+			if err != nil {
+				return
+			}
+			touch()
+			_, _ = pc.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	idle := time.NewTimer(idleTimeout)
+	defer idle.Stop()
+	for {
+		select {
+		case b := <-queue:
+			touch()
+			if err := WriteDatagram(stream, b); err != nil {
+				return
+			}
+		case <-replies:
+			return
+		case <-idle.C:
+			// wait out the rest of the timeout if there has been traffic since the timer was set
+			if remaining := idleTimeout - time.Since(time.Unix(0, atomic.LoadInt64(&last))); remaining > 0 {
+				idle.Reset(remaining)
+				continue
+			}
+			return
+		case <-closed:
+			return
+		}
+	}
+}
+
+// ServeDatagramForward accepts streams on l until it's closed, sending the datagrams from each stream to
+// the target address and the replies back through the stream.
+func ServeDatagramForward(l net.Listener, target string) error {
+	for {
+		stream, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer stream.Close()
+			conn, err := net.Dial("udp", target)
+			if err != nil {
+				util.LogError("error connecting to %s: %s", target, err)
+				return
+			}
+			defer conn.Close()
+			PipeDatagrams(stream, conn)
+		}()
+	}
+}
+
+// ProxyDatagrams reads datagrams from pc until it's closed, proxying the datagrams from each address to the
+// target address and the replies back to the address.
+func ProxyDatagrams(pc net.PacketConn, target string) error {
+	return ServeDatagrams(pc, func() (net.Conn, error) {
+		conn, err := net.Dial("udp", target)
+		if err != nil {
+			return nil, err
+		}
+		stream, local := net.Pipe()
+		go func() {
+			defer conn.Close()
+			defer local.Close()
+			PipeDatagrams(local, conn)
+		}()
+		return stream, nil
+	})
+}
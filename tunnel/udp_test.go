@@ -0,0 +1,141 @@
+package tunnel
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDatagramFraming(t *testing.T) {
+	tests := []struct {
+		name     string
+		datagram []byte
+		wantErr  bool
+	}{
+		{"empty", []byte{}, false},
+		{"small", []byte("hello"), false},
+		{"largest", bytes.Repeat([]byte{1}, maxDatagramSize), false},
+		{"too large", bytes.Repeat([]byte{1}, maxDatagramSize+1), true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var stream bytes.Buffer
+			err := WriteDatagram(&stream, tc.datagram)
+			if tc.wantErr {
+				if err == nil || stream.Len() != 0 {
+					t.Errorf("expected an error without writing, got %v with %d bytes written", err, stream.Len())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("WriteDatagram() error = %s", err)
+			}
+			if stream.Len() != 2+len(tc.datagram) {
+				t.Errorf("expected %d bytes to be written, got %d", 2+len(tc.datagram), stream.Len())
+			}
+			buf := make([]byte, maxDatagramSize)
+			n, err := ReadDatagram(&stream, buf)
+			if err != nil || !bytes.Equal(buf[:n], tc.datagram) {
+				t.Errorf("ReadDatagram() = %d, %v", n, err)
+			}
+		})
+	}
+}
+
+func TestReadDatagram(t *testing.T) {
+	tests := []struct {
+		name    string
+		stream  string
+		bufSize int
+		want    []string
+		wantErr string
+	}{
+		{"consecutive", "\x00\x02hi\x00\x00\x00\x03abc", 16, []string{"hi", "", "abc"}, "EOF"},
+		{"cut off header", "\x00", 16, nil, "unexpected EOF"},
+		{"cut off datagram", "\x00\x05abc", 16, nil, "unexpected EOF"},
+		{"larger than the buffer", "\x00\x05hello", 4, nil, "datagram of 5 bytes is larger than the buffer"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r := strings.NewReader(tc.stream)
+			buf := make([]byte, tc.bufSize)
+			var got []string
+			for {
+				n, err := ReadDatagram(r, buf)
+				if err != nil {
+					if err.Error() != tc.wantErr {
+						t.Errorf("expected error %q, got %q", tc.wantErr, err)
+					}
+					break
+				}
+				got = append(got, string(buf[:n]))
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("read %q, want %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func listenUDP(t *testing.T) net.PacketConn {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	_ = pc.SetDeadline(time.Now().Add(10 * time.Second))
+	return pc
+}
+
+func TestDatagramSessionIdle(t *testing.T) {
+	const idleTimeout = 200 * time.Millisecond
+	pc, client := listenUDP(t), listenUDP(t)
+	stream, remote := net.Pipe()
+	t.Cleanup(func() { remote.Close() })
+	_ = remote.SetDeadline(time.Now().Add(10 * time.Second))
+
+	queue := make(chan []byte, 1)
+	done := make(chan struct{})
+	go func() {
+		serveDatagramSession(pc, client.LocalAddr(), queue, func() (net.Conn, error) { return stream, nil }, nil, idleTimeout)
+		close(done)
+	}()
+
+	// datagrams are carried to the stream
+	queue <- []byte("query")
+	buf := make([]byte, maxDatagramSize)
+	if n, err := ReadDatagram(remote, buf); err != nil || string(buf[:n]) != "query" {
+		t.Fatalf("ReadDatagram() = %q, %v", buf[:n], err)
+	}
+
+	// replies alone keep the session open past the idle timeout, and are sent back to the address
+	for deadline := time.Now().Add(3 * idleTimeout); time.Now().Before(deadline); {
+		if err := WriteDatagram(remote, []byte("reply")); err != nil {
+			t.Fatalf("session closed while replies were arriving: %s", err)
+		}
+		n, _, err := client.ReadFrom(buf)
+		if err != nil || string(buf[:n]) != "reply" {
+			t.Fatalf("ReadFrom() = %q, %v", buf[:n], err)
+		}
+		time.Sleep(idleTimeout / 4)
+	}
+	select {
+	case <-done:
+		t.Fatalf("session closed while replies were arriving")
+	default:
+	}
+
+	// without any traffic it's closed
+	select {
+	case <-done:
+	case <-time.After(10 * idleTimeout):
+		t.Fatalf("expected the idle session to be closed")
+	}
+	if _, err := ReadDatagram(remote, buf); err == nil {
+		t.Errorf("expected the stream to be closed")
+	}
+}
@@ -0,0 +1,39 @@
+package util
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// closeWriter is implemented by connections that can be half-closed, such as *net.TCPConn
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// Pipe copies data in both directions between two connections until both directions are finished.  When
+// one side stops sending, the other side is half-closed so that it can still send its response.  If a
+// copy fails or a connection can't be half-closed, both connections are closed.
+func Pipe(a, b net.Conn) {
+	var closeOnce sync.Once
+	closeBoth := func() {
+		closeOnce.Do(func() {
+			a.Close()
+			b.Close()
+		})
+	}
+	var wg sync.WaitGroup
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		if _, err := io.Copy(dst, src); err == nil {
+			if cw, ok := dst.(closeWriter); ok && cw.CloseWrite() == nil {
+				return
+			}
+		}
+		closeBoth()
+	}
+	wg.Add(2)
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+}
@@ -0,0 +1,92 @@
+package util
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a TCP connection on the loopback interface.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dialed, <-accepted
+}
+
+func TestPipeHalfClose(t *testing.T) {
+	client, proxyIn := tcpPair(t)
+	proxyOut, server := tcpPair(t)
+	defer client.Close()
+	defer server.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Pipe(proxyIn, proxyOut)
+	}()
+
+	// the server only responds once it has read the whole request
+	go func() {
+		req, _ := io.ReadAll(server)
+		_, _ = server.Write(append([]byte("response to "), req...))
+		server.Close()
+	}()
+
+	if _, err := client.Write([]byte("request")); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	resp, err := io.ReadAll(client)
+	if err != nil {
+		t.Fatalf("reading response: %s", err)
+	}
+	if got, want := string(resp), "response to request"; got != want {
+		t.Errorf("got response %q, want %q", got, want)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pipe didn't return after both directions finished")
+	}
+}
+
+func TestPipeWithoutHalfClose(t *testing.T) {
+	// net.Pipe connections can't be half-closed, so both sides are closed when either finishes
+	a, proxyIn := net.Pipe()
+	proxyOut, b := net.Pipe()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		Pipe(proxyIn, proxyOut)
+	}()
+
+	a.Close()
+	_ = b.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("expected EOF, got %v", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Pipe didn't return")
+	}
+}
@@ -0,0 +1,25 @@
+package util
+
+import (
+	"net"
+)
+
+// Proxy accepts connections on l and proxies each of them to the target address until l is closed.
+func Proxy(l net.Listener, target string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			remote, err := net.Dial("tcp", target)
+			if err != nil {
+				LogError("error connecting to %s: %s", target, err)
+				return
+			}
+			defer remote.Close()
+			Pipe(conn, remote)
+		}()
+	}
+}